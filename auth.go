@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator checks the credential a client sends back in
+// answer to the PacketAuth challenge and decides which ClientID
+// the connection belongs to. Failures should be one of the
+// ERROR_INVALID_AUTH_* errors so they map to a status code
+type Authenticator interface {
+	Authenticate(challenge ClientID, credential []byte) (ClientID, error)
+}
+
+// EchoAuthenticator is the original handshake, the client
+// proves it can read the challenge by sending it back. It
+// doesn't prove anything else so only use it for local play
+type EchoAuthenticator struct{}
+
+func (EchoAuthenticator) Authenticate(challenge ClientID, credential []byte) (ClientID, error) {
+	if ClientID(credential) != challenge {
+		return "", ERROR_INVALID_AUTH_ID
+	}
+	return challenge, nil
+}
+
+// TokenClaims is the signed body of a bearer token
+type TokenClaims struct {
+	ClientID ClientID `json:"sub"`
+	Expires  int64    `json:"exp"`
+}
+
+// TokenAuthenticator accepts HMAC-SHA256 signed bearer tokens of
+// the form base64(claims).base64(signature). Tokens are minted
+// with Issue by whoever shares the secret, usually a login service
+type TokenAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func NewTokenAuthenticator(secret []byte) *TokenAuthenticator {
+	return &TokenAuthenticator{
+		secret: secret,
+		now:    time.Now,
+	}
+}
+
+// Issue signs a token for id that is good for ttl
+func (a *TokenAuthenticator) Issue(id ClientID, ttl time.Duration) (string, error) {
+	claims, err := json.Marshal(TokenClaims{ClientID: id, Expires: a.now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(claims)
+	return body + "." + base64.RawURLEncoding.EncodeToString(a.sign(body)), nil
+}
+
+func (a *TokenAuthenticator) Authenticate(challenge ClientID, credential []byte) (ClientID, error) {
+	body, sig, ok := strings.Cut(string(credential), ".")
+	if !ok {
+		return "", ERROR_INVALID_AUTH_PKT
+	}
+
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", ERROR_INVALID_AUTH_PKT
+	}
+
+	// check the signature before trusting anything in the body
+	if !hmac.Equal(got, a.sign(body)) {
+		return "", ERROR_INVALID_AUTH_ID
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return "", ERROR_INVALID_AUTH_PKT
+	}
+
+	var claims TokenClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return "", ERROR_INVALID_AUTH_PKT
+	}
+
+	if !validClientID(claims.ClientID) || a.now().Unix() >= claims.Expires {
+		return "", ERROR_INVALID_AUTH_ID
+	}
+
+	return claims.ClientID, nil
+}
+
+func (a *TokenAuthenticator) sign(body string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+const (
+	PASSWORD_ITERATIONS = 100000
+	PASSWORD_SALT_SIZE  = 16
+	PASSWORD_KEY_SIZE   = 32
+)
+
+// PasswordCredential is what a client sends in PacketAuth
+// when the server is using a PasswordAuthenticator
+type PasswordCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type account struct {
+	id   ClientID
+	salt []byte
+	hash []byte
+}
+
+// PasswordAuthenticator is a local username and password store.
+// Passwords are only ever kept as salted PBKDF2-SHA256 hashes
+// and every user keeps the same ClientID across logins
+type PasswordAuthenticator struct {
+	mu       sync.RWMutex
+	accounts map[string]*account
+	// hashed against when the username is unknown so a miss
+	// takes as long as a wrong password
+	dummy *account
+}
+
+func NewPasswordAuthenticator() *PasswordAuthenticator {
+	return &PasswordAuthenticator{
+		accounts: make(map[string]*account),
+		dummy:    newAccount("", ""),
+	}
+}
+
+func newAccount(id ClientID, password string) *account {
+	salt := make([]byte, PASSWORD_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+
+	return &account{
+		id:   id,
+		salt: salt,
+		hash: pbkdf2(sha256.New, []byte(password), salt, PASSWORD_ITERATIONS, PASSWORD_KEY_SIZE),
+	}
+}
+
+// AddUser stores username with a new ClientID, replacing
+// the password of an existing user. It returns the
+// ClientID the user will be authenticated as
+func (a *PasswordAuthenticator) AddUser(username, password string) ClientID {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	id := GenerateClientId()
+	if acc, ok := a.accounts[username]; ok {
+		id = acc.id
+	}
+	a.accounts[username] = newAccount(id, password)
+
+	return id
+}
+
+func (a *PasswordAuthenticator) RemoveUser(username string) {
+	a.mu.Lock()
+	delete(a.accounts, username)
+	a.mu.Unlock()
+}
+
+func (a *PasswordAuthenticator) Authenticate(challenge ClientID, credential []byte) (ClientID, error) {
+	var cred PasswordCredential
+	if err := json.Unmarshal(credential, &cred); err != nil || cred.Username == "" {
+		return "", ERROR_INVALID_AUTH_PKT
+	}
+
+	a.mu.RLock()
+	acc, ok := a.accounts[cred.Username]
+	a.mu.RUnlock()
+	if !ok {
+		acc = a.dummy
+	}
+
+	hash := pbkdf2(sha256.New, []byte(cred.Password), acc.salt, PASSWORD_ITERATIONS, PASSWORD_KEY_SIZE)
+	if subtle.ConstantTimeCompare(hash, acc.hash) != 1 || !ok {
+		return "", ERROR_INVALID_AUTH_ID
+	}
+
+	return acc.id, nil
+}
+
+// pbkdf2 derives a key from password as described in RFC 8018 5.2
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	size := prf.Size()
+	blocks := (keyLen + size - 1) / size
+
+	key := make([]byte, 0, blocks*size)
+	u := make([]byte, size)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, uint32(block)))
+		u = prf.Sum(u[:0])
+
+		t := make([]byte, size)
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
+
+// game state packets carry the ClientID as 8 bytes
+func validClientID(id ClientID) bool {
+	return len(id) == 8
+}
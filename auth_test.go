@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEchoAuthenticator(t *testing.T) {
+	auth := EchoAuthenticator{}
+
+	id, err := auth.Authenticate("12345678", []byte("12345678"))
+	if err != nil || id != "12345678" {
+		t.Fatalf("Expected echoed challenge to authenticate. Got %q, %v", id, err)
+	}
+
+	if _, err := auth.Authenticate("12345678", []byte("87654321")); err != ERROR_INVALID_AUTH_ID {
+		t.Fatalf("Expected %v. Got %v", ERROR_INVALID_AUTH_ID, err)
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	auth := NewTokenAuthenticator([]byte("secret"))
+
+	token, err := auth.Issue("12345678", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := auth.Authenticate("", []byte(token))
+	if err != nil || id != "12345678" {
+		t.Fatalf("Expected token to authenticate. Got %q, %v", id, err)
+	}
+
+	forged, _ := NewTokenAuthenticator([]byte("not the secret")).Issue("12345678", time.Minute)
+	expired, _ := auth.Issue("12345678", -time.Second)
+	badID, _ := auth.Issue("1234", time.Minute)
+	body, sig, _ := strings.Cut(token, ".")
+
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"forged", forged, ERROR_INVALID_AUTH_ID},
+		{"expired", expired, ERROR_INVALID_AUTH_ID},
+		{"bad client id", badID, ERROR_INVALID_AUTH_ID},
+		{"tampered", body + "x." + sig, ERROR_INVALID_AUTH_ID},
+		{"no signature", body, ERROR_INVALID_AUTH_PKT},
+		{"bad encoding", body + ".!!", ERROR_INVALID_AUTH_PKT},
+	}
+
+	for _, c := range cases {
+		if _, err := auth.Authenticate("", []byte(c.token)); err != c.err {
+			t.Errorf("%s: expected %v. Got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestPasswordAuthenticator(t *testing.T) {
+	auth := NewPasswordAuthenticator()
+	id := auth.AddUser("craig", "hunter2")
+
+	login := func(username, password string) (ClientID, error) {
+		cred, _ := json.Marshal(PasswordCredential{Username: username, Password: password})
+		return auth.Authenticate("", cred)
+	}
+
+	got, err := login("craig", "hunter2")
+	if err != nil || got != id {
+		t.Fatalf("Expected %q. Got %q, %v", id, got, err)
+	}
+
+	if _, err := login("craig", "hunter3"); err != ERROR_INVALID_AUTH_ID {
+		t.Fatalf("Wrong password: expected %v. Got %v", ERROR_INVALID_AUTH_ID, err)
+	}
+	if _, err := login("nobody", "hunter2"); err != ERROR_INVALID_AUTH_ID {
+		t.Fatalf("Unknown user: expected %v. Got %v", ERROR_INVALID_AUTH_ID, err)
+	}
+	if _, err := auth.Authenticate("", []byte("craig:hunter2")); err != ERROR_INVALID_AUTH_PKT {
+		t.Fatalf("Malformed credential: expected %v. Got %v", ERROR_INVALID_AUTH_PKT, err)
+	}
+
+	// changing the password keeps the ClientID
+	if auth.AddUser("craig", "hunter3") != id {
+		t.Fatal("Expected ClientID to survive a password change")
+	}
+	if _, err := login("craig", "hunter2"); err != ERROR_INVALID_AUTH_ID {
+		t.Fatalf("Old password: expected %v. Got %v", ERROR_INVALID_AUTH_ID, err)
+	}
+}
+
+// RFC 7914 section 11 test vector for PBKDF2-HMAC-SHA256
+func TestPBKDF2(t *testing.T) {
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+
+	got := hex.EncodeToString(pbkdf2(sha256.New, []byte("passwd"), []byte("salt"), 1, 64))
+	if got != want {
+		t.Fatalf("Expected %s. Got %s", want, got)
+	}
+}
+
+func TestServerTokenAuth(t *testing.T) {
+	auth := NewTokenAuthenticator([]byte("secret"))
+
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	hub.SetAuthenticator(auth)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+
+	login := func(credential string) (*PacketFramer, *Client) {
+		conn, err := net.Dial("tcp", server.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClient(conn)
+
+		framer := NewPacketFramer()
+		go FrameWithReader(framer, client.conn)
+		if _, err := expectPacket(framer.C, PacketAuth); err != nil {
+			t.Fatal(err)
+		}
+		client.Write(ConstructPacket(EncString, PacketAuth, []byte(credential)).data)
+
+		return framer, client
+	}
+
+	// echoing the challenge is no longer enough
+	framer, client := login("12345678")
+	defer client.Disconnect()
+	if err := expectError(framer.C, ERROR_INVALID_AUTH_PKT); err != nil {
+		t.Fatal(err)
+	}
+
+	token, _ := auth.Issue("12345678", time.Minute)
+	framer, client = login(token)
+	defer client.Disconnect()
+	if _, err := expectPacket(framer.C, PacketSessionToken); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	if _, err := expectPacket(framer.C, PacketCreateGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDuplicateLogin(t *testing.T) {
+	auth := NewTokenAuthenticator([]byte("secret"))
+
+	hub := NewHub()
+	hub.SetAuthenticator(auth)
+	defer hub.Close()
+	mem := NewMemTransport(hub)
+
+	token, _ := auth.Issue("12345678", time.Minute)
+	login := func() (*PacketFramer, *Client) {
+		client := NewClient(mem.Dial())
+		framer := NewPacketFramer()
+		go FrameWithReader(framer, client.conn)
+		if _, err := expectPacket(framer.C, PacketAuth); err != nil {
+			t.Fatal(err)
+		}
+		client.Write(ConstructPacket(EncString, PacketAuth, []byte(token)).data)
+		return framer, client
+	}
+
+	framer, first := login()
+	if _, err := expectPacket(framer.C, PacketSessionToken); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same token can't log in twice at once
+	framer, second := login()
+	defer second.Disconnect()
+	if err := expectError(framer.C, ERROR_ALREADY_LOGGED_IN); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the first is gone it can again
+	first.Write(ConstructPacket(EncString, PacketDisconnect, []byte{}).data)
+	first.Disconnect()
+	time.Sleep(time.Millisecond * 50)
+
+	framer, third := login()
+	defer third.Disconnect()
+	if _, err := expectPacket(framer.C, PacketSessionToken); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const header = "Code generated by protogen from protocol.json. DO NOT EDIT."
+
+// GenerateGo emits the constants, enums, stringers, message
+// types and per packet encode/decode functions for the server
+func GenerateGo(s *Schema) ([]byte, error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// %s\n\npackage main\n\n", header)
+	if imports := goImports(s); len(imports) > 0 {
+		b.WriteString("import (\n")
+		for _, imp := range imports {
+			fmt.Fprintf(&b, "\t%q\n", imp)
+		}
+		b.WriteString(")\n\n")
+	}
+
+	goConstants(&b, s)
+	goAliases(&b, s)
+	for _, e := range s.Enums {
+		goEnum(&b, e)
+	}
+	for i := range s.Messages {
+		goMessage(&b, s, &s.Messages[i])
+	}
+	goPackets(&b, s)
+
+	src, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return nil, fmt.Errorf("generated Go doesn't parse: %w", err)
+	}
+	return src, nil
+}
+
+func goImports(s *Schema) []string {
+	set := map[string]bool{}
+	for _, m := range s.Messages {
+		for _, f := range m.Fields {
+			switch baseType(f.Type) {
+			case "raw":
+				set["encoding/json"] = true
+			case "time":
+				set["time"] = true
+			}
+		}
+		for _, slot := range m.Layout {
+			if slot.Size == 2 || slot.Size == 8 {
+				set["encoding/binary"] = true
+			}
+		}
+	}
+
+	imports := make([]string, 0, len(set))
+	for imp := range set {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+func goDoc(b *strings.Builder, doc string) {
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		fmt.Fprintf(b, "// %s\n", line)
+	}
+}
+
+func goConstants(b *strings.Builder, s *Schema) {
+	b.WriteString("const (\n")
+	for _, c := range s.Constants {
+		goDoc(b, c.Doc)
+		value := c.Expr
+		if c.Value != nil {
+			value = strconv.Itoa(*c.Value)
+		}
+		if c.Type != "" {
+			value = fmt.Sprintf("%s(%s)", c.Type, value)
+		}
+		fmt.Fprintf(b, "%s = %s\n", c.Name, value)
+	}
+	b.WriteString(")\n\n")
+
+	// offsets of every layout that names them
+	for _, m := range s.Messages {
+		offset := 0
+		named := false
+		for _, slot := range m.Layout {
+			if slot.Offset == "" {
+				offset += slot.Size
+				continue
+			}
+			if !named {
+				fmt.Fprintf(b, "// offsets into the %s layout\nconst (\n", m.Name)
+				named = true
+			}
+			fmt.Fprintf(b, "%s = uint8(%d)\n", slot.Offset, offset)
+			offset += slot.Size
+		}
+		if named {
+			b.WriteString(")\n\n")
+		}
+	}
+}
+
+func goAliases(b *strings.Builder, s *Schema) {
+	if len(s.Types) == 0 {
+		return
+	}
+	b.WriteString("type (\n")
+	for _, a := range s.Types {
+		fmt.Fprintf(b, "%s %s\n", a.Name, a.Type)
+	}
+	b.WriteString(")\n\n")
+}
+
+func goEnum(b *strings.Builder, e Enum) {
+	goDoc(b, e.Doc)
+	fmt.Fprintf(b, "type %s %s\n\nconst (\n", e.Name, e.Type)
+	for i, v := range e.Values {
+		line := v.Name
+		if i == 0 {
+			line += " " + e.Name + " = iota"
+			if e.Start != 0 {
+				line += " + " + strconv.Itoa(e.Start)
+			}
+		}
+		if v.Doc != "" {
+			line += " // " + v.Doc
+		}
+		b.WriteString(line + "\n")
+	}
+	if e.Count != "" {
+		b.WriteString(e.Count + "\n")
+	}
+	b.WriteString(")\n\n")
+
+	if e.Stringer == "" {
+		return
+	}
+	fmt.Fprintf(b, "func %s(v %s) string {\nswitch v {\n", e.Stringer, e.Name)
+	for _, v := range e.Values {
+		str := v.String
+		if str == "" {
+			str = v.Name
+		}
+		fmt.Fprintf(b, "case %s:\nreturn %q\n", v.Name, str)
+	}
+	fmt.Fprintf(b, "}\nreturn %q\n}\n\n", e.Default)
+}
+
+func goType(t string) string {
+	prefix := t[:len(t)-len(baseType(t))]
+	switch baseType(t) {
+	case "raw":
+		return prefix + "json.RawMessage"
+	case "time":
+		return prefix + "time.Time"
+	}
+	return t
+}
+
+func goMessage(b *strings.Builder, s *Schema, m *Message) {
+	goDoc(b, m.Doc)
+	fmt.Fprintf(b, "type %s struct {\n", m.Name)
+	if m.Embed != "" {
+		b.WriteString(m.Embed + "\n")
+	}
+	for _, f := range m.Fields {
+		tag := f.JSON
+		if f.Optional {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(b, "%s %s `json:%q`", f.Name, goType(f.Type), tag)
+		if f.Doc != "" {
+			b.WriteString(" // " + f.Doc)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n\n")
+
+	if len(m.Layout) == 0 {
+		return
+	}
+	goLayout(b, s, m)
+
+	// the other encodings share the custom layout
+	for _, enc := range m.layoutEncodings()[1:] {
+		methods := layoutMethods[enc]
+		fmt.Fprintf(b, "func (m %s) %s() ([]byte, error) {\nreturn m.MarshalCustom()\n}\n\n", m.Name, methods[0])
+		fmt.Fprintf(b, "func (m *%s) %s(data []byte) error {\nreturn m.UnmarshalCustom(data)\n}\n\n", m.Name, methods[1])
+	}
+}
+
+// goLayout emits MarshalCustom and UnmarshalCustom for m
+func goLayout(b *strings.Builder, s *Schema, m *Message) {
+	fixed := m.fixedSize()
+	offset := 0
+	var marshal, unmarshal strings.Builder
+
+	for _, slot := range m.Layout {
+		f := m.field(slot.Field)
+		at := strconv.Itoa(offset)
+		if slot.Offset != "" {
+			at = slot.Offset
+		}
+		end := at + "+" + strconv.Itoa(slot.Size)
+
+		switch kind := s.kind(f.Type); {
+		case slot.Rest:
+			fmt.Fprintf(&marshal, "buf = append(buf, m.%s...)\n", f.Name)
+			fmt.Fprintf(&unmarshal, "m.%s = %s(data[%s:])\n", f.Name, goType(f.Type), at)
+		case kind == "string":
+			fmt.Fprintf(&marshal, "copy(buf[%s:%s], m.%s)\n", at, end, f.Name)
+			fmt.Fprintf(&unmarshal, "m.%s = %s(data[%s:%s])\n", f.Name, f.Type, at, end)
+		case kind == "uint8":
+			fmt.Fprintf(&marshal, "buf[%s] = uint8(m.%s)\n", at, f.Name)
+			fmt.Fprintf(&unmarshal, "m.%s = %s(data[%s])\n", f.Name, f.Type, at)
+		case kind == "uint16":
+			fmt.Fprintf(&marshal, "binary.BigEndian.PutUint16(buf[%s:], uint16(m.%s))\n", at, f.Name)
+			fmt.Fprintf(&unmarshal, "m.%s = %s(binary.BigEndian.Uint16(data[%s:]))\n", f.Name, f.Type, at)
+		case kind == "uint64":
+			fmt.Fprintf(&marshal, "binary.BigEndian.PutUint64(buf[%s:], uint64(m.%s))\n", at, f.Name)
+			fmt.Fprintf(&unmarshal, "m.%s = %s(binary.BigEndian.Uint64(data[%s:]))\n", f.Name, f.Type, at)
+		}
+		offset += slot.Size
+	}
+
+	capacity := strconv.Itoa(fixed)
+	if m.hasRest() {
+		rest := m.Layout[len(m.Layout)-1].Field
+		capacity += "+len(m." + rest + ")"
+	}
+	fmt.Fprintf(b, "func (m %s) MarshalCustom() ([]byte, error) {\nbuf := make([]byte, %d, %s)\n%sreturn buf, nil\n}\n\n",
+		m.Name, fixed, capacity, marshal.String())
+
+	errName := m.Error
+	if errName == "" {
+		errName = "ERROR_INVALID_PAYLOAD"
+	}
+	check := ""
+	switch {
+	case !m.hasRest():
+		check = fmt.Sprintf("if len(data) != %d {\nreturn %s\n}\n\n", fixed, errName)
+	case fixed > 0:
+		check = fmt.Sprintf("if len(data) < %d {\nreturn %s\n}\n\n", fixed, errName)
+	}
+	fmt.Fprintf(b, "func (m *%s) UnmarshalCustom(data []byte) error {\n%s%sreturn nil\n}\n\n",
+		m.Name, check, unmarshal.String())
+}
+
+// goPackets emits a typed Encode and Decode for every
+// packet type that carries a message
+func goPackets(b *strings.Builder, s *Schema) {
+	for _, e := range s.Enums {
+		for _, v := range e.Values {
+			if v.Message == "" {
+				continue
+			}
+			name := strings.TrimPrefix(v.Name, "Packet")
+
+			fmt.Fprintf(b, "// Encode%s wraps msg in a %s\n", name, v.Name)
+			fmt.Fprintf(b, "func Encode%s(enc Encoding, msg %s) (Packet, error) {\nreturn Encode(enc, %s, msg)\n}\n\n", name, v.Message, v.Name)
+
+			fmt.Fprintf(b, "// Decode%s decodes the %s carried by a %s\n", name, v.Message, v.Name)
+			fmt.Fprintf(b, "func Decode%s(p *Packet) (%s, error) {\nvar msg %s\nerr := Decode(p, &msg)\nreturn msg, err\n}\n\n", name, v.Message, v.Message)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Command protogen generates the Go and TypeScript protocol bindings
+// from protocol.json so the server and the web client can't drift
+//
+//	go run ./cmd/protogen -schema protocol.json -go protocol_gen.go -ts web/src/protocol.ts
+//
+// With -check nothing is written, it fails if either file is stale
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	schemaPath := flag.String("schema", "protocol.json", "protocol definition")
+	goPath := flag.String("go", "protocol_gen.go", "Go output")
+	tsPath := flag.String("ts", "web/src/protocol.ts", "TypeScript output")
+	check := flag.Bool("check", false, "fail if the outputs are out of date instead of writing them")
+	flag.Parse()
+
+	schema, err := Load(*schemaPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	goSrc, err := GenerateGo(schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tsSrc := GenerateTS(schema)
+
+	stale := false
+	for path, src := range map[string][]byte{*goPath: goSrc, *tsPath: tsSrc} {
+		if !*check {
+			if err := os.WriteFile(path, src, 0644); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+
+		old, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(old, src) {
+			fmt.Fprintf(os.Stderr, "%s is out of date, run go generate\n", path)
+			stale = true
+		}
+	}
+
+	if stale {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the checked in bindings have to match what the schema generates
+func TestGeneratedUpToDate(t *testing.T) {
+	s, err := Load("../../protocol.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goSrc, err := GenerateGo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, src := range map[string][]byte{
+		"../../protocol_gen.go":     goSrc,
+		"../../web/src/protocol.ts": GenerateTS(s),
+	} {
+		old, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(old, src) {
+			t.Errorf("%s is out of date, run go generate", path)
+		}
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema Schema
+		err    string
+	}{
+		{
+			"unknown field type",
+			Schema{Messages: []Message{{Name: "M", Fields: []Field{{Name: "A", Type: "Nope"}}}}},
+			"unknown type",
+		},
+		{
+			"unknown packet message",
+			Schema{Enums: []Enum{{Name: "PacketType", Values: []EnumValue{{Name: "PacketA", Message: "Nope"}}}}},
+			"unknown message",
+		},
+		{
+			"rest before the end",
+			Schema{Messages: []Message{{
+				Name:   "M",
+				Fields: []Field{{Name: "A", Type: "string"}, {Name: "B", Type: "uint8"}},
+				Layout: []Slot{{Field: "A", Rest: true}, {Field: "B", Size: 1}},
+			}}},
+			"before the end",
+		},
+		{
+			"slot too small",
+			Schema{Messages: []Message{{
+				Name:   "M",
+				Fields: []Field{{Name: "A", Type: "uint16"}},
+				Layout: []Slot{{Field: "A", Size: 1}},
+			}}},
+			"doesn't fit",
+		},
+		{
+			"encodings without a layout",
+			Schema{Messages: []Message{{Name: "M", Encodings: []string{"EncBytes"}}}},
+			"without a layout",
+		},
+		{
+			"layout as json",
+			Schema{Messages: []Message{{
+				Name:      "M",
+				Fields:    []Field{{Name: "A", Type: "string"}},
+				Layout:    []Slot{{Field: "A", Rest: true}},
+				Encodings: []string{"EncJSON"},
+			}}},
+			"can't use a layout",
+		},
+	}
+
+	for _, c := range cases {
+		err := c.schema.validate()
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing %q. Got %v", c.name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Schema struct {
+	Types     []Alias    `json:"types"`
+	Enums     []Enum     `json:"enums"`
+	Constants []Constant `json:"constants"`
+	Messages  []Message  `json:"messages"`
+}
+
+// Alias is a named type over a builtin, like ClientID
+type Alias struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type Enum struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Doc  string `json:"doc"`
+	// value of the first entry, the rest count up from it
+	Start int `json:"start"`
+	// name of the Go function turning a value into a string,
+	// and what it returns for values it doesn't know
+	Stringer string `json:"stringer"`
+	Default  string `json:"default"`
+	// name of a Go constant one past the last value, for
+	// looping over all of them. Left out of the TypeScript
+	Count  string      `json:"count"`
+	Values []EnumValue `json:"values"`
+}
+
+type EnumValue struct {
+	Name string `json:"name"`
+	// what the stringer returns, the name by default
+	String string `json:"string"`
+	Doc    string `json:"doc"`
+	// message carried by packets of this type, PacketType only
+	Message string `json:"message"`
+}
+
+type Constant struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value *int   `json:"value"`
+	// expression in terms of other constants, used instead of Value
+	Expr string `json:"expr"`
+	Doc  string `json:"doc"`
+}
+
+type Message struct {
+	Name   string  `json:"name"`
+	Doc    string  `json:"doc"`
+	Embed  string  `json:"embed"`
+	Fields []Field `json:"fields"`
+	// binary layout used for EncCustom, and for EncBytes and
+	// EncString when they are listed in Encodings
+	Layout    []Slot   `json:"layout"`
+	Encodings []string `json:"encodings"`
+	// error returned for a payload of the wrong size
+	Error string `json:"error"`
+}
+
+type Field struct {
+	Name     string `json:"name"`
+	JSON     string `json:"json"`
+	Type     string `json:"type"`
+	Doc      string `json:"doc"`
+	Optional bool   `json:"optional"`
+}
+
+// Slot places a field in a layout. Fields follow each other in
+// order, a rest field takes whatever is left and has to be last
+type Slot struct {
+	Field string `json:"field"`
+	Size  int    `json:"size"`
+	Rest  bool   `json:"rest"`
+	// name of the offset constant to generate, if any
+	Offset string `json:"offset"`
+}
+
+func Load(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+var builtins = map[string]bool{
+	"string": true,
+	"bool":   true,
+	"int":    true,
+	"uint8":  true,
+	"uint16": true,
+	"uint64": true,
+	"raw":    true,
+	"time":   true,
+}
+
+func (s *Schema) validate() error {
+	known := map[string]bool{}
+	for name := range builtins {
+		known[name] = true
+	}
+	for _, a := range s.Types {
+		known[a.Name] = true
+	}
+	for _, e := range s.Enums {
+		known[e.Name] = true
+	}
+	messages := map[string]*Message{}
+	for i := range s.Messages {
+		known[s.Messages[i].Name] = true
+		messages[s.Messages[i].Name] = &s.Messages[i]
+	}
+
+	for _, e := range s.Enums {
+		for _, v := range e.Values {
+			if v.Message != "" && messages[v.Message] == nil {
+				return fmt.Errorf("%s carries unknown message %s", v.Name, v.Message)
+			}
+		}
+	}
+
+	for _, m := range s.Messages {
+		if m.Embed != "" && messages[m.Embed] == nil {
+			return fmt.Errorf("%s embeds unknown message %s", m.Name, m.Embed)
+		}
+
+		for _, f := range m.Fields {
+			if !known[baseType(f.Type)] {
+				return fmt.Errorf("%s.%s has unknown type %s", m.Name, f.Name, f.Type)
+			}
+		}
+
+		for i, slot := range m.Layout {
+			f := m.field(slot.Field)
+			if f == nil {
+				return fmt.Errorf("%s layout has unknown field %s", m.Name, slot.Field)
+			}
+			if slot.Rest && i != len(m.Layout)-1 {
+				return fmt.Errorf("%s layout has rest field %s before the end", m.Name, slot.Field)
+			}
+			if !slot.Rest {
+				if err := s.checkSlot(m, slot, f); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(m.Encodings) > 0 && len(m.Layout) == 0 {
+			return fmt.Errorf("%s lists encodings without a layout", m.Name)
+		}
+		for _, enc := range m.Encodings {
+			if _, ok := layoutMethods[enc]; !ok {
+				return fmt.Errorf("%s can't use a layout for %s", m.Name, enc)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkSlot makes sure a fixed size slot fits its field
+func (s *Schema) checkSlot(m Message, slot Slot, f *Field) error {
+	switch kind := s.kind(f.Type); {
+	case kind == "string" && slot.Size > 0:
+		return nil
+	case kind == "uint8" && slot.Size == 1,
+		kind == "uint16" && slot.Size == 2,
+		kind == "uint64" && slot.Size == 8:
+		return nil
+	}
+	return fmt.Errorf("%s.%s of type %s doesn't fit %d bytes", m.Name, f.Name, f.Type, slot.Size)
+}
+
+// kind resolves aliases and enums down to the builtin they are
+func (s *Schema) kind(t string) string {
+	for _, a := range s.Types {
+		if a.Name == t {
+			return a.Type
+		}
+	}
+	for _, e := range s.Enums {
+		if e.Name == t {
+			return e.Type
+		}
+	}
+	return t
+}
+
+func (m *Message) field(name string) *Field {
+	for i := range m.Fields {
+		if m.Fields[i].Name == name {
+			return &m.Fields[i]
+		}
+	}
+	return nil
+}
+
+// fixedSize is the size of everything in the layout
+// up to the rest field, if there is one
+func (m *Message) fixedSize() int {
+	n := 0
+	for _, slot := range m.Layout {
+		n += slot.Size
+	}
+	return n
+}
+
+func (m *Message) hasRest() bool {
+	return len(m.Layout) > 0 && m.Layout[len(m.Layout)-1].Rest
+}
+
+// baseType strips slices and pointers off t
+func baseType(t string) string {
+	return strings.TrimLeft(t, "[]*")
+}
+
+// layoutMethods are the Go methods a layout is exposed
+// through for each encoding it can be sent as
+var layoutMethods = map[string][2]string{
+	"EncCustom": {"MarshalCustom", "UnmarshalCustom"},
+	"EncBytes":  {"MarshalBinary", "UnmarshalBinary"},
+	"EncString": {"MarshalText", "UnmarshalText"},
+}
+
+// layoutEncodings is every encoding m uses its layout for
+func (m *Message) layoutEncodings() []string {
+	if len(m.Layout) == 0 {
+		return nil
+	}
+	encs := []string{"EncCustom"}
+	for _, enc := range m.Encodings {
+		if enc != "EncCustom" {
+			encs = append(encs, enc)
+		}
+	}
+	return encs
+}
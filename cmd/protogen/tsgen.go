@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GenerateTS emits the matching web client module: the same
+// enums, constants and messages plus functions to frame v1
+// packets and encode or decode the message each one carries
+func GenerateTS(s *Schema) []byte {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// %s\n\n", header)
+
+	for _, a := range s.Types {
+		fmt.Fprintf(&b, "export type %s = %s;\n", a.Name, tsType(s, a.Type))
+	}
+	b.WriteString("\n")
+
+	for _, c := range s.Constants {
+		tsDoc(&b, c.Doc)
+		value := c.Expr
+		if c.Value != nil {
+			value = strconv.Itoa(*c.Value)
+		}
+		fmt.Fprintf(&b, "export const %s = %s;\n", c.Name, value)
+	}
+	b.WriteString("\n")
+
+	for _, m := range s.Messages {
+		offset := 0
+		for _, slot := range m.Layout {
+			if slot.Offset != "" {
+				fmt.Fprintf(&b, "export const %s = %d;\n", slot.Offset, offset)
+			}
+			offset += slot.Size
+		}
+	}
+	b.WriteString("\n")
+
+	for _, e := range s.Enums {
+		tsDoc(&b, e.Doc)
+		fmt.Fprintf(&b, "export enum %s {\n", e.Name)
+		for i, v := range e.Values {
+			line := "  " + v.Name
+			if i == 0 && e.Start != 0 {
+				line += " = " + strconv.Itoa(e.Start)
+			}
+			line += ","
+			if v.Doc != "" {
+				line += " // " + v.Doc
+			}
+			b.WriteString(line + "\n")
+		}
+		b.WriteString("}\n\n")
+	}
+
+	for i := range s.Messages {
+		tsMessage(&b, s, &s.Messages[i])
+	}
+
+	b.WriteString(tsFraming)
+
+	for i := range s.Messages {
+		tsCodec(&b, s, &s.Messages[i])
+	}
+
+	for _, e := range s.Enums {
+		for _, v := range e.Values {
+			if v.Message == "" {
+				continue
+			}
+			name := strings.TrimPrefix(v.Name, "Packet")
+			fmt.Fprintf(&b, "export function encode%s(msg: %s, enc: Encoding = Encoding.EncJSON): Uint8Array {\n", name, v.Message)
+			fmt.Fprintf(&b, "  return encodePacket(enc, PacketType.%s, encode%sPayload(msg, enc));\n}\n\n", v.Name, v.Message)
+			fmt.Fprintf(&b, "export function decode%s(pkt: Packet): %s {\n", name, v.Message)
+			fmt.Fprintf(&b, "  return decode%sPayload(pkt.data, pkt.encoding);\n}\n\n", v.Message)
+		}
+	}
+
+	return []byte(strings.TrimRight(b.String(), "\n") + "\n")
+}
+
+func tsDoc(b *strings.Builder, doc string) {
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		fmt.Fprintf(b, "// %s\n", line)
+	}
+}
+
+func tsType(s *Schema, t string) string {
+	if strings.HasPrefix(t, "[]") {
+		return tsType(s, t[2:]) + "[]"
+	}
+	t = strings.TrimPrefix(t, "*")
+
+	switch t {
+	case "string", "time":
+		return "string"
+	case "bool":
+		return "boolean"
+	case "int", "uint8", "uint16":
+		return "number"
+	case "uint64":
+		return "bigint"
+	case "raw":
+		return "unknown"
+	}
+	return t
+}
+
+func tsMessage(b *strings.Builder, s *Schema, m *Message) {
+	tsDoc(b, m.Doc)
+	fmt.Fprintf(b, "export type %s = ", m.Name)
+	if m.Embed != "" {
+		fmt.Fprintf(b, "%s & ", m.Embed)
+	}
+	b.WriteString("{\n")
+	for _, f := range m.Fields {
+		name := f.JSON
+		if f.Optional {
+			name += "?"
+		}
+		fmt.Fprintf(b, "  %s: %s;", name, tsType(s, f.Type))
+		if f.Doc != "" {
+			b.WriteString(" // " + f.Doc)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("};\n\n")
+}
+
+// tsFraming is the part of the module that doesn't
+// depend on the schema beyond the header constants
+const tsFraming = `const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+// bigints don't survive JSON.stringify, they are sent as plain
+// numbers and are only exact below 2^53
+function toJSON(msg: unknown): Uint8Array {
+  return textEncoder.encode(JSON.stringify(msg, (_, v) => typeof v === "bigint" ? Number(v) : v));
+}
+
+function fromJSON<T>(data: Uint8Array): T {
+  return JSON.parse(textDecoder.decode(data)) as T;
+}
+
+export type Packet = {
+  encoding: Encoding;
+  type: PacketType;
+  data: Uint8Array;
+};
+
+export function bitPack(enc: Encoding, type: PacketType): number {
+  return ((enc & 0x3) << 6) | (type & 0x3f);
+}
+
+// encodePacket frames data with a v1 header
+export function encodePacket(enc: Encoding, type: PacketType, data: Uint8Array): Uint8Array {
+  const buf = new Uint8Array(PACKET_HEADER_SIZE + data.length);
+  buf[0] = VERSION;
+  buf[ENC_TYPE_OFFSET] = bitPack(enc, type);
+  new DataView(buf.buffer).setUint16(HEADER_LENGTH_OFFSET, data.length);
+  buf.set(data, PACKET_HEADER_SIZE);
+  return buf;
+}
+
+// decodePacket reads the v1 packet at the front of buf. Returns
+// null until the whole packet has arrived
+export function decodePacket(buf: Uint8Array): { packet: Packet, size: number } | null {
+  if (buf.length < PACKET_HEADER_SIZE) {
+    return null;
+  }
+  if (buf[0] !== VERSION) {
+    throw new Error(` + "`Unsupported packet version ${buf[0]}`" + `);
+  }
+
+  const length = new DataView(buf.buffer, buf.byteOffset, buf.byteLength).getUint16(HEADER_LENGTH_OFFSET);
+  const size = PACKET_HEADER_SIZE + length;
+  if (buf.length < size) {
+    return null;
+  }
+
+  return {
+    packet: {
+      encoding: (buf[ENC_TYPE_OFFSET] >> 6) & 0x3,
+      type: buf[ENC_TYPE_OFFSET] & 0x3f,
+      data: buf.slice(PACKET_HEADER_SIZE, size),
+    },
+    size,
+  };
+}
+
+`
+
+// tsCodec emits the payload encode and decode for m. JSON
+// always works, everything else goes through the layout
+func tsCodec(b *strings.Builder, s *Schema, m *Message) {
+	layoutCases := ""
+	for _, enc := range m.layoutEncodings() {
+		layoutCases += fmt.Sprintf("    case Encoding.%s:\n", enc)
+	}
+
+	fmt.Fprintf(b, "export function encode%sPayload(msg: %s, enc: Encoding): Uint8Array {\n  switch (enc) {\n", m.Name, m.Name)
+	b.WriteString("    case Encoding.EncJSON:\n      return toJSON(msg);\n")
+	if layoutCases != "" {
+		b.WriteString(layoutCases + "      {\n")
+		tsLayoutEncode(b, s, m)
+		b.WriteString("      }\n")
+	}
+	fmt.Fprintf(b, "  }\n  throw new Error(`%s can't be sent as ${Encoding[enc]}`);\n}\n\n", m.Name)
+
+	fmt.Fprintf(b, "export function decode%sPayload(data: Uint8Array, enc: Encoding): %s {\n  switch (enc) {\n", m.Name, m.Name)
+	fmt.Fprintf(b, "    case Encoding.EncJSON:\n      return fromJSON<%s>(data);\n", m.Name)
+	if layoutCases != "" {
+		b.WriteString(layoutCases + "      {\n")
+		tsLayoutDecode(b, s, m)
+		b.WriteString("      }\n")
+	}
+	fmt.Fprintf(b, "  }\n  throw new Error(`%s can't be read as ${Encoding[enc]}`);\n}\n\n", m.Name)
+}
+
+func tsLayoutEncode(b *strings.Builder, s *Schema, m *Message) {
+	const indent = "        "
+
+	var sizes []string
+	if fixed := m.fixedSize(); fixed > 0 {
+		sizes = append(sizes, strconv.Itoa(fixed))
+	}
+	if m.hasRest() {
+		rest := m.field(m.Layout[len(m.Layout)-1].Field)
+		if s.kind(rest.Type) == "raw" {
+			fmt.Fprintf(b, "%sconst rest = msg.%s === undefined || msg.%s === null ? new Uint8Array() : toJSON(msg.%s);\n", indent, rest.JSON, rest.JSON, rest.JSON)
+		} else {
+			fmt.Fprintf(b, "%sconst rest = textEncoder.encode(msg.%s);\n", indent, rest.JSON)
+		}
+		sizes = append(sizes, "rest.length")
+	}
+	fmt.Fprintf(b, "%sconst buf = new Uint8Array(%s);\n", indent, strings.Join(sizes, " + "))
+	if s.needsView(m) {
+		fmt.Fprintf(b, "%sconst view = new DataView(buf.buffer);\n", indent)
+	}
+
+	offset := 0
+	for _, slot := range m.Layout {
+		f := m.field(slot.Field)
+		at := strconv.Itoa(offset)
+		if slot.Offset != "" {
+			at = slot.Offset
+		}
+
+		switch kind := s.kind(f.Type); {
+		case slot.Rest:
+			fmt.Fprintf(b, "%sbuf.set(rest, %s);\n", indent, at)
+		case kind == "string":
+			fmt.Fprintf(b, "%sbuf.set(textEncoder.encode(msg.%s).subarray(0, %d), %s);\n", indent, f.JSON, slot.Size, at)
+		case kind == "uint8":
+			fmt.Fprintf(b, "%sview.setUint8(%s, msg.%s);\n", indent, at, f.JSON)
+		case kind == "uint16":
+			fmt.Fprintf(b, "%sview.setUint16(%s, msg.%s);\n", indent, at, f.JSON)
+		case kind == "uint64":
+			fmt.Fprintf(b, "%sview.setBigUint64(%s, BigInt(msg.%s));\n", indent, at, f.JSON)
+		}
+		offset += slot.Size
+	}
+	fmt.Fprintf(b, "%sreturn buf;\n", indent)
+}
+
+func tsLayoutDecode(b *strings.Builder, s *Schema, m *Message) {
+	const indent = "        "
+
+	fixed := m.fixedSize()
+	switch {
+	case !m.hasRest():
+		fmt.Fprintf(b, "%sif (data.length !== %d) {\n", indent, fixed)
+		fmt.Fprintf(b, "%s  throw new Error(`%s payload should be %d bytes, got ${data.length}`);\n%s}\n", indent, m.Name, fixed, indent)
+	case fixed > 0:
+		fmt.Fprintf(b, "%sif (data.length < %d) {\n", indent, fixed)
+		fmt.Fprintf(b, "%s  throw new Error(`%s payload should be at least %d bytes, got ${data.length}`);\n%s}\n", indent, m.Name, fixed, indent)
+	}
+	if s.needsView(m) {
+		fmt.Fprintf(b, "%sconst view = new DataView(data.buffer, data.byteOffset, data.byteLength);\n", indent)
+	}
+	fmt.Fprintf(b, "%sreturn {\n", indent)
+
+	offset := 0
+	for _, slot := range m.Layout {
+		f := m.field(slot.Field)
+		at := strconv.Itoa(offset)
+		if slot.Offset != "" {
+			at = slot.Offset
+		}
+
+		var value string
+		switch kind := s.kind(f.Type); {
+		case slot.Rest && kind == "raw":
+			value = fmt.Sprintf("data.length > %s ? fromJSON<unknown>(data.subarray(%s)) : null", at, at)
+		case slot.Rest:
+			value = fmt.Sprintf("textDecoder.decode(data.subarray(%s))", at)
+		case kind == "string":
+			value = fmt.Sprintf("textDecoder.decode(data.subarray(%s, %s + %d))", at, at, slot.Size)
+		case kind == "uint8":
+			value = fmt.Sprintf("view.getUint8(%s)", at)
+		case kind == "uint16":
+			value = fmt.Sprintf("view.getUint16(%s)", at)
+		case kind == "uint64":
+			value = fmt.Sprintf("view.getBigUint64(%s)", at)
+		}
+		fmt.Fprintf(b, "%s  %s: %s,\n", indent, f.JSON, value)
+		offset += slot.Size
+	}
+	fmt.Fprintf(b, "%s};\n", indent)
+}
+
+// needsView reports whether the layout of m has any
+// numbers in it that go through a DataView
+func (s *Schema) needsView(m *Message) bool {
+	for _, slot := range m.Layout {
+		switch s.kind(m.field(slot.Field).Type) {
+		case "uint8", "uint16", "uint64":
+			return !slot.Rest
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+//go:generate go run ./cmd/protogen
+
+import (
+	"encoding"
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// Codec turns messages into packet payloads and back for
+// one Encoding. The encoding bits of a packet pick the codec
+// its payload is decoded with
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// CustomMarshaler is implemented by messages with their
+// own binary layout, sent as EncCustom
+type CustomMarshaler interface {
+	MarshalCustom() ([]byte, error)
+}
+
+// CustomUnmarshaler is the other half of CustomMarshaler
+type CustomUnmarshaler interface {
+	UnmarshalCustom(data []byte) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[Encoding]Codec{
+		EncCustom: customCodec{},
+		EncJSON:   jsonCodec{},
+		EncString: stringCodec{},
+		EncBytes:  bytesCodec{},
+	}
+)
+
+// RegisterCodec replaces the codec used for enc
+func RegisterCodec(enc Encoding, c Codec) {
+	codecsMu.Lock()
+	codecs[enc] = c
+	codecsMu.Unlock()
+}
+
+func codecFor(enc Encoding) (Codec, error) {
+	codecsMu.RLock()
+	c, ok := codecs[enc]
+	codecsMu.RUnlock()
+
+	if !ok {
+		return nil, ERROR_UNSUPPORTED_ENCODING
+	}
+	return c, nil
+}
+
+// Decode unmarshals the payload of p into v with the codec
+// for the encoding of p. Errors the server knows about are
+// passed through so they keep their status code, anything
+// else from the codec is an ERROR_INVALID_PAYLOAD
+func Decode(p *Packet, v any) error {
+	codec, err := codecFor(p.Encoding())
+	if err != nil {
+		return err
+	}
+
+	if err := codec.Unmarshal(p.Data(), v); err != nil {
+		if errorToStatusCode(err) != 0 {
+			return err
+		}
+		log.Printf("Failed to decode %s payload of %s: %s", EncToString(p.Encoding()), TypeToString(p.Type()), err)
+		return ERROR_INVALID_PAYLOAD
+	}
+	return nil
+}
+
+// Encode marshals v with the codec for enc and
+// wraps it in a packet of type pktType
+func Encode(enc Encoding, pktType PacketType, v any) (Packet, error) {
+	codec, err := codecFor(enc)
+	if err != nil {
+		return Packet{}, err
+	}
+
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return Packet{}, err
+	}
+	return ConstructPacket(enc, pktType, data), nil
+}
+
+// Typed adapts a handler that wants the payload of its
+// packet decoded into a T before it is called
+func Typed[T any](h func(p *Packet, c *Client, msg T) error) HandlerFunc {
+	return func(p *Packet, c *Client) error {
+		var msg T
+		if err := Decode(p, &msg); err != nil {
+			return err
+		}
+		return h(p, c, msg)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type customCodec struct{}
+
+func (customCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(CustomMarshaler)
+	if !ok {
+		return nil, ERROR_UNSUPPORTED_ENCODING
+	}
+	return m.MarshalCustom()
+}
+
+func (customCodec) Unmarshal(data []byte, v any) error {
+	u, ok := v.(CustomUnmarshaler)
+	if !ok {
+		return ERROR_UNSUPPORTED_ENCODING
+	}
+	return u.UnmarshalCustom(data)
+}
+
+// stringCodec handles strings and anything
+// that marshals itself to text
+type stringCodec struct{}
+
+func (stringCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case encoding.TextMarshaler:
+		return v.MarshalText()
+	}
+	return nil, ERROR_UNSUPPORTED_ENCODING
+}
+
+func (stringCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *string:
+		*v = string(data)
+		return nil
+	case encoding.TextUnmarshaler:
+		return v.UnmarshalText(data)
+	}
+	return ERROR_UNSUPPORTED_ENCODING
+}
+
+// bytesCodec handles byte slices and anything
+// that marshals itself to binary
+type bytesCodec struct{}
+
+func (bytesCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	}
+	return nil, ERROR_UNSUPPORTED_ENCODING
+}
+
+func (bytesCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append((*v)[:0], data...)
+		return nil
+	case encoding.BinaryUnmarshaler:
+		return v.UnmarshalBinary(data)
+	}
+	return ERROR_UNSUPPORTED_ENCODING
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	cases := []struct {
+		enc     Encoding
+		pktType PacketType
+		in      any
+		out     func() any
+	}{
+		{EncString, PacketJoinGame, GameRef{GameID: "ABC123"}, func() any { return &GameRef{} }},
+		{EncBytes, PacketJoinGame, GameRef{GameID: "ABC123"}, func() any { return &GameRef{} }},
+		{EncCustom, PacketJoinGame, GameRef{GameID: "ABC123"}, func() any { return &GameRef{} }},
+		{EncJSON, PacketJoinGame, GameRef{GameID: "ABC123"}, func() any { return &GameRef{} }},
+		{EncBytes, PacketHeartbeatAck, Heartbeat{Nonce: 0xDEADBEEF}, func() any { return &Heartbeat{} }},
+		{EncJSON, PacketHeartbeatAck, Heartbeat{Nonce: 0xDEADBEEF}, func() any { return &Heartbeat{} }},
+		{EncCustom, PacketGameState, GameStateMessage{Version: GSVERSION, State: ATTACK, ClientID: "10000001", Data: json.RawMessage(`[1,2]`)}, func() any { return &GameStateMessage{} }},
+		{EncJSON, PacketGameState, GameStateMessage{Version: GSVERSION, State: ATTACK, ClientID: "10000001", Data: json.RawMessage(`[1,2]`)}, func() any { return &GameStateMessage{} }},
+	}
+
+	for _, c := range cases {
+		pkt, err := Encode(c.enc, c.pktType, c.in)
+		if err != nil {
+			t.Errorf("%s %s: encode failed: %s", EncToString(c.enc), TypeToString(c.pktType), err)
+			continue
+		}
+		if pkt.Encoding() != c.enc || pkt.Type() != c.pktType {
+			t.Errorf("Expected %s %s. Got %s %s", EncToString(c.enc), TypeToString(c.pktType), EncToString(pkt.Encoding()), TypeToString(pkt.Type()))
+		}
+
+		out := c.out()
+		if err := Decode(&pkt, out); err != nil {
+			t.Errorf("%s %s: decode failed: %s", EncToString(c.enc), TypeToString(c.pktType), err)
+			continue
+		}
+
+		want, _ := json.Marshal(c.in)
+		got, _ := json.Marshal(out)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s %s: expected %s. Got %s", EncToString(c.enc), TypeToString(c.pktType), want, got)
+		}
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	// a game state has no string form
+	pkt := ConstructPacket(EncString, PacketGameState, []byte("attack"))
+	if err := Decode(&pkt, &GameStateMessage{}); err != ERROR_UNSUPPORTED_ENCODING {
+		t.Errorf("String game state: expected %v. Got %v", ERROR_UNSUPPORTED_ENCODING, err)
+	}
+
+	pkt = ConstructPacket(EncJSON, PacketJoinGame, []byte("{not json"))
+	if err := Decode(&pkt, &GameRef{}); err != ERROR_INVALID_PAYLOAD {
+		t.Errorf("Bad JSON: expected %v. Got %v", ERROR_INVALID_PAYLOAD, err)
+	}
+
+	// errors from the message itself keep their status code
+	pkt = ConstructPacket(EncCustom, PacketGameState, []byte{GSVERSION})
+	if err := Decode(&pkt, &GameStateMessage{}); err != ERROR_INVALID_GAME_STATE {
+		t.Errorf("Short game state: expected %v. Got %v", ERROR_INVALID_GAME_STATE, err)
+	}
+
+	pkt = ConstructPacket(EncBytes, PacketHeartbeatAck, []byte{1, 2, 3})
+	if err := Decode(&pkt, &Heartbeat{}); err != ERROR_INVALID_HEARTBEAT {
+		t.Errorf("Short heartbeat: expected %v. Got %v", ERROR_INVALID_HEARTBEAT, err)
+	}
+}
+
+func TestServerJSONMessages(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	hub.SetGameStateValidationFunc(validateGamePkt)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+
+	host, hostFramer := dialClient(t, server.ln.Addr().String())
+	guest, guestFramer := dialClient(t, server.ln.Addr().String())
+	defer host.Disconnect()
+	defer guest.Disconnect()
+
+	host.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	created, err := expectPacket(hostFramer.C, PacketCreateGameSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := GameRef{GameID: GameID(created.Data())}
+
+	// the same requests as startTestGame, only sent as JSON
+	join, _ := Encode(EncJSON, PacketJoinGame, ref)
+	guest.Write(join.data)
+	if _, err := expectPacket(guestFramer.C, PacketJoinGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	// a bad payload is rejected before it reaches the game
+	bad := ConstructPacket(EncJSON, PacketStartGame, []byte("{"))
+	host.Write(bad.data)
+	if err := expectError(hostFramer.C, ERROR_INVALID_PAYLOAD); err != nil {
+		t.Fatal(err)
+	}
+
+	start, _ := Encode(EncJSON, PacketStartGame, ref)
+	host.Write(start.data)
+	for _, framer := range []*PacketFramer{hostFramer, guestFramer} {
+		if _, err := expectPacket(framer.C, PacketStartGameSuccess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := expectGameState(hostFramer.C, ATTACK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(guestFramer.C, DEFENSE); err != nil {
+		t.Fatal(err)
+	}
+
+	attacks, _ := json.Marshal([]Attack{
+		attack(UnitOne, UnitOne, TeamTwo, "Dark Pulse"),
+		attack(UnitTwo, UnitOne, TeamTwo, "Arcane Burst"),
+		attack(UnitThree, UnitOne, TeamTwo, "Slash"),
+	})
+	state, _ := Encode(EncJSON, PacketGameState, GameStateMessage{Version: GSVERSION, State: ATTACK, ClientID: host.clientID, Data: attacks})
+	host.Write(state.data)
+	if _, err := expectGameState(guestFramer.C, RESULT); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import "encoding/json"
+
+// The combat engine is the source of truth for every match.
+// Clients queue up attacks and send them over as game state
+// packets, the engine checks them against its own rosters
+// and move list and hands back what actually happened
+//
+// Move, Attack and the team and character IDs are shared with
+// the web client, they are generated from protocol.json
+
+var Moves = map[string]Move{
+	"Slash":        {Name: "Slash", Damage: 5, Target: EnemyTeam},
+	"Defend":       {Name: "Defend", Damage: 0, Target: OwnTeam, Shield: true},
+	"Heal":         {Name: "Heal", Damage: -3, Target: OwnTeam},
+	"Arcane Burst": {Name: "Arcane Burst", Damage: 4, Target: EnemyTeam},
+	"Shield":       {Name: "Shield", Damage: 0, Target: OwnTeam, Shield: true},
+	"Dark Pulse":   {Name: "Dark Pulse", Damage: 6, Target: EnemyTeam},
+}
+
+type Character struct {
+	ID        CharacterID
+	Name      string
+	Health    int
+	MaxHealth int
+	Defense   int
+	Moves     []string
+	shielded  bool
+}
+
+func (c *Character) Alive() bool {
+	return c.Health > 0
+}
+
+func (c *Character) knows(move string) bool {
+	for _, m := range c.Moves {
+		if m == move {
+			return true
+		}
+	}
+	return false
+}
+
+type Team struct {
+	ID         TeamID
+	Characters []*Character
+}
+
+// NewRoster builds the default team, the same one
+// GameState.constructTeam builds on the client
+func NewRoster(id TeamID) *Team {
+	return &Team{
+		ID: id,
+		Characters: []*Character{
+			{ID: UnitOne, Name: "Necromancer", Health: 20, MaxHealth: 20, Defense: 5, Moves: []string{"Shield", "Dark Pulse"}},
+			{ID: UnitTwo, Name: "Witch", Health: 17, MaxHealth: 17, Defense: 6, Moves: []string{"Heal", "Arcane Burst"}},
+			{ID: UnitThree, Name: "Knight", Health: 22, MaxHealth: 22, Defense: 3, Moves: []string{"Slash", "Defend"}},
+		},
+	}
+}
+
+func (t *Team) Character(id CharacterID) *Character {
+	for _, c := range t.Characters {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (t *Team) Alive() int {
+	n := 0
+	for _, c := range t.Characters {
+		if c.Alive() {
+			n++
+		}
+	}
+	return n
+}
+
+type Battle struct {
+	teams  map[TeamID]*Team
+	winner TeamID
+}
+
+func NewBattle() *Battle {
+	return &Battle{
+		teams: map[TeamID]*Team{
+			TeamOne: NewRoster(TeamOne),
+			TeamTwo: NewRoster(TeamTwo),
+		},
+	}
+}
+
+func (b *Battle) Team(id TeamID) *Team {
+	return b.teams[id]
+}
+
+func (b *Battle) Winner() TeamID {
+	return b.winner
+}
+
+func opponent(id TeamID) TeamID {
+	if id == TeamOne {
+		return TeamTwo
+	}
+	return TeamOne
+}
+
+func DecodeAttacks(data []byte) ([]Attack, error) {
+	var attacks []Attack
+	if err := json.Unmarshal(data, &attacks); err != nil {
+		return nil, ERROR_INVALID_ATTACK
+	}
+	return attacks, nil
+}
+
+// Resolve applies a full attack queue for team. The queue is
+// checked as a whole before anything is applied so a bad
+// attack can't leave the battle half resolved
+func (b *Battle) Resolve(team TeamID, attacks []Attack) (TurnResult, error) {
+	if b.winner != TeamNone {
+		return TurnResult{}, ERROR_GAME_OVER
+	}
+
+	own, ok := b.teams[team]
+	if !ok {
+		return TurnResult{}, ERROR_INVALID_ATTACK
+	}
+
+	if err := b.validate(own, attacks); err != nil {
+		return TurnResult{}, err
+	}
+
+	// shields last until the start of the owners next turn
+	for _, c := range own.Characters {
+		c.shielded = false
+	}
+
+	res := TurnResult{Team: team, Results: make([]AttackResult, 0, len(attacks))}
+	for _, a := range attacks {
+		move := Moves[a.Attack.Name]
+		target := b.teams[a.TargetTeamID].Character(a.TargetID)
+		// already killed by another attack
+		if !target.Alive() {
+			continue
+		}
+
+		applied := b.apply(move, target)
+
+		a.CharacterTeamID = team
+		a.Attack = move
+		a.Attack.Damage = applied
+		res.Results = append(res.Results, AttackResult{Attack: a, TargetHealth: target.Health})
+	}
+
+	if b.teams[opponent(team)].Alive() == 0 {
+		b.winner = team
+	}
+	res.Winner = b.winner
+
+	return res, nil
+}
+
+// Check validates a single attack for team without applying it
+func (b *Battle) Check(team TeamID, a Attack) error {
+	if b.winner != TeamNone {
+		return ERROR_GAME_OVER
+	}
+
+	own, ok := b.teams[team]
+	if !ok {
+		return ERROR_INVALID_ATTACK
+	}
+
+	return b.validate(own, []Attack{a})
+}
+
+func (b *Battle) validate(own *Team, attacks []Attack) error {
+	if len(attacks) == 0 {
+		return ERROR_INVALID_ATTACK
+	}
+
+	seen := make(map[CharacterID]bool, len(attacks))
+	for _, a := range attacks {
+		attacker := own.Character(a.CharacterID)
+		if attacker == nil || !attacker.Alive() || seen[a.CharacterID] {
+			return ERROR_INVALID_ATTACK
+		}
+		seen[a.CharacterID] = true
+
+		if a.CharacterTeamID != TeamNone && a.CharacterTeamID != own.ID {
+			return ERROR_INVALID_ATTACK
+		}
+
+		move, ok := Moves[a.Attack.Name]
+		if !ok || !attacker.knows(move.Name) {
+			return ERROR_INVALID_ATTACK
+		}
+
+		want := opponent(own.ID)
+		if move.Target == OwnTeam {
+			want = own.ID
+		}
+		if a.TargetTeamID != want {
+			return ERROR_INVALID_ATTACK
+		}
+
+		if b.teams[a.TargetTeamID].Character(a.TargetID) == nil {
+			return ERROR_INVALID_ATTACK
+		}
+	}
+
+	return nil
+}
+
+// apply returns the change in health the same way the
+// client treats damage, positive hurts and negative heals
+func (b *Battle) apply(move Move, target *Character) int {
+	if move.Shield {
+		target.shielded = true
+		return 0
+	}
+
+	if move.Damage < 0 {
+		before := target.Health
+		target.Health = min(target.Health-move.Damage, target.MaxHealth)
+		return before - target.Health
+	}
+
+	dmg := max(move.Damage-target.Defense/2, 1)
+	if target.shielded {
+		dmg = max(dmg/2, 1)
+	}
+
+	dmg = min(dmg, target.Health)
+	target.Health -= dmg
+
+	return dmg
+}
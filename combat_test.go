@@ -0,0 +1,124 @@
+package main
+
+import "testing"
+
+func attack(char, target CharacterID, targetTeam TeamID, move string) Attack {
+	return Attack{
+		CharacterID:  char,
+		TargetID:     target,
+		TargetTeamID: targetTeam,
+		Attack:       Move{Name: move},
+	}
+}
+
+func TestBattleResolve(t *testing.T) {
+	b := NewBattle()
+
+	res, err := b.Resolve(TeamOne, []Attack{
+		attack(UnitOne, UnitThree, TeamTwo, "Dark Pulse"),
+		attack(UnitTwo, UnitThree, TeamTwo, "Arcane Burst"),
+		attack(UnitThree, UnitThree, TeamTwo, "Slash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// knight has 3 defense so every hit loses 1
+	want := []int{5, 3, 4}
+	for i, r := range res.Results {
+		if r.Attack.Attack.Damage != want[i] {
+			t.Errorf("Damage mismatch on idx %d. Got %d want %d", i, r.Attack.Attack.Damage, want[i])
+		}
+	}
+
+	if hp := b.Team(TeamTwo).Character(UnitThree).Health; hp != 22-12 {
+		t.Errorf("Knight health mismatch. Got %d want %d", hp, 22-12)
+	}
+
+	if res.Winner != TeamNone {
+		t.Errorf("Unexpected winner %d", res.Winner)
+	}
+}
+
+func TestBattleShieldAndHeal(t *testing.T) {
+	b := NewBattle()
+
+	if _, err := b.Resolve(TeamTwo, []Attack{
+		attack(UnitOne, UnitThree, TeamTwo, "Shield"),
+		attack(UnitThree, UnitThree, TeamOne, "Slash"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := b.Resolve(TeamOne, []Attack{
+		attack(UnitOne, UnitThree, TeamTwo, "Dark Pulse"),
+		attack(UnitTwo, UnitThree, TeamOne, "Heal"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shielded knight takes half of 5, healed knight only had 4 missing
+	if dmg := res.Results[0].Attack.Attack.Damage; dmg != 2 {
+		t.Errorf("Shielded damage mismatch. Got %d want 2", dmg)
+	}
+	if heal := res.Results[1].Attack.Attack.Damage; heal != -3 {
+		t.Errorf("Heal mismatch. Got %d want -3", heal)
+	}
+}
+
+func TestBattleRejectsInvalidAttacks(t *testing.T) {
+	tests := []struct {
+		name    string
+		team    TeamID
+		attacks []Attack
+	}{
+		{"empty", TeamOne, []Attack{}},
+		{"unknown move", TeamOne, []Attack{attack(UnitOne, UnitOne, TeamTwo, "Fireball")}},
+		{"move not known by character", TeamOne, []Attack{attack(UnitThree, UnitOne, TeamTwo, "Dark Pulse")}},
+		{"wrong target team", TeamOne, []Attack{attack(UnitThree, UnitOne, TeamOne, "Slash")}},
+		{"unknown target", TeamOne, []Attack{attack(UnitThree, 9, TeamTwo, "Slash")}},
+		{"duplicate attacker", TeamOne, []Attack{
+			attack(UnitThree, UnitOne, TeamTwo, "Slash"),
+			attack(UnitThree, UnitTwo, TeamTwo, "Slash"),
+		}},
+		{"claims other team", TeamOne, []Attack{{
+			CharacterID:     UnitThree,
+			TargetID:        UnitOne,
+			CharacterTeamID: TeamTwo,
+			TargetTeamID:    TeamTwo,
+			Attack:          Move{Name: "Slash"},
+		}}},
+	}
+
+	for _, tt := range tests {
+		b := NewBattle()
+		if _, err := b.Resolve(tt.team, tt.attacks); err != ERROR_INVALID_ATTACK {
+			t.Errorf("%s: got %v want %v", tt.name, err, ERROR_INVALID_ATTACK)
+		}
+	}
+}
+
+func TestBattleWinner(t *testing.T) {
+	b := NewBattle()
+	for _, c := range b.Team(TeamTwo).Characters {
+		c.Health = 1
+	}
+
+	res, err := b.Resolve(TeamOne, []Attack{
+		attack(UnitOne, UnitOne, TeamTwo, "Dark Pulse"),
+		attack(UnitTwo, UnitTwo, TeamTwo, "Arcane Burst"),
+		attack(UnitThree, UnitThree, TeamTwo, "Slash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Winner != TeamOne {
+		t.Errorf("Winner mismatch. Got %d want %d", res.Winner, TeamOne)
+	}
+
+	if _, err := b.Resolve(TeamTwo, []Attack{attack(UnitThree, UnitOne, TeamOne, "Slash")}); err != ERROR_GAME_OVER {
+		t.Errorf("Got %v want %v", err, ERROR_GAME_OVER)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Clients that negotiated CAP_COMPRESSION get payloads over
+// COMPRESSION_THRESHOLD deflated, with FLAG_COMPRESSED set in
+// the v2 header. Only payloads that fit a single v2 packet are
+// compressed and nothing inflates past MAX_DATA_SIZE_V2, so a
+// compressed packet can never be used to smuggle in more than
+// an uncompressed one could
+const (
+	CAP_COMPRESSION = "compression"
+	// payloads this small aren't worth deflating
+	COMPRESSION_THRESHOLD = 128
+)
+
+// flate writers are expensive to set up, every
+// compressing connection shares the ones in here
+var deflaters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var inflaters = sync.Pool{
+	New: func() any {
+		return flate.NewReader(nil)
+	},
+}
+
+var errCompressedTooBig = errors.New("compressed payload is no smaller")
+
+// fixedBuffer is an io.Writer over a buffer that
+// never grows, writing past its end fails
+type fixedBuffer struct {
+	buf []byte
+	n   int
+}
+
+func (b *fixedBuffer) Write(p []byte) (int, error) {
+	if len(p) > len(b.buf)-b.n {
+		return 0, errCompressedTooBig
+	}
+	b.n += copy(b.buf[b.n:], p)
+	return len(p), nil
+}
+
+// deflate compresses data into dst, returning how much of dst
+// was used. ok is false if it didn't fit, when compressing
+// doesn't pay off dst should be smaller than data
+func deflate(dst, data []byte) (int, bool) {
+	out := fixedBuffer{buf: dst}
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+
+	w.Reset(&out)
+	if _, err := w.Write(data); err != nil {
+		return 0, false
+	}
+	if err := w.Close(); err != nil {
+		return 0, false
+	}
+	return out.n, true
+}
+
+// Compress deflates data. ok is false if the result
+// isn't any smaller, data should be sent as is then
+func Compress(data []byte) ([]byte, bool) {
+	if len(data) <= COMPRESSION_THRESHOLD || len(data) > MAX_DATA_SIZE_V2 {
+		return data, false
+	}
+
+	dst := make([]byte, len(data)-1)
+	n, ok := deflate(dst, data)
+	if !ok {
+		return data, false
+	}
+	return dst[:n], true
+}
+
+// Decompress inflates data into dst, failing with
+// ERROR_MESSAGE_TOO_LARGE if it inflates past dst
+func Decompress(dst, data []byte) (int, error) {
+	r := inflaters.Get().(io.ReadCloser)
+	defer inflaters.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return 0, ERROR_INVALID_COMPRESSION
+	}
+
+	// only a clean io.EOF ends the stream, flate reports a
+	// truncated one as io.ErrUnexpectedEOF
+	n := 0
+	for n < len(dst) {
+		m, err := r.Read(dst[n:])
+		n += m
+		switch {
+		case err == io.EOF:
+			return n, nil
+		case err != nil:
+			return 0, ERROR_INVALID_COMPRESSION
+		}
+	}
+
+	// dst is full, anything more is over the limit
+	var probe [1]byte
+	m, err := r.Read(probe[:])
+	switch {
+	case m > 0:
+		return 0, ERROR_MESSAGE_TOO_LARGE
+	case err != nil && err != io.EOF:
+		return 0, ERROR_INVALID_COMPRESSION
+	}
+	return n, nil
+}
+
+// compressPooled is reframePooled for a client that takes
+// compressed packets. Returns nil if pkt doesn't get any smaller
+func compressPooled(pkt *Packet, seq uint16) *Packet {
+	data := pkt.Data()
+	if len(data) <= COMPRESSION_THRESHOLD || len(data) > MAX_DATA_SIZE_V2 {
+		return nil
+	}
+
+	out := AcquirePacket(PACKET_HEADER_SIZE_V2 + len(data) - 1)
+	n, ok := deflate(out.data[PACKET_HEADER_SIZE_V2:], data)
+	if !ok {
+		out.Release()
+		return nil
+	}
+
+	out.data = out.data[:PACKET_HEADER_SIZE_V2+n]
+	out.len = len(out.data)
+	putHeader(out.data, VERSION_2, pkt.data[ENC_TYPE_OFFSET], n, seq, pkt.Flags()|FLAG_COMPRESSED)
+	return out
+}
+
+// inflate swaps a compressed packet for its inflated self.
+// pkt is released either way
+func inflate(pkt *Packet) (*Packet, error) {
+	defer pkt.Release()
+
+	out := AcquirePacket(PACKET_MAX_SIZE)
+	n, err := Decompress(out.data[PACKET_HEADER_SIZE_V2:], pkt.Data())
+	if err != nil {
+		out.Release()
+		return nil, err
+	}
+
+	out.data = out.data[:PACKET_HEADER_SIZE_V2+n]
+	out.len = len(out.data)
+	putHeader(out.data, VERSION_2, pkt.data[ENC_TYPE_OFFSET], n, pkt.Seq(), pkt.Flags()&^FLAG_COMPRESSED)
+	return out, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// snapshot is a full team game state, the kind of
+// payload compression is there for
+func snapshot() []byte {
+	attacks := make([]Attack, 0, 6)
+	for i := 0; i < 6; i++ {
+		attacks = append(attacks, Attack{
+			CharacterID:     UnitOne,
+			TargetID:        UnitTwo,
+			CharacterTeamID: TeamOne,
+			TargetTeamID:    TeamTwo,
+			Attack:          Moves["Slash"],
+		})
+	}
+	data, _ := json.Marshal(attacks)
+	return data
+}
+
+func TestCompressedFraming(t *testing.T) {
+	data := snapshot()
+
+	pkt := ConstructCompressedPacket(EncJSON, PacketGameState, 7, data)
+	if pkt.Flags()&FLAG_COMPRESSED == 0 || len(pkt.Data()) >= len(data) {
+		t.Fatalf("Expected %d bytes to be compressed. Got %d bytes with flags %08b", len(data), len(pkt.Data()), pkt.Flags())
+	}
+
+	small := ConstructCompressedPacket(EncJSON, PacketGameState, 8, []byte(`[]`))
+	if small.Flags()&FLAG_COMPRESSED != 0 {
+		t.Fatal("Expected payload under the threshold to be sent as is")
+	}
+
+	// the framer hands back what was compressed as if it never was
+	pkts, errs := frameStream(PolicyResync, append(pkt.data, small.data...))
+	if len(errs) != 1 || errs[0] != io.EOF {
+		t.Fatalf("Expected clean EOF. Got %v", errs)
+	}
+	if len(pkts) != 2 {
+		t.Fatalf("Expected 2 packets. Got %d", len(pkts))
+	}
+	if !bytes.Equal(pkts[0].Data(), data) || pkts[0].Flags() != 0 || pkts[0].Seq() != 7 {
+		t.Fatalf("Inflated packet doesn't match. Got seq %d flags %08b data %s", pkts[0].Seq(), pkts[0].Flags(), pkts[0].Data())
+	}
+	if pkts[0].Type() != PacketGameState || pkts[0].Encoding() != EncJSON {
+		t.Fatalf("Expected EncJSON PacketGameState. Got %s %s", EncToString(pkts[0].Encoding()), TypeToString(pkts[0].Type()))
+	}
+}
+
+func TestDecompressionLimits(t *testing.T) {
+	// a few hundred bytes that inflate to 64 KiB
+	var bomb bytes.Buffer
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	w.Write(make([]byte, 64*1024))
+	w.Close()
+
+	// just over what fits a single packet
+	var over bytes.Buffer
+	w.Reset(&over)
+	w.Write(make([]byte, MAX_DATA_SIZE_V2+1))
+	w.Close()
+
+	// a good stream with its tail cut off
+	whole, _ := Compress(snapshot())
+	truncated := whole[:len(whole)/2]
+
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"bomb", bomb.Bytes(), ERROR_MESSAGE_TOO_LARGE},
+		{"one byte over", over.Bytes(), ERROR_MESSAGE_TOO_LARGE},
+		{"corrupt", []byte{0xFF, 0xFF, 0xFF, 0xFF}, ERROR_INVALID_COMPRESSION},
+		{"truncated", truncated, ERROR_INVALID_COMPRESSION},
+	}
+
+	health := ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data
+	for _, c := range cases {
+		pkt := ConstructPacketV2(EncBytes, PacketGameState, 1, c.data)
+		pkt.data[HEADER_FLAGS_OFFSET] = FLAG_COMPRESSED
+
+		// the bad packet is dropped and the stream carries on
+		pkts, errs := frameStream(PolicyResync, append(pkt.data, health...))
+		if len(pkts) != 1 || pkts[0].Type() != PacketHealthCheckReq {
+			t.Errorf("%s: expected only the health check to make it through. Got %d packets", c.name, len(pkts))
+		}
+		if len(errs) == 0 || !errors.Is(errs[0], c.err) {
+			t.Errorf("%s: expected %v. Got %v", c.name, c.err, errs)
+		}
+	}
+}
+
+func TestDecompressTruncated(t *testing.T) {
+	data := snapshot()
+	whole, ok := Compress(data)
+	if !ok {
+		t.Fatal("Expected snapshot to compress")
+	}
+
+	dst := make([]byte, MAX_DATA_SIZE_V2)
+	if n, err := Decompress(dst, whole); err != nil || !bytes.Equal(dst[:n], data) {
+		t.Fatalf("Expected the whole stream to inflate. Got %d bytes, %v", n, err)
+	}
+
+	// every cut short stream is an error, never a shorter message
+	for i := 0; i < len(whole); i++ {
+		if n, err := Decompress(dst, whole[:i]); err != ERROR_INVALID_COMPRESSION {
+			t.Fatalf("Cut to %d bytes: expected %v. Got %d bytes, %v", i, ERROR_INVALID_COMPRESSION, n, err)
+		}
+	}
+
+	// a dst the message fits exactly doesn't hide a missing tail
+	exact := make([]byte, len(data))
+	if n, err := Decompress(exact, whole); err != nil || n != len(data) {
+		t.Fatalf("Expected %d bytes to fit exactly. Got %d, %v", len(data), n, err)
+	}
+	if _, err := Decompress(exact, whole[:len(whole)-1]); err != ERROR_INVALID_COMPRESSION {
+		t.Fatalf("Expected %v for a stream missing its tail. Got %v", ERROR_INVALID_COMPRESSION, err)
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	server, remote := net.Pipe()
+	client := NewClient(server)
+	defer client.Disconnect()
+
+	client.version = VERSION_2
+	client.proto = Negotiated{Version: int(VERSION_2), Capabilities: []string{CAP_COMPRESSION}}
+
+	data := snapshot()
+	client.Write(ConstructPacket(EncJSON, PacketGameState, data).data)
+
+	// on the wire it is compressed
+	header := make([]byte, PACKET_HEADER_SIZE_V2)
+	if _, err := io.ReadFull(remote, header); err != nil {
+		t.Fatal(err)
+	}
+	wire := NewPacket(append(header, make([]byte, getPacketLength(header))...))
+	if _, err := io.ReadFull(remote, wire.data[PACKET_HEADER_SIZE_V2:]); err != nil {
+		t.Fatal(err)
+	}
+	if wire.Flags()&FLAG_COMPRESSED == 0 || len(wire.Data()) >= len(data) {
+		t.Fatalf("Expected a compressed packet. Got %d bytes with flags %08b", len(wire.Data()), wire.Flags())
+	}
+
+	pkts, _ := frameStream(PolicyResync, wire.data)
+	if len(pkts) != 1 || !bytes.Equal(pkts[0].Data(), data) {
+		t.Fatal("Compressed packet didn't inflate back to what was written")
+	}
+}
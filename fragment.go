@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+// Messages too big for a single packet are split into fragments.
+// A fragment is a v2 packet with a message ID and fragment index
+// tacked on, every fragment but the last has FLAG_MORE set
+//
+// |  Version  |  Enc/Type  |  Length  |  Seq     |  Flags  |  Reserved  |  MsgID   |  FragIdx
+//
+//	1 byte      1 byte       2 bytes    2 bytes    1 byte    1 byte       2 bytes    2 bytes
+const (
+	VERSION_FRAGMENT            = uint8(3)
+	PACKET_HEADER_SIZE_FRAGMENT = 12
+	HEADER_MSG_ID_OFFSET        = 8
+	HEADER_FRAG_IDX_OFFSET      = 10
+	MAX_FRAGMENT_DATA           = PACKET_MAX_SIZE - PACKET_HEADER_SIZE_FRAGMENT
+)
+
+const (
+	// more fragments of the message follow this one
+	FLAG_MORE = uint8(1 << iota)
+	// the payload is deflated, see compress.go
+	FLAG_COMPRESSED
+)
+
+const (
+	// largest message that will be reassembled, kept under
+	// what the uint16 length of the reassembled packet can hold
+	MAX_MESSAGE_SIZE = 60 * 1024
+	// most messages a single connection can have half sent
+	MAX_PENDING_MESSAGES = 4
+	// how long a half sent message is kept around
+	FRAGMENT_TIMEOUT = time.Second * 10
+)
+
+// reassembly is a message being put back together
+type reassembly struct {
+	header  uint8 // enc/type byte of the first fragment
+	seq     uint16
+	next    uint16
+	data    []byte
+	started time.Time
+}
+
+// Fragment splits a packet that is too big to send in one go,
+// returning it as is if it fits. seq and flags are carried over
+// to every fragment
+func Fragment(data []byte, msgID uint16, seq uint16) [][]byte {
+	if len(data) <= PACKET_MAX_SIZE {
+		return [][]byte{data}
+	}
+
+	pkt := NewPacket(data)
+	payload := pkt.Data()
+
+	frags := make([][]byte, 0, len(payload)/MAX_FRAGMENT_DATA+1)
+	for idx := 0; len(payload) > 0; idx++ {
+		n := min(len(payload), MAX_FRAGMENT_DATA)
+
+		frag := make([]byte, PACKET_HEADER_SIZE_FRAGMENT, PACKET_HEADER_SIZE_FRAGMENT+n)
+		frag[0] = VERSION_FRAGMENT
+		frag[ENC_TYPE_OFFSET] = data[ENC_TYPE_OFFSET]
+		binary.BigEndian.PutUint16(frag[HEADER_LENGTH_OFFSET:], uint16(n))
+		binary.BigEndian.PutUint16(frag[HEADER_SEQ_OFFSET:], seq)
+		frag[HEADER_FLAGS_OFFSET] = pkt.Flags()
+		if n < len(payload) {
+			frag[HEADER_FLAGS_OFFSET] |= FLAG_MORE
+		}
+		binary.BigEndian.PutUint16(frag[HEADER_MSG_ID_OFFSET:], msgID)
+		binary.BigEndian.PutUint16(frag[HEADER_FRAG_IDX_OFFSET:], uint16(idx))
+
+		frags = append(frags, append(frag, payload[:n]...))
+		payload = payload[n:]
+	}
+
+	return frags
+}
+
+// reassemble adds a fragment to the message it belongs to. Once
+// the last fragment is in the whole message is returned as a
+// single v2 packet, until then it returns nil
+func (p *PacketFramer) reassemble(frag *Packet) (*Packet, error) {
+	now := time.Now()
+	p.expireFragments(now)
+
+	id := binary.BigEndian.Uint16(frag.data[HEADER_MSG_ID_OFFSET:])
+	idx := binary.BigEndian.Uint16(frag.data[HEADER_FRAG_IDX_OFFSET:])
+
+	msg, ok := p.partial[id]
+	if !ok {
+		if idx != 0 {
+			return nil, ERROR_INVALID_FRAGMENT
+		}
+		if len(p.partial) >= MAX_PENDING_MESSAGES {
+			return nil, ERROR_TOO_MANY_FRAGMENTED_MESSAGES
+		}
+
+		msg = &reassembly{header: frag.data[ENC_TYPE_OFFSET], seq: frag.Seq(), started: now}
+		p.partial[id] = msg
+	}
+
+	if idx != msg.next || frag.data[ENC_TYPE_OFFSET] != msg.header {
+		delete(p.partial, id)
+		return nil, ERROR_INVALID_FRAGMENT
+	}
+
+	if len(msg.data)+len(frag.Data()) > MAX_MESSAGE_SIZE {
+		delete(p.partial, id)
+		return nil, ERROR_MESSAGE_TOO_LARGE
+	}
+
+	msg.data = append(msg.data, frag.Data()...)
+	msg.next++
+
+	if frag.Flags()&FLAG_MORE != 0 {
+		return nil, nil
+	}
+
+	delete(p.partial, id)
+
+	pkt := ConstructPacketV2(0, 0, msg.seq, msg.data)
+	pkt.data[ENC_TYPE_OFFSET] = msg.header
+	pkt.data[HEADER_FLAGS_OFFSET] = frag.Flags()
+	return &pkt, nil
+}
+
+// expireFragments forgets messages that have been
+// waiting on their next fragment for too long
+func (p *PacketFramer) expireFragments(now time.Time) {
+	for id, msg := range p.partial {
+		if now.Sub(msg.started) > FRAGMENT_TIMEOUT {
+			log.Printf("Dropping fragmented message %d after %d fragments, timed out", id, msg.next)
+			delete(p.partial, id)
+		}
+	}
+}
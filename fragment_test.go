@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func largePayload(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	data := largePayload(MAX_FRAGMENT_DATA*3 + 10)
+	pkt := ConstructPacketV2(EncJSON, PacketGameState, 7, data)
+
+	frags := Fragment(pkt.data, 1, 7)
+	if len(frags) != 4 {
+		t.Fatalf("Expected 4 fragments. Got %d", len(frags))
+	}
+
+	framer := NewPacketFramer()
+	for _, frag := range frags {
+		if len(frag) > PACKET_MAX_SIZE {
+			t.Fatalf("Fragment of %d bytes is over the max packet size", len(frag))
+		}
+		framer.push(frag)
+	}
+
+	select {
+	case res := <-framer.C:
+		if res.Type() != PacketGameState || res.Encoding() != EncJSON || res.Seq() != 7 {
+			t.Errorf("Expected %s %s packet 7. Got %s %s packet %d", EncToString(EncJSON), TypeToString(PacketGameState),
+				EncToString(res.Encoding()), TypeToString(res.Type()), res.Seq())
+		}
+		if !bytes.Equal(res.Data(), data) {
+			t.Error("Reassembled data does not match")
+		}
+	default:
+		t.Fatal("Expected reassembled packet")
+	}
+
+	if len(framer.partial) != 0 {
+		t.Fatalf("Expected no partial messages left. Got %d", len(framer.partial))
+	}
+
+	// small packets are left alone
+	small := ConstructPacket(EncString, PacketHealthCheckRes, []byte("Im alive :D"))
+	if frags := Fragment(small.data, 2, 0); len(frags) != 1 || !bytes.Equal(frags[0], small.data) {
+		t.Fatal("Expected small packet to go out as is")
+	}
+}
+
+func TestFragmentInterleaved(t *testing.T) {
+	a := largePayload(PACKET_MAX_SIZE + 1)
+	b := largePayload(PACKET_MAX_SIZE + 2)
+	fa := Fragment(ConstructPacketV2(EncBytes, PacketGameState, 1, a).data, 1, 1)
+	fb := Fragment(ConstructPacketV2(EncBytes, PacketGameState, 2, b).data, 2, 2)
+
+	framer := NewPacketFramer()
+	for _, frag := range [][]byte{fa[0], fb[0], fb[1], fa[1]} {
+		if err := framer.push(frag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range [][]byte{b, a} {
+		res := <-framer.C
+		if !bytes.Equal(res.Data(), want) {
+			t.Fatalf("Expected message of %d bytes. Got %d", len(want), len(res.Data()))
+		}
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+	frags := Fragment(ConstructPacketV2(EncBytes, PacketGameState, 1, largePayload(MAX_FRAGMENT_DATA*2)).data, 1, 1)
+
+	// out of order
+	framer := NewPacketFramer()
+	if err := framer.push(frags[1]); err != ERROR_INVALID_FRAGMENT {
+		t.Errorf("Out of order: expected %v. Got %v", ERROR_INVALID_FRAGMENT, err)
+	}
+
+	// too many half sent messages
+	framer = NewPacketFramer()
+	var err error
+	for id := uint16(0); id <= MAX_PENDING_MESSAGES; id++ {
+		frag := Fragment(ConstructPacketV2(EncBytes, PacketGameState, 1, largePayload(PACKET_MAX_SIZE+1)).data, id, 1)[0]
+		err = framer.push(frag)
+	}
+	if err != ERROR_TOO_MANY_FRAGMENTED_MESSAGES {
+		t.Errorf("Too many pending: expected %v. Got %v", ERROR_TOO_MANY_FRAGMENTED_MESSAGES, err)
+	}
+
+	// stale messages make room again
+	for _, msg := range framer.partial {
+		msg.started = time.Now().Add(-FRAGMENT_TIMEOUT * 2)
+	}
+	frag := Fragment(ConstructPacketV2(EncBytes, PacketGameState, 1, largePayload(PACKET_MAX_SIZE+1)).data, 99, 1)[0]
+	if err := framer.push(frag); err != nil {
+		t.Errorf("Expected expired messages to be dropped. Got %v", err)
+	}
+	if len(framer.partial) != 1 {
+		t.Errorf("Expected 1 partial message. Got %d", len(framer.partial))
+	}
+
+	// too large, the length field of a single packet can't
+	// say so build the fragments by hand
+	framer = NewPacketFramer()
+	big := largePayload(MAX_MESSAGE_SIZE + 1)
+	var last error
+	for idx := 0; len(big) > 0; idx++ {
+		n := min(len(big), MAX_FRAGMENT_DATA)
+		frag := Fragment(ConstructPacketV2(EncBytes, PacketGameState, 1, largePayload(PACKET_MAX_SIZE+1)).data, 5, 1)[0]
+		frag = append(frag[:PACKET_HEADER_SIZE_FRAGMENT], big[:n]...)
+		frag[HEADER_LENGTH_OFFSET] = byte(n >> 8)
+		frag[HEADER_LENGTH_OFFSET+1] = byte(n)
+		frag[HEADER_FRAG_IDX_OFFSET] = byte(idx >> 8)
+		frag[HEADER_FRAG_IDX_OFFSET+1] = byte(idx)
+		big = big[n:]
+
+		if last = framer.push(frag); last != nil {
+			break
+		}
+	}
+	if last != ERROR_MESSAGE_TOO_LARGE {
+		t.Errorf("Too large: expected %v. Got %v", ERROR_MESSAGE_TOO_LARGE, last)
+	}
+}
+
+func TestClientWritesFragments(t *testing.T) {
+	client, framer := pipeClient("10000001")
+	defer client.Disconnect()
+
+	// v1 has no room for the fragment header
+	data := largePayload(PACKET_MAX_SIZE * 4)
+	if _, err := client.Write(ConstructPacket(EncJSON, PacketGameState, data).data); err != ERROR_MESSAGE_TOO_LARGE {
+		t.Fatalf("Expected %v writing to a v1 client. Got %v", ERROR_MESSAGE_TOO_LARGE, err)
+	}
+
+	client.mu.Lock()
+	client.version = VERSION_2
+	client.mu.Unlock()
+
+	client.Write(ConstructPacket(EncJSON, PacketGameState, data).data)
+	client.Write(ConstructPacket(EncString, PacketHealthCheckRes, []byte("Im alive :D")).data)
+
+	pkt, err := expectPacket(framer.C, PacketGameState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pkt.Data(), data) {
+		t.Fatal("Reassembled data does not match")
+	}
+
+	if _, err := expectPacket(framer.C, PacketHealthCheckRes); err != nil {
+		t.Fatal(err)
+	}
+}
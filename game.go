@@ -1,20 +1,15 @@
 package main
 
-import "log"
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
 
 // |  Version  |  Type   |  ClientID  | Data...
 //	1 byte     1 byte       8 bytes     Packet max size - game header size - header size
-
-const (
-	GSVERSION = uint8(1)
-)
-
-const (
-	GS_VERSION_OFFSET   = uint8(0)
-	GS_TYPE_OFFSET      = uint8(1)
-	GS_CLIENT_ID_OFFSET = uint8(2)
-	GS_DATA_OFFSET      = uint8(10)
-)
+//
+// the offsets are generated from the GameStateMessage layout in protocol.json
 
 func gameState(data []byte) GameState {
 	return GameState(data[GS_TYPE_OFFSET])
@@ -28,59 +23,472 @@ func gameStateData(data []byte) []byte {
 	return data[GS_DATA_OFFSET:]
 }
 
+// ConstructGameStatePacket wraps data in the game state
+// sub header on top of a regular PacketGameState packet
+func ConstructGameStatePacket(gs GameState, id ClientID, data []byte) Packet {
+	buf, _ := GameStateMessage{Version: GSVERSION, State: gs, ClientID: id, Data: data}.MarshalCustom()
+	return ConstructPacket(EncCustom, PacketGameState, buf)
+}
+
+// Game owns its own state. Everything below is only ever
+// touched by the goroutine running readLoop, everyone else
+// talks to the game through ch for game state packets and
+// reqch for membership changes
 type Game struct {
 	clients        []*Client
 	id             GameID
+	host           ClientID
 	state          GameState
-	ch             chan *Packet
+	battle         *Battle
+	ch             chan gameStatePacket
+	reqch          chan gameRequest
 	quitch         chan interface{}
-	validationFunc func(pkt *Packet) error
+	validationFunc func(msg GameStateMessage) error
+	// held by send while it hands a packet over, see readLoop
+	sendMu sync.RWMutex
+
+	// onEnd is called once when the game ends so
+	// the owner can forget about it
+	onEnd   func(g *Game)
+	endOnce sync.Once
+
+	// turn tracking. The active team is the only one allowed to
+	// send attacks and its queue is resolved once every living
+	// character on it has one queued up
+	turn   int
+	active TeamID
+	queue  []Attack
+
+	// set when the server is shutting down, the game
+	// ends as soon as the turn in progress is resolved
+	draining bool
+}
+
+type requestKind uint8
+
+const (
+	joinRequest requestKind = iota
+	leaveRequest
+	startRequest
+	drainRequest
+	stopRequest
+)
+
+// gameStatePacket is a game state packet handed to the
+// game's goroutine along with the client it came from
+type gameStatePacket struct {
+	pkt  *Packet
+	from *Client
+}
+
+// gameRequest is a membership change handed to the game's
+// goroutine. reply is buffered so the game never blocks on it
+type gameRequest struct {
+	kind  requestKind
+	c     *Client
+	pkt   *Packet // the packet behind the request, if any
+	reply chan error
 }
 
 // TODO rename this to something more appropriate
 // i guess readLoop works
 func (g *Game) readLoop() {
 	for {
+		// checked on its own, a select with more than one
+		// ready picks any of them
 		select {
-		case pkt := <-g.ch:
-			log.Printf("Gamestate of type %s with data %s", GameStateToString(gameState(pkt.Data())), gameStateData(pkt.Data()))
-			err := g.broadCast(pkt)
+		case <-g.quitch:
+			log.Printf("Game with ID %s finished", g.id)
+			g.turnAway()
+			return
+		default:
+		}
+
+		select {
+		case in := <-g.ch:
+			err := g.handleGameState(in.pkt)
 			if err != nil {
-				// TODO find a way to pipe this error back to the client
-				// can probably just use clientID and sent back to client
-				log.Println("There was a packet validation/broadcast error")
+				log.Printf("Game %s rejected game state packet: %s", g.id, err)
+				in.from.Reply(in.pkt, ConstructReplyErrorPacket(err, in.pkt))
 			}
+			in.pkt.Release()
+		case req := <-g.reqch:
+			req.reply <- g.handleRequest(req)
 		case <-g.quitch:
-			log.Printf("Game with ID %s finished", g.id)
+		}
+	}
+}
+
+// turnAway answers whatever was still queued up when the game
+// finished. Sends already under way are waited out first, any
+// send after that sees quitch closed and never queues
+func (g *Game) turnAway() {
+	g.sendMu.Lock()
+	g.sendMu.Unlock()
+
+	for {
+		select {
+		case in := <-g.ch:
+			in.from.Reply(in.pkt, ConstructReplyErrorPacket(ERROR_GAME_FINISHED, in.pkt))
+			in.pkt.Release()
+		default:
 			return
 		}
 	}
 }
 
-func (g *Game) broadCast(pkt *Packet) error {
-	err := g.validationFunc(pkt)
+// send hands a game state packet from c to the game
+func (g *Game) send(pkt *Packet, c *Client) error {
+	g.sendMu.RLock()
+	defer g.sendMu.RUnlock()
+
+	// a finished game must never take another packet
+	select {
+	case <-g.quitch:
+		return ERROR_GAME_FINISHED
+	default:
+	}
+
+	select {
+	case g.ch <- gameStatePacket{pkt: pkt, from: c}:
+		return nil
+	case <-g.quitch:
+		return ERROR_GAME_FINISHED
+	}
+}
+
+// request hands a membership change to the game and
+// waits for it to be applied
+func (g *Game) request(kind requestKind, c *Client, pkt *Packet) error {
+	req := gameRequest{kind: kind, c: c, pkt: pkt, reply: make(chan error, 1)}
+
+	select {
+	case g.reqch <- req:
+	case <-g.quitch:
+		return ERROR_GAME_FINISHED
+	}
+
+	// once the game picks a request up it always replies
+	return <-req.reply
+}
+
+func (g *Game) handleRequest(req gameRequest) error {
+	switch req.kind {
+	case joinRequest:
+		return g.join(req.c, req.pkt)
+	case leaveRequest:
+		return g.leave(req.c, req.pkt)
+	case startRequest:
+		return g.start(req.c, req.pkt)
+	case drainRequest:
+		g.drain()
+	case stopRequest:
+		log.Printf("Stopping game %s", g.id)
+		g.end()
+	}
+	return nil
+}
+
+func (g *Game) join(c *Client, req *Packet) error {
+	if g.state != WAITING {
+		log.Printf("Client with ID %s attempted to join game %s after it started", c.clientID, g.id)
+		return ERROR_GAME_ALREADY_STARTED
+	}
+
+	team := g.openTeam()
+	if team == TeamNone {
+		log.Printf("Client with ID %s attempted to join full game %s", c.clientID, g.id)
+		return ERROR_GAME_FULL
+	}
+
+	if !c.seat(g, team) {
+		log.Printf("Client with ID %s attempted to join game while currently in game", c.clientID)
+		return ERROR_INVALID_GAME_JOIN_ATTEMPT
+	}
+
+	g.clients = append(g.clients, c)
+	c.Reply(req, ConstructPacket(EncString, PacketJoinGameSuccess, []byte(g.id)))
+
+	return nil
+}
+
+func (g *Game) leave(c *Client, req *Packet) error {
+	_, team := c.Game()
+	if g.client(c.clientID) != c {
+		return ERROR_CLIENT_NOT_IN_GAME
+	}
+
+	g.clients = removeClient(g.clients, c)
+	if g.host == c.clientID && len(g.clients) > 0 {
+		g.host = g.clients[0].clientID
+	}
+	c.unseat(g)
+
+	c.Reply(req, ConstructPacket(EncString, PacketLeaveGameSuccess, []byte("")))
+
+	switch {
+	case len(g.clients) == 0:
+		log.Printf("Last client left game %s", g.id)
+		g.end()
+	case g.state == ATTACK:
+		log.Printf("Client %s forfeited game %s", c.Id(), g.id)
+		g.forfeit(team)
+	}
+
+	return nil
+}
+
+func (g *Game) start(c *Client, req *Packet) error {
+	if g.host != c.clientID || g.client(c.clientID) != c {
+		log.Printf("Client with ID %s attempted to start game %s without being host", c.clientID, g.id)
+		return ERROR_NOT_GAME_HOST
+	}
+
+	if g.state != WAITING {
+		return ERROR_GAME_ALREADY_STARTED
+	}
+
+	if len(g.clients) != 2 {
+		return ERROR_GAME_NOT_READY
+	}
+
+	g.begin(req)
+
+	return nil
+}
+
+// handleGameState no longer relays what the client sent. Attacks
+// are queued up for the active team and once the queue is full
+// it is run through the battle and everyone, sender included,
+// gets the results the server decided on
+func (g *Game) handleGameState(pkt *Packet) error {
+	msg, err := DecodeGameState(pkt)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Data:", gameStateData(pkt.Data()))
+	err = g.validationFunc(msg)
+	if err != nil {
+		return err
+	}
 
+	log.Printf("Gamestate of type %s with data %s", GameStateToString(msg.State), msg.Data)
+
+	sender := g.client(msg.ClientID)
+	if sender == nil {
+		return ERROR_CLIENT_NOT_IN_GAME
+	}
+
+	if _, team := sender.Game(); g.state != ATTACK || team != g.active || msg.State != ATTACK {
+		return ERROR_INVALID_GAME_STATE
+	}
+
+	attacks, err := DecodeAttacks(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	// all or nothing, a packet with a bad attack
+	// in it doesn't get to queue the good ones
+	for _, a := range attacks {
+		if err := g.battle.Check(g.active, a); err != nil {
+			return err
+		}
+	}
+	for _, a := range attacks {
+		g.queueAttack(a)
+	}
+
+	if len(g.queue) < g.battle.Team(g.active).Alive() {
+		return nil
+	}
+
+	queue := g.queue
+	g.queue = nil
+
+	res, err := g.battle.Resolve(g.active, queue)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	g.broadCast(ConstructGameStatePacket(RESULT, sender.clientID, data))
+
+	if res.Winner != TeamNone {
+		log.Printf("Game %s won by team %d", g.id, res.Winner)
+		g.end()
+		return nil
+	}
+
+	if g.draining {
+		log.Printf("Game %s stopped after turn %d for shutdown", g.id, g.turn)
+		g.end()
+		return nil
+	}
+
+	g.advance(opponent(g.active))
+
+	return nil
+}
+
+// queueAttack replaces any attack already queued
+// for the same character, same as the client does
+func (g *Game) queueAttack(a Attack) {
+	for i, q := range g.queue {
+		if q.CharacterID == a.CharacterID {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			break
+		}
+	}
+	g.queue = append(g.queue, a)
+}
+
+// begin confirms the start and seat of every client, then
+// moves the game out of WAITING and hands the first turn
+// to TeamOne. The host gets its confirmation as the reply to req
+func (g *Game) begin(req *Packet) {
 	for _, c := range g.clients {
-		if c.clientID == gameStateClientID(pkt.Data()) {
-			continue
+		_, team := c.Game()
+		pkt, err := EncodeStartGameSuccess(EncJSON, StartInfo{GameID: g.id, Team: team, Host: g.host})
+		if err != nil {
+			log.Printf("Failed to marshal start info for game %s: %s", g.id, err)
+			return
+		}
+
+		if c.clientID == g.host {
+			c.Reply(req, pkt)
+		} else {
+			c.Write(pkt.data)
 		}
-		c.Write(pkt.data)
 	}
-	log.Println("Done broadcasting")
 
+	g.advance(TeamOne)
+}
+
+// advance starts the next turn for team and lets
+// every client know which phase they are now in
+func (g *Game) advance(team TeamID) {
+	g.turn++
+	g.active = team
+	g.state = ATTACK
+	g.queue = nil
+
+	log.Printf("Game %s turn %d, team %d attacking", g.id, g.turn, team)
+
+	for _, c := range g.clients {
+		_, own := c.Game()
+		phase := DEFENSE
+		if own == team {
+			phase = ATTACK
+		}
+
+		data, err := json.Marshal(TurnState{Turn: g.turn, ActiveTeam: team, Team: own})
+		if err != nil {
+			log.Printf("Failed to marshal turn state for game %s: %s", g.id, err)
+			return
+		}
+
+		c.Write(ConstructGameStatePacket(phase, c.clientID, data).data)
+	}
+}
+
+// drain lets the turn in progress play out before the
+// game ends. Games still in the lobby have nothing to
+// finish so they end right away
+func (g *Game) drain() {
+	if g.state == WAITING {
+		log.Printf("Closing lobby %s for shutdown", g.id)
+		g.end()
+		return
+	}
+	g.draining = true
+}
+
+// forfeit hands the win to whoever is left when
+// a player walks out of a running game
+func (g *Game) forfeit(team TeamID) {
+	res := TurnResult{Team: team, Results: []AttackResult{}, Winner: opponent(team)}
+
+	data, err := json.Marshal(res)
+	if err == nil {
+		g.broadCast(ConstructGameStatePacket(RESULT, "", data))
+	}
+
+	g.end()
+}
+
+// end finishes the game. Every client still seated is let go
+// so they can create or join another game, the read loop is
+// stopped and the owner is told through onEnd
+func (g *Game) end() {
+	g.endOnce.Do(func() {
+		g.state = FINISHED
+		for _, c := range g.clients {
+			c.unseat(g)
+		}
+		g.clients = nil
+
+		close(g.quitch)
+
+		if g.onEnd != nil {
+			g.onEnd(g)
+		}
+	})
+}
+
+// broadCast sends pkt to every client in the game. The
+// clients all share a single copy of it
+func (g *Game) broadCast(pkt Packet) {
+	shared := AcquirePacket(pkt.len)
+	copy(shared.data, pkt.data)
+
+	for _, c := range g.clients {
+		shared.Retain()
+		c.enqueue(shared, 0)
+	}
+	shared.Release()
+}
+
+func (g *Game) client(id ClientID) *Client {
+	for _, c := range g.clients {
+		if c.clientID == id {
+			return c
+		}
+	}
 	return nil
 }
 
-func NewGame(c *Client, vf func(pkt *Packet) error) *Game {
+// openTeam returns the first team without a client seated on it
+func (g *Game) openTeam() TeamID {
+	for _, team := range []TeamID{TeamOne, TeamTwo} {
+		taken := false
+		for _, c := range g.clients {
+			if _, own := c.Game(); own == team {
+				taken = true
+			}
+		}
+		if !taken {
+			return team
+		}
+	}
+	return TeamNone
+}
+
+// NewGame creates a game hosted by c. The caller is
+// responsible for seating c before starting readLoop
+func NewGame(c *Client, vf func(msg GameStateMessage) error) *Game {
 	return &Game{
 		clients:        []*Client{c},
 		id:             GenerateGameId(),
-		ch:             make(chan *Packet, 10),
+		host:           c.clientID,
+		state:          WAITING,
+		battle:         NewBattle(),
+		ch:             make(chan gameStatePacket, 10),
+		reqch:          make(chan gameRequest),
 		quitch:         make(chan interface{}),
 		validationFunc: vf,
 	}
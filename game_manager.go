@@ -1,20 +1,33 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"log"
 	"math/big"
 	"sync"
+	"time"
 )
 
+// how long an ended game is remembered so late
+// joiners get told it finished instead of that it
+// never existed
+const GAME_TOMBSTONE_TTL = time.Minute * 5
+
 type GameManager struct {
 	mu             sync.Mutex
 	games          map[GameID]*Game
-	validationFunc func(pkt *Packet) error
+	tombstones     map[GameID]time.Time
+	validationFunc func(msg GameStateMessage) error
+
+	// closing stops new games from being created
+	// and wg tracks the read loop of every game
+	closing bool
+	wg      sync.WaitGroup
 }
 
-func NopValidationFunc(pkt *Packet) error {
+func NopValidationFunc(msg GameStateMessage) error {
 	return nil
 }
 
@@ -32,79 +45,126 @@ func NewGameManager() GameManager {
 	return GameManager{
 		mu:             sync.Mutex{},
 		games:          make(map[GameID]*Game),
+		tombstones:     make(map[GameID]time.Time),
 		validationFunc: NopValidationFunc,
 	}
 }
 
-func (m *GameManager) CreateNewGame(c *Client) error {
-	if len(c.gameID) != 0 {
+// CreateNewGame and the other client requests take the packet that
+// asked for them so the reply can be matched up with it. req may
+// be nil when the server acts on the clients behalf
+func (m *GameManager) CreateNewGame(c *Client, req *Packet) error {
+	game := NewGame(c, m.validationFunc)
+	game.onEnd = m.removeGame
+
+	if !c.seat(game, TeamOne) {
 		log.Printf("Client with ID %s attempted to create a game while already in a game", c.clientID)
 		return ERROR_INVALID_CREATE_GAME_ATTEMPT
 	}
 
-	game := NewGame(c, m.validationFunc)
-
 	m.mu.Lock()
+	if m.closing {
+		m.mu.Unlock()
+		c.unseat(game)
+		return ERROR_SERVER_SHUTTING_DOWN
+	}
 	m.games[game.id] = game
+	m.wg.Add(1)
 	m.mu.Unlock()
 
-	go game.readLoop()
+	// written before the loop starts so the create success
+	// always reaches the host ahead of anything the game sends
+	pkt, _ := EncodeCreateGameSuccess(EncString, GameRef{GameID: game.id})
+	c.Reply(req, pkt)
 
-	msg := []byte(fmt.Sprintf("%s", game.id))
-
-	c.Write(ConstructPacket(EncString, PacketCreateGameSuccess, msg).data)
-
-	c.gameID = game.id
-	c.gamePump = game.ch
+	go func() {
+		defer m.wg.Done()
+		game.readLoop()
+	}()
 
 	return nil
 }
 
-func (m *GameManager) JoinGame(c *Client, id GameID) error {
-	if len(c.gameID) != 0 {
+func (m *GameManager) JoinGame(c *Client, id GameID, req *Packet) error {
+	if len(c.GameID()) != 0 {
 		log.Printf("Client with ID %s attempted to join game while currently in game", c.clientID)
 		return ERROR_INVALID_GAME_JOIN_ATTEMPT
 	}
 
-	// TODO find a way to parse this based on encoding
 	if len(id) != 6 {
 		return ERROR_INVALID_GAME_ID
 	}
 
-	game, ok := m.games[id]
-	if !ok {
-		log.Printf("Game of id %s does not exist!", id)
-		return ERROR_INVALID_GAME_ID
+	game, err := m.lookup(id)
+	if err != nil {
+		return err
 	}
 
-	msg := []byte(fmt.Sprintf("%s", game.id))
-	game.clients = append(game.clients, c)
-	c.Write(ConstructPacket(EncString, PacketJoinGameSuccess, msg).data)
+	return game.request(joinRequest, c, req)
+}
+
+// Disconnect takes c out of its game without it asking
+func (m *GameManager) Disconnect(c *Client) error {
+	return m.Leave(c, nil)
+}
 
-	c.gameID = game.id
-	c.gamePump = game.ch
+func (m *GameManager) Leave(c *Client, req *Packet) error {
+	game, _ := c.Game()
+	if game == nil {
+		return ERROR_CLIENT_NOT_IN_GAME
+	}
+
+	if err := game.request(leaveRequest, c, req); err != nil {
+		// the game ended underneath us and already let the client go
+		if err == ERROR_GAME_FINISHED {
+			log.Printf("Client %s attempted to disconnect from game that didn't exist", c.Id())
+			return ERROR_INVALID_GAME_DISCONNECT
+		}
+		return err
+	}
 
 	return nil
 }
 
-func (m *GameManager) Disconnect(c *Client) error {
-	if len(c.gameID) == 0 {
-		return ERROR_CLIENT_NOT_IN_GAME
+// lookup finds a running game, telling apart games
+// that recently ended from ones that never existed
+func (m *GameManager) lookup(id GameID) (*Game, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	game, ok := m.games[id]
+	if ok {
+		return game, nil
 	}
 
-	game, ok := m.games[c.gameID]
-	if !ok {
-		// this would be so weird
-		log.Printf("Client %s attempted to disconnect from game that didn't exist", c.Id())
-		return ERROR_INVALID_GAME_DISCONNECT
+	if ended, ok := m.tombstones[id]; ok {
+		if time.Since(ended) < GAME_TOMBSTONE_TTL {
+			return nil, ERROR_GAME_FINISHED
+		}
+		delete(m.tombstones, id)
 	}
 
-	game.clients = removeClient(game.clients, c)
-	c.gameID = ""
+	log.Printf("Game of id %s does not exist!", id)
+	return nil, ERROR_INVALID_GAME_ID
+}
+
+// removeGame drops an ended game and leaves a tombstone in
+// its place. Expired tombstones are swept at the same time
+func (m *GameManager) removeGame(g *Game) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	c.Write(ConstructPacket(EncString, PacketLeaveGameSuccess, []byte("")).data)
+	delete(m.games, g.id)
 
-	return nil
+	now := time.Now()
+	for id, ended := range m.tombstones {
+		if now.Sub(ended) >= GAME_TOMBSTONE_TTL {
+			delete(m.tombstones, id)
+		}
+	}
+	m.tombstones[g.id] = now
+
+	log.Printf("Removed game %s", g.id)
 }
 
 func removeClient(clients []*Client, target *Client) []*Client {
@@ -116,12 +176,60 @@ func removeClient(clients []*Client, target *Client) []*Client {
 	return clients
 }
 
-func (m *GameManager) StartGame(c *Client, id GameID) error {
-	_, ok := m.games[id]
-	if !ok {
-		log.Printf("Game of id %s does not exist!", id)
-		return ERROR_INVALID_GAME_ID
+func (m *GameManager) StartGame(c *Client, id GameID, req *Packet) error {
+	game, err := m.lookup(id)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if c.GameID() != id {
+		log.Printf("Client with ID %s attempted to start game %s without being host", c.clientID, id)
+		return ERROR_NOT_GAME_HOST
+	}
+
+	return game.request(startRequest, c, req)
+}
+
+// Shutdown stops new games from being created and lets every
+// running game finish its current turn. Games still going when
+// ctx is done are stopped where they are. Returns once every
+// game has ended
+func (m *GameManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+
+	for _, game := range m.running() {
+		game.request(drainRequest, nil, nil)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	for _, game := range m.running() {
+		game.request(stopRequest, nil, nil)
+	}
+	<-done
+
+	return ctx.Err()
+}
+
+func (m *GameManager) running() []*Game {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	games := make([]*Game, 0, len(m.games))
+	for _, game := range m.games {
+		games = append(games, game)
+	}
+	return games
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGameManagerLobby(t *testing.T) {
+	m := NewGameManager()
+	host, hostFramer := pipeClient("10000001")
+	guest, guestFramer := pipeClient("10000002")
+	late, lateFramer := pipeClient("10000003")
+
+	go m.CreateNewGame(host, nil)
+	pkt, err := expectPacket(hostFramer.C, PacketCreateGameSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := GameID(pkt.Data())
+
+	if err := m.StartGame(host, id, nil); err != ERROR_GAME_NOT_READY {
+		t.Fatalf("Start with one player: got %v want %v", err, ERROR_GAME_NOT_READY)
+	}
+
+	go m.JoinGame(guest, id, nil)
+	if _, err := expectPacket(guestFramer.C, PacketJoinGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.StartGame(guest, id, nil); err != ERROR_NOT_GAME_HOST {
+		t.Fatalf("Start from guest: got %v want %v", err, ERROR_NOT_GAME_HOST)
+	}
+
+	errch := make(chan error, 1)
+	go func() { errch <- m.StartGame(host, id, nil) }()
+
+	want := map[*PacketFramer]TeamID{hostFramer: TeamOne, guestFramer: TeamTwo}
+	for framer, team := range want {
+		pkt, err := expectPacket(framer.C, PacketStartGameSuccess)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var info StartInfo
+		if err := json.Unmarshal(pkt.Data(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.GameID != id || info.Team != team || info.Host != host.clientID {
+			t.Errorf("Unexpected start info %+v", info)
+		}
+	}
+
+	if _, err := expectGameState(hostFramer.C, ATTACK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(guestFramer.C, DEFENSE); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.JoinGame(late, id, nil); err != ERROR_GAME_ALREADY_STARTED {
+		t.Fatalf("Join after start: got %v want %v", err, ERROR_GAME_ALREADY_STARTED)
+	}
+
+	if err := m.StartGame(host, id, nil); err != ERROR_GAME_ALREADY_STARTED {
+		t.Fatalf("Second start: got %v want %v", err, ERROR_GAME_ALREADY_STARTED)
+	}
+
+	select {
+	case pkt := <-lateFramer.C:
+		t.Fatalf("Late joiner got unexpected %s", TypeToString(pkt.Type()))
+	default:
+	}
+}
+
+func TestGameManagerLifecycle(t *testing.T) {
+	m := NewGameManager()
+	host, hostFramer := pipeClient("10000001")
+	late, _ := pipeClient("10000002")
+
+	go m.CreateNewGame(host, nil)
+	pkt, err := expectPacket(hostFramer.C, PacketCreateGameSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := GameID(pkt.Data())
+	m.mu.Lock()
+	game := m.games[id]
+	m.mu.Unlock()
+
+	go m.Disconnect(host)
+	if _, err := expectPacket(hostFramer.C, PacketLeaveGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-game.quitch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Game read loop was not stopped")
+	}
+
+	m.mu.Lock()
+	_, ok := m.games[id]
+	m.mu.Unlock()
+	if ok {
+		t.Fatalf("Game %s still registered after last client left", id)
+	}
+
+	if err := m.JoinGame(late, id, nil); err != ERROR_GAME_FINISHED {
+		t.Fatalf("Join finished game: got %v want %v", err, ERROR_GAME_FINISHED)
+	}
+
+	m.tombstones[id] = time.Now().Add(-GAME_TOMBSTONE_TTL)
+	if err := m.JoinGame(late, id, nil); err != ERROR_INVALID_GAME_ID {
+		t.Fatalf("Join after tombstone expired: got %v want %v", err, ERROR_INVALID_GAME_ID)
+	}
+}
+
+func TestGameEndsOnWinner(t *testing.T) {
+	game, framers := newTestGame()
+	one := game.clients[0]
+	ended := make(chan GameID, 1)
+	game.onEnd = func(g *Game) { ended <- g.id }
+
+	go game.begin(nil)
+	for _, framer := range framers {
+		if _, err := expectPacket(framer.C, PacketStartGameSuccess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := expectGameState(framers[0].C, ATTACK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(framers[1].C, DEFENSE); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range game.battle.Team(TeamTwo).Characters {
+		c.Health = 1
+	}
+
+	go game.handleGameState(attackPacket(one.clientID,
+		attack(UnitOne, UnitOne, TeamTwo, "Dark Pulse"),
+		attack(UnitTwo, UnitTwo, TeamTwo, "Arcane Burst"),
+		attack(UnitThree, UnitThree, TeamTwo, "Slash"),
+	))
+
+	for _, framer := range framers {
+		if _, err := expectGameState(framer.C, RESULT); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case id := <-ended:
+		if id != game.id {
+			t.Fatalf("Ended game %s want %s", id, game.id)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Game did not end after a winner was decided")
+	}
+
+	if g, _ := one.Game(); g != nil || one.GameID() != "" {
+		t.Errorf("Client %s still attached to finished game", one.clientID)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func newTestGame() (*Game, [2]*PacketFramer) {
+	one, oneFramer := pipeClient("10000001")
+	two, twoFramer := pipeClient("10000002")
+	game := NewGame(one, validateGamePkt)
+	one.seat(game, TeamOne)
+	two.seat(game, TeamTwo)
+	game.clients = append(game.clients, two)
+
+	return game, [2]*PacketFramer{oneFramer, twoFramer}
+}
+
+func TestGameTurnPhases(t *testing.T) {
+	game, framers := newTestGame()
+	one, two := game.clients[0], game.clients[1]
+
+	if err := game.handleGameState(attackPacket(one.clientID, attack(UnitThree, UnitOne, TeamTwo, "Slash"))); err != ERROR_INVALID_GAME_STATE {
+		t.Fatalf("Attack before start: got %v want %v", err, ERROR_INVALID_GAME_STATE)
+	}
+
+	go game.begin(nil)
+	for _, framer := range framers {
+		if _, err := expectPacket(framer.C, PacketStartGameSuccess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := expectGameState(framers[0].C, ATTACK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(framers[1].C, DEFENSE); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := game.handleGameState(attackPacket(two.clientID, attack(UnitThree, UnitOne, TeamOne, "Slash"))); err != ERROR_INVALID_GAME_STATE {
+		t.Fatalf("Attack out of turn: got %v want %v", err, ERROR_INVALID_GAME_STATE)
+	}
+
+	// a bad attack sinks the whole packet, the good one with it
+	if err := game.handleGameState(attackPacket(one.clientID,
+		attack(UnitOne, UnitOne, TeamTwo, "Dark Pulse"),
+		attack(UnitTwo, UnitOne, TeamTwo, "Fireball"),
+	)); err != ERROR_INVALID_ATTACK {
+		t.Fatalf("Bad attack: got %v want %v", err, ERROR_INVALID_ATTACK)
+	}
+	if len(game.queue) != 0 {
+		t.Fatalf("Expected nothing queued. Got %d attacks", len(game.queue))
+	}
+
+	// partial queues are held until every living character has attacked
+	if err := game.handleGameState(attackPacket(one.clientID, attack(UnitThree, UnitOne, TeamTwo, "Slash"))); err != nil {
+		t.Fatal(err)
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- game.handleGameState(attackPacket(one.clientID,
+			attack(UnitOne, UnitOne, TeamTwo, "Dark Pulse"),
+			attack(UnitTwo, UnitOne, TeamTwo, "Arcane Burst"),
+		))
+	}()
+
+	for _, framer := range framers {
+		pkt, err := expectGameState(framer.C, RESULT)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var res TurnResult
+		if err := json.Unmarshal(gameStateData(pkt.Data()), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Results) != 3 {
+			t.Fatalf("Expected 3 results. Got %d", len(res.Results))
+		}
+	}
+
+	if _, err := expectGameState(framers[0].C, DEFENSE); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := expectGameState(framers[1].C, ATTACK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ts TurnState
+	if err := json.Unmarshal(gameStateData(pkt.Data()), &ts); err != nil {
+		t.Fatal(err)
+	}
+	if ts.Turn != 2 || ts.ActiveTeam != TeamTwo || ts.Team != TeamTwo {
+		t.Errorf("Unexpected turn state %+v", ts)
+	}
+
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGameFinishedWithPacketsQueued(t *testing.T) {
+	game, framers := newTestGame()
+	one := game.clients[0]
+
+	// queued up before the game ended and never picked up
+	for i := 0; i < 3; i++ {
+		if err := game.send(attackPacket(one.clientID, attack(UnitThree, UnitOne, TeamTwo, "Slash")), one); err != nil {
+			t.Fatal(err)
+		}
+	}
+	game.end()
+
+	if err := game.send(attackPacket(one.clientID, attack(UnitThree, UnitOne, TeamTwo, "Slash")), one); err != ERROR_GAME_FINISHED {
+		t.Fatalf("Expected %v once the game is over. Got %v", ERROR_GAME_FINISHED, err)
+	}
+
+	// every one of them is answered as the game goes away
+	game.readLoop()
+	for i := 0; i < 3; i++ {
+		if err := expectError(framers[0].C, ERROR_GAME_FINISHED); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(game.ch) != 0 {
+		t.Fatalf("Expected nothing left queued. Got %d", len(game.ch))
+	}
+}
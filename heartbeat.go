@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	HEARTBEAT_INTERVAL = time.Second * 10
+	// heartbeats in a row a client can go without being
+	// heard from before it is considered dead
+	HEARTBEAT_MISSES = 3
+	// asked for in the hello by clients that answer heartbeats,
+	// no one else is sent them or reaped for ignoring them
+	CAP_HEARTBEAT = "heartbeat"
+)
+
+// heartbeat is the liveness state of a client. The server sends
+// a PacketHeartbeat carrying a nonce every interval and the client
+// is expected to send the nonce straight back in a PacketHeartbeatAck.
+// Any other packet from the client shows it is alive just as well
+type heartbeat struct {
+	nonce uint64
+	sent  time.Time
+	// heartbeats sent since the client was last heard from
+	missed int
+	rtt    time.Duration
+}
+
+// Latency returns the round trip time measured by the last
+// answered heartbeat, 0 until one has been answered
+func (c *Client) Latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hb.rtt
+}
+
+// ping records a heartbeat going out and returns its nonce
+// along with how many in a row have gone unanswered
+func (c *Client) ping() (uint64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hb.nonce++
+	c.hb.sent = time.Now()
+	missed := c.hb.missed
+	c.hb.missed++
+
+	return c.hb.nonce, missed
+}
+
+// pong records an answer to the heartbeat with nonce. Only
+// an answer to the latest one counts, a stale or made up
+// nonce says nothing about the client now
+func (c *Client) pong(nonce uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if nonce != c.hb.nonce {
+		return
+	}
+	c.hb.missed = 0
+	c.hb.rtt = time.Since(c.hb.sent)
+}
+
+// alive records that the client was heard from
+func (c *Client) alive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hb.missed = 0
+}
+
+// SetHeartbeat sets how often clients are sent a heartbeat and
+// how many they can go without being heard from before they are
+// disconnected. Only clients that asked for CAP_HEARTBEAT get them.
+// An interval of 0 turns heartbeats off
+func (h *Hub) SetHeartbeat(interval time.Duration, misses int) {
+	h.hbInterval = interval
+	h.hbMisses = misses
+}
+
+// Latencies returns the last measured latency of every
+// connected client
+func (h *Hub) Latencies() map[ClientID]time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	latencies := make(map[ClientID]time.Duration, len(h.clients))
+	for _, c := range h.clients {
+		latencies[c.clientID] = c.Latency()
+	}
+	return latencies
+}
+
+// heartbeat pings c until stop is closed. A client that goes
+// too many heartbeats without being heard from is reaped
+func (h *Hub) heartbeat(c *Client, stop chan struct{}) {
+	ticker := time.NewTicker(h.hbInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			nonce, missed := c.ping()
+			if missed >= h.hbMisses {
+				h.reap(c)
+				return
+			}
+
+			pkt, _ := EncodeHeartbeat(EncBytes, Heartbeat{Nonce: nonce})
+			c.Write(pkt.data)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reap disconnects a client that stopped answering heartbeats.
+// Unlike a dropped connection the peer is known to be gone so
+// its seat isn't held for it
+func (h *Hub) reap(c *Client) {
+	log.Printf("Client %s missed %d heartbeats, disconnecting", c.Id(), h.hbMisses)
+	h.disconnect(c)
+}
+
+func (h *Hub) heartbeatAckHandler(p *Packet, c *Client, msg Heartbeat) error {
+	c.pong(msg.Nonce)
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// heartbeatClient dials addr and asks for heartbeats in its hello
+func heartbeatClient(t *testing.T, addr string) (*Client, *PacketFramer) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(conn)
+
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, client.conn)
+
+	challenge, err := expectPacket(framer.C, PacketAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, _ := EncodeHello(EncJSON, Hello{Capabilities: []string{CAP_HEARTBEAT}})
+	client.Write(hello.data)
+	client.Write(ConstructPacket(EncString, PacketAuth, challenge.Data()).data)
+	client.clientID = ClientID(challenge.Data())
+
+	if _, err := expectPacket(framer.C, PacketHelloAck); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := expectPacket(framer.C, PacketSessionToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.session = string(pkt.Data())
+
+	return client, framer
+}
+
+func TestHeartbeatLatency(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	hub.SetHeartbeat(time.Millisecond*20, 3)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+
+	client, framer := heartbeatClient(t, server.ln.Addr().String())
+	defer client.Disconnect()
+
+	var last uint64
+	for i := 0; i < 5; i++ {
+		pkt, err := expectPacket(framer.C, PacketHeartbeat)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nonce := binary.BigEndian.Uint64(pkt.Data())
+		if nonce <= last {
+			t.Fatalf("Expected nonce after %d. Got %d", last, nonce)
+		}
+		last = nonce
+
+		client.Write(ConstructPacket(EncBytes, PacketHeartbeatAck, pkt.Data()).data)
+	}
+
+	// the client answered every heartbeat so it outlived
+	// several intervals worth of misses
+	time.Sleep(time.Millisecond * 10)
+	latency, ok := hub.Latencies()[client.clientID]
+	if !ok || latency <= 0 {
+		t.Fatalf("Expected latency to be measured. Got %v", latency)
+	}
+}
+
+func TestHeartbeatReaping(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	hub.SetHeartbeat(time.Millisecond*20, 3)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+
+	client, framer := heartbeatClient(t, server.ln.Addr().String())
+	defer client.Disconnect()
+
+	client.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	if _, err := expectPacket(framer.C, PacketCreateGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	// heartbeats go unanswered, answers to the wrong one don't count
+	for i := 0; i < 3; i++ {
+		client.Write(ConstructPacket(EncBytes, PacketHeartbeatAck, make([]byte, 8)).data)
+		if _, err := expectPacket(framer.C, PacketHeartbeat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectClosed(t, framer)
+
+	// the seat isn't held for a reaped client
+	time.Sleep(time.Millisecond * 50)
+	if n := len(hub.gamemgr.running()); n != 0 {
+		t.Fatalf("Expected the game to end with its only client. %d still running", n)
+	}
+	if n := len(hub.Latencies()); n != 0 {
+		t.Fatalf("Expected no connected clients. Got %d", n)
+	}
+}
+
+func TestHeartbeatLiveness(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	hub.SetHeartbeat(time.Millisecond*20, 3)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+
+	// busy clients don't have to answer, anything they send will do
+	busy, busyFramer := heartbeatClient(t, server.ln.Addr().String())
+	defer busy.Disconnect()
+	// and clients that never asked for heartbeats don't get any
+	legacy, legacyFramer := dialClient(t, server.ln.Addr().String())
+	defer legacy.Disconnect()
+
+	for i := 0; i < 10; i++ {
+		busy.Write(ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data)
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the busy client ignored every heartbeat, it's still there
+	busy.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	for created := false; !created; {
+		select {
+		case pkt := <-busyFramer.C:
+			created = pkt.Type() == PacketCreateGameSuccess
+		case err := <-busyFramer.errch:
+			t.Fatalf("Expected the busy client to be kept alive. Got %v", err)
+		case <-time.After(time.Second * 5):
+			t.Fatal(ERROR_SERVER_TIMEOUT)
+		}
+	}
+
+	legacy.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	if _, err := expectPacket(legacyFramer.C, PacketCreateGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+}
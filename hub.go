@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	HandlerFunc func(p *Packet, c *Client) error
+)
+
+// Conn is all the Hub needs from a connection, a stream of
+// Packet frames both ways. net.Conn fits, so TCP, TLS, the
+// WebSocket gateway and net.Pipe all plug in as is
+type Conn interface {
+	io.ReadWriteCloser
+	RemoteAddr() net.Addr
+	SetWriteDeadline(t time.Time) error
+}
+
+// Hub is the part of the server every transport shares. It
+// owns the handlers, sessions and games, transports accept
+// connections however they do and hand them over to Serve
+type Hub struct {
+	// what packets are dispatched to, the routes wrapped
+	// in their middleware. See Handle and Use
+	handlers   map[PacketType]HandlerFunc
+	routes     map[PacketType]route
+	middleware []Middleware
+
+	quitch   chan interface{}
+	gamemgr  GameManager
+	sessions *SessionStore
+	auth     Authenticator
+
+	hbInterval   time.Duration
+	hbMisses     int
+	framerPolicy FramerPolicy
+	// set when verified client certificates authenticate, see SetClientCertAuth
+	certID ClientCertMapper
+
+	mu sync.Mutex
+	// keyed by connection, not address. Connections that
+	// never went over the network can't be told apart by it
+	clients map[Conn]*Client
+	// set once shutdown starts, no new connections are
+	// handed to handleConnection after that
+	closing   bool
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func NewHub() *Hub {
+	h := &Hub{
+		handlers: make(map[PacketType]HandlerFunc),
+		routes:   make(map[PacketType]route),
+		quitch:   make(chan interface{}),
+		gamemgr:  NewGameManager(),
+		sessions: NewSessionStore(),
+		auth:     EchoAuthenticator{},
+
+		hbInterval: HEARTBEAT_INTERVAL,
+		hbMisses:   HEARTBEAT_MISSES,
+
+		mu:      sync.Mutex{},
+		clients: make(map[Conn]*Client),
+	}
+
+	h.Use(Recover)
+	h.registerHandlers()
+
+	return h
+}
+
+func (h *Hub) SetGameStateValidationFunc(vf func(msg GameStateMessage) error) {
+	h.gamemgr.validationFunc = vf
+}
+
+// SetFramerPolicy sets what happens to connections that send
+// bytes the framer can't make sense of, PolicyResync by default
+func (h *Hub) SetFramerPolicy(policy FramerPolicy) {
+	h.framerPolicy = policy
+}
+
+// SetSessionGracePeriod sets how long a dropped client
+// has to resume before it loses its seat
+func (h *Hub) SetSessionGracePeriod(d time.Duration) {
+	h.sessions.grace = d
+}
+
+// SetAuthenticator replaces the default EchoAuthenticator
+func (h *Hub) SetAuthenticator(a Authenticator) {
+	h.auth = a
+}
+
+func GenerateClientId() ClientID {
+	mx := big.NewInt(90000000)
+	n, err := rand.Int(rand.Reader, mx)
+	if err != nil {
+		panic(err)
+	}
+	return ClientID(fmt.Sprintf("%08d", n.Int64()+10000000))
+}
+
+// Serve runs conn in its own goroutine until it is done with.
+// Every transport hands its connections over through here so
+// Shutdown can wait on every one of them
+func (h *Hub) Serve(conn Conn) {
+	client := NewClient(conn)
+
+	h.mu.Lock()
+	if h.closing {
+		h.mu.Unlock()
+		client.Disconnect()
+		return
+	}
+	h.wg.Add(1)
+	h.mu.Unlock()
+
+	go func() {
+		defer h.wg.Done()
+		h.handleConnection(client)
+	}()
+}
+
+// authenticate challenges the client with PacketAuth and hands
+// whatever it sends back to the Authenticator. The challenge is
+// only meaningful to the EchoAuthenticator, other authenticators
+// expect a credential of their own
+//
+// A client that lost its connection can answer the challenge with
+// PacketResume and its session token instead, in which case the
+// client it used to be is handed back
+//
+// Before its answer the client can send a PacketHello to settle on
+// a protocol. A client that doesn't is held to the version it
+// answers in, which is how clients from before the hello get by
+func (h *Hub) authenticate(framer *PacketFramer, client *Client) (*Client, error) {
+	challenge := GenerateClientId()
+	client.Write(ConstructPacket(EncBytes, PacketAuth, []byte(challenge)).data)
+
+	timeout := time.After(time.Second * 5)
+	next := func() (*Packet, error) {
+		select {
+		case p := <-framer.C:
+			return p, nil
+		case err := <-framer.errch:
+			// nothing to wait out the timeout for if the stream
+			// is already broken or gone, failed TLS handshakes too
+			var ferr *FrameError
+			if errors.As(err, &ferr) {
+				err = ferr.Err
+			}
+			return nil, err
+		case <-timeout:
+			return nil, ERROR_AUTH_TIMEOUT
+		case <-h.quitch:
+			return nil, ERROR_SERVER_SHUTTING_DOWN
+		}
+	}
+
+	authp, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	if authp.Type() == PacketHello {
+		err = h.hello(client, authp)
+		authp.Release()
+		if err != nil {
+			return nil, err
+		}
+		if authp, err = next(); err != nil {
+			return nil, err
+		}
+	} else {
+		client.mu.Lock()
+		client.version = authp.Version()
+		client.proto = legacyProtocol(client.version)
+		client.mu.Unlock()
+	}
+	defer authp.Release()
+
+	switch authp.Type() {
+	case PacketAuth:
+	case PacketResume:
+		return h.resume(client, authp)
+	default:
+		return nil, ERROR_INVALID_AUTH_PKT
+	}
+
+	// a verified client certificate speaks for itself,
+	// everyone else has to get past the Authenticator
+	id, viaCert, err := h.certClientID(client.conn)
+	if err != nil {
+		return nil, err
+	}
+	if !viaCert {
+		if id, err = h.auth.Authenticate(challenge, authp.Data()); err != nil {
+			return nil, err
+		}
+	}
+
+	client.clientID = id
+	if client.session, err = h.sessions.Issue(client); err != nil {
+		return nil, err
+	}
+	client.Reply(authp, ConstructPacket(EncString, PacketSessionToken, []byte(client.session)))
+	log.Printf("Successful authentication of conn %s with ClientID %s", client.Addr(), id)
+
+	return client, nil
+}
+
+// hello settles on a protocol out of what the client sent in
+// p and lets it know what was picked. Everything from here on
+// is framed in the picked version
+func (h *Hub) hello(client *Client, p *Packet) error {
+	msg, err := DecodeHello(p)
+	if err != nil {
+		return err
+	}
+
+	proto, err := negotiate(msg)
+	if err != nil {
+		return err
+	}
+
+	client.mu.Lock()
+	client.version = uint8(proto.Version)
+	client.proto = proto
+	client.mu.Unlock()
+
+	ack, err := EncodeHelloAck(EncJSON, proto)
+	if err != nil {
+		return err
+	}
+	client.Reply(p, ack)
+
+	log.Printf("Negotiated v%d with game state v%d for conn %s", proto.Version, proto.GameStateVersion, client.Addr())
+
+	return nil
+}
+
+// resume hands the connection of fresh over to the client behind
+// the token in req. If that client still had a connection open it
+// is closed, the client is most likely on the other end of a dead peer
+func (h *Hub) resume(fresh *Client, req *Packet) (*Client, error) {
+	client, err := h.sessions.Resume(string(req.Data()))
+	if err != nil {
+		return nil, err
+	}
+
+	_, team := client.Game()
+	greeting, err := EncodeResumeSuccess(EncJSON, ResumeInfo{ClientID: client.clientID, GameID: client.GameID(), Team: team})
+	if err != nil {
+		return nil, err
+	}
+
+	// the challenge fresh was sent has to be out of
+	// the way before the resumed client takes over
+	fresh.release()
+
+	old := client.attach(fresh, req, greeting)
+	if old != fresh.conn {
+		old.Close()
+	}
+
+	log.Printf("Resumed session of client %s on conn %s", client.Id(), client.Addr())
+
+	return client, nil
+}
+
+func (h *Hub) registerClient(client *Client, conn Conn) {
+	h.mu.Lock()
+	h.clients[conn] = client
+	h.mu.Unlock()
+}
+
+func (h *Hub) unregisterClient(client *Client, conn Conn) {
+	h.mu.Lock()
+	if h.clients[conn] == client {
+		delete(h.clients, conn)
+	}
+	h.mu.Unlock()
+}
+
+func (h *Hub) handleConnection(client *Client) {
+	conn := client.conn
+
+	framer := NewPacketFramer()
+	framer.SetPolicy(h.framerPolicy)
+	go FrameWithReader(framer, conn, conn.RemoteAddr())
+	defer framer.Stop()
+
+	authed, autherr := h.authenticate(framer, client)
+	if autherr != nil {
+		log.Printf("Failed to authenticate conn %s with err %s", conn.RemoteAddr(), autherr.Error())
+		client.Write(ConstructErrorPacket(autherr).data)
+		client.Disconnect()
+		return
+	}
+	client = authed
+
+	defer h.drop(client, conn)
+	h.registerClient(client, conn)
+
+	// clients from before heartbeats, the browser one included,
+	// would be reaped for never answering
+	if h.hbInterval > 0 && client.HasCapability(CAP_HEARTBEAT) {
+		// backstop for peers so far gone even the
+		// heartbeat writes never fail
+		framer.SetReadTimeout(h.hbInterval * time.Duration(h.hbMisses+2))
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go h.heartbeat(client, stop)
+	}
+
+	for {
+		select {
+		case p := <-framer.C:
+			// acks are only as good as their nonce, see pong
+			if p.Type() != PacketHeartbeatAck {
+				client.alive()
+			}
+
+			handler, ok := h.handlers[p.Type()]
+			if !ok {
+				log.Printf("%s: %s", ERROR_NO_HANDLER_REGISTERED.Error(), TypeToString(p.Type()))
+				p.Release()
+				continue
+			}
+			if !client.Accepts(p.Encoding()) {
+				client.Reply(p, ConstructReplyErrorPacket(ERROR_UNSUPPORTED_ENCODING, p))
+				p.Release()
+				continue
+			}
+
+			err := handler(p, client)
+			if err != nil {
+				log.Println(err)
+				client.Reply(p, ConstructReplyErrorPacket(err, p))
+			}
+			// handlers that hang on to p retain it themselves
+			p.Release()
+		case err := <-framer.errch:
+			var ferr *FrameError
+			if errors.As(err, &ferr) {
+				// the client is still there, let it know what it got wrong
+				client.Write(ConstructErrorPacket(ferr.Err).data)
+				if !ferr.Fatal {
+					log.Printf("Recovered from bad stream from client %s: %s", client.Id(), ferr.Err)
+					continue
+				}
+				client.release()
+			}
+			log.Printf("Error reading packet from client %s. Shutting down connection due to error %s", client.Addr(), err.Error())
+			return
+		case <-h.quitch:
+			return
+		}
+	}
+}
+
+// registerHandlers registers the built in handlers. The
+// game ones need the client to still have a session
+func (h *Hub) registerHandlers() {
+	h.Handle(PacketHealthCheckReq, h.healthCheckReqHandler)
+	h.Handle(PacketCreateGame, h.createGameHandler, h.RequireAuth)
+	h.Handle(PacketJoinGame, Typed(h.joinGameHandler), h.RequireAuth)
+	h.Handle(PacketStartGame, Typed(h.startGameHandler), h.RequireAuth)
+	h.Handle(PacketGameState, Typed(h.gameStateHandler), h.RequireAuth)
+	h.Handle(PacketLeaveGame, h.leaveGameHandler, h.RequireAuth)
+	h.Handle(PacketDisconnect, h.disconnectHandler)
+	h.Handle(PacketHeartbeatAck, Typed(h.heartbeatAckHandler))
+	h.Handle(PacketBindToken, h.bindTokenHandler, h.RequireAuth)
+}
+
+// disconnect is for clients that are done for good,
+// their session goes with them
+func (h *Hub) disconnect(c *Client) {
+	h.sessions.Revoke(c.session)
+	c.closeUDP()
+	h.gamemgr.Disconnect(c)
+
+	log.Printf("Disconnecting client %s", c.Id())
+	c.Disconnect()
+}
+
+// drop cleans up after conn is lost. A client seated in a game
+// keeps its seat for the grace period so it can resume, anyone
+// else is disconnected right away
+func (h *Hub) drop(c *Client, conn Conn) {
+	h.unregisterClient(c, conn)
+	conn.Close()
+
+	if !c.detach(conn) {
+		// resumed on another connection already
+		return
+	}
+
+	if game, _ := c.Game(); game != nil {
+		log.Printf("Client %s lost connection, holding seat in game %s", c.Id(), c.GameID())
+		h.sessions.Park(c.session, func() {
+			c.closeUDP()
+			h.gamemgr.Disconnect(c)
+		})
+		return
+	}
+
+	h.sessions.Revoke(c.session)
+	c.closeUDP()
+	log.Printf("Disconnecting client %s", c.Id())
+}
+
+func (h *Hub) healthCheckReqHandler(p *Packet, c *Client) error {
+	log.Printf("Health check request from client: %s", c.Id())
+
+	pkt := ConstructPacket(EncString, PacketHealthCheckRes, []byte("Im alive :D"))
+
+	c.Reply(p, pkt)
+
+	return nil
+}
+
+func (h *Hub) bindTokenHandler(p *Packet, c *Client) error {
+	token, err := h.sessions.BindToken(c.session)
+	if err != nil {
+		return err
+	}
+
+	c.Reply(p, ConstructPacket(EncString, PacketBindTokenSuccess, []byte(token)))
+
+	return nil
+}
+
+func (h *Hub) createGameHandler(p *Packet, c *Client) error {
+	log.Println("Create game request from client: ", c.Id())
+
+	if err := h.gamemgr.CreateNewGame(c, p); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (h *Hub) joinGameHandler(p *Packet, c *Client, msg GameRef) error {
+	log.Printf("Join game request from client %s for game %s", c.Id(), msg.GameID)
+
+	if err := h.gamemgr.JoinGame(c, msg.GameID, p); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (h *Hub) startGameHandler(p *Packet, c *Client, msg GameRef) error {
+	log.Printf("Start game request from client %s for game %s", c.Id(), msg.GameID)
+
+	if err := h.gamemgr.StartGame(c, msg.GameID, p); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (h *Hub) gameStateHandler(p *Packet, c *Client, msg GameStateMessage) error {
+	log.Printf("Game state packet sent from client %s.", c.Id())
+
+	game, _ := c.Game()
+	if game == nil {
+		return ERROR_CLIENT_NOT_IN_GAME
+	}
+
+	if c.clientID != msg.ClientID {
+		log.Println(c.clientID, msg.ClientID)
+		return ERROR_INVALID_AUTH_ID
+	}
+
+	if int(msg.Version) != c.Protocol().GameStateVersion {
+		return ERROR_VERSION_MISMATCH
+	}
+
+	// the game releases it once it has been handled
+	p.Retain()
+	if err := game.send(p, c); err != nil {
+		p.Release()
+		return err
+	}
+	return nil
+}
+
+func (h *Hub) leaveGameHandler(p *Packet, c *Client) error {
+	log.Printf("Leave game packet sent from client %s.", c.Id())
+
+	if err := h.gamemgr.Leave(c, p); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (h *Hub) disconnectHandler(p *Packet, c *Client) error {
+	log.Printf("Disconnect request from client %s", c.Id())
+
+	h.disconnect(c)
+
+	return nil
+}
+
+// Shutdown stops the hub gracefully. Every client is told the
+// server is going away and running games get to finish their
+// current turn. Once they have, or ctx is done, every connection
+// is closed and Shutdown waits for the connection and game
+// goroutines to exit. Returns ctx.Err() if games had to be stopped
+// early. Transports should stop accepting before it is called,
+// anything handed to Serve after is turned away
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closing = true
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	info := ShutdownInfo{}
+	if deadline, ok := ctx.Deadline(); ok {
+		info.Deadline = deadline
+	}
+	pkt, _ := EncodeServerShutdown(EncJSON, info)
+	for _, c := range clients {
+		c.Write(pkt.data)
+	}
+
+	log.Printf("Shutting down, waiting on running games")
+	drainErr := h.gamemgr.Shutdown(ctx)
+
+	// disconnected before quitch is closed so whatever the
+	// games sent last is flushed before the handlers bail
+	for _, c := range clients {
+		c.Disconnect()
+	}
+	h.closeOnce.Do(func() { close(h.quitch) })
+	h.wg.Wait()
+
+	log.Println("Shutdown complete")
+
+	return drainErr
+}
+
+// Close shuts the hub down without waiting on anything
+func (h *Hub) Close() {
+	h.mu.Lock()
+	h.closing = true
+	h.mu.Unlock()
+
+	h.closeOnce.Do(func() { close(h.quitch) })
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+// serveClient returns an authenticated client
+// connected to hub over a MemTransport
+func serveClient(t *testing.T, hub *Hub) (*Client, *PacketFramer) {
+	t.Helper()
+
+	client := NewClient(NewMemTransport(hub).Dial())
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, client.conn)
+	if err := authenticate(framer.C, client); err != nil {
+		t.Fatal(err)
+	}
+
+	return client, framer
+}
+
+func TestHubWithoutNetwork(t *testing.T) {
+	hub := NewHub()
+	defer hub.Close()
+
+	// every pipe has the same address, the hub
+	// can't go by it to tell clients apart
+	one, oneFramer := serveClient(t, hub)
+	defer one.Disconnect()
+	two, twoFramer := serveClient(t, hub)
+	defer two.Disconnect()
+
+	one.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	pkt, err := expectPacket(oneFramer.C, PacketCreateGameSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	two.Write(ConstructPacket(EncString, PacketJoinGame, pkt.Data()).data)
+	if _, err := expectPacket(twoFramer.C, PacketJoinGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(hub.Latencies()); n != 2 {
+		t.Fatalf("Expected 2 clients. Got %d", n)
+	}
+}
@@ -1,41 +1,97 @@
 package main
 
-import "log"
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// how long running games get to finish on shutdown
+const SHUTDOWN_TIMEOUT = time.Second * 30
 
 const (
-	ATTACK GameState = iota
-	DEFENSE
+	// game and lobby packets a second a client can send on average
+	CLIENT_RATE_LIMIT = 20
+	// game and lobby packets a client can send in one go
+	CLIENT_RATE_BURST = 40
 )
 
-func GameStateToString(gs GameState) string {
-	switch gs {
-	case ATTACK:
-		return "Attack"
-	case DEFENSE:
-		return "Defense"
+func validateGamePkt(msg GameStateMessage) error {
+	if msg.Version != GSVERSION {
+		return ERROR_INVALID_GAME_STATE
 	}
 
-	return "Invalid"
-}
-
-func validateGamePkt(pkt *Packet) error {
-	switch gameState(pkt.Data()) {
+	switch msg.State {
 	case ATTACK:
 		return nil
-	case DEFENSE:
-		return nil
 	}
-	return nil
+	return ERROR_INVALID_GAME_STATE
 }
 
 func main() {
-	server := NewTCPServer("0.0.0.0:3000")
+	hub := NewHub()
 
-	server.SetGameStateValidationFunc(validateGamePkt)
+	hub.SetGameStateValidationFunc(validateGamePkt)
+	hub.SetRateLimit(CLIENT_RATE_LIMIT, CLIENT_RATE_BURST)
+
+	// signed tokens when a secret is configured, echo auth for local play
+	if secret := os.Getenv("AUTH_SECRET"); secret != "" {
+		hub.SetAuthenticator(NewTokenAuthenticator([]byte(secret)))
+	}
+
+	server := NewTCPServer("0.0.0.0:3000", hub)
+
+	// TLS when a certificate is configured, client certificates
+	// on top of that when there is a CA to check them against
+	if cert := os.Getenv("TLS_CERT"); cert != "" {
+		if err := server.SetTLS(cert, os.Getenv("TLS_KEY")); err != nil {
+			log.Fatal(err.Error())
+		}
+		if ca := os.Getenv("TLS_CLIENT_CA"); ca != "" {
+			if err := server.SetClientCertAuth(ca, nil); err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+	}
 
 	if err := server.Start(); err != nil {
 		log.Fatal(err.Error())
 	}
 
-	<-server.quitch
+	gateway := NewWSServer("0.0.0.0:3001", hub)
+	if err := gateway.Start(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// game state over UDP for clients that bind to it
+	udp := NewUDPServer("0.0.0.0:3002", hub)
+	if err := udp.Start(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	log.Println("Received shutdown signal")
+
+	// nothing new gets in, game state falls back to TCP
+	server.Close()
+	udp.Close()
+
+	// games get this long to finish their turn, a second
+	// signal kills the server outright
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %s", err)
+	}
+
+	// closed last, it takes the hijacked connections with it
+	// and those should get to hear about the shutdown first
+	gateway.Close()
 }
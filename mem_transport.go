@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net"
+)
+
+// MemTransport serves connections that never leave the process,
+// each one a net.Pipe with the Hub on the far end. Nothing is bound
+// so any number of them can run side by side
+type MemTransport struct {
+	hub *Hub
+}
+
+func NewMemTransport(hub *Hub) *MemTransport {
+	return &MemTransport{hub: hub}
+}
+
+// Dial opens a connection to the hub and returns the client end.
+// Writes to it block until the hub reads them, same as net.Pipe
+func (m *MemTransport) Dial() net.Conn {
+	server, client := net.Pipe()
+	m.hub.Serve(server)
+	return client
+}
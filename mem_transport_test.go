@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+)
+
+// script drives clients connected over a MemTransport one step
+// at a time. Heartbeats are off so the only packets a client
+// gets are the ones the steps caused
+type script struct {
+	t   *testing.T
+	hub *Hub
+	mem *MemTransport
+}
+
+func newScript(t *testing.T) *script {
+	hub := NewHub()
+	hub.SetHeartbeat(0, 0)
+	hub.SetGameStateValidationFunc(validateGamePkt)
+	t.Cleanup(hub.Close)
+
+	return &script{t: t, hub: hub, mem: NewMemTransport(hub)}
+}
+
+// player is a client in a script, named so a failed
+// step says whose it was
+type player struct {
+	*Client
+	t      *testing.T
+	name   string
+	framer *PacketFramer
+}
+
+// connect dials the hub and authenticates as a new player
+func (s *script) connect(name string) *player {
+	s.t.Helper()
+
+	client := NewClient(s.mem.Dial())
+	s.t.Cleanup(client.Disconnect)
+
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, client.conn)
+	if err := authenticate(framer.C, client); err != nil {
+		s.t.Fatalf("%s: %s", name, err)
+	}
+
+	return &player{Client: client, t: s.t, name: name, framer: framer}
+}
+
+func (p *player) send(pktType PacketType, data []byte) {
+	p.Write(ConstructPacket(EncString, pktType, data).data)
+}
+
+// attack plays a whole turn against target
+func (p *player) attack(target TeamID) {
+	p.Write(fullAttack(p.clientID, target).data)
+}
+
+func (p *player) expect(pktType PacketType) *Packet {
+	p.t.Helper()
+
+	pkt, err := expectPacket(p.framer.C, pktType)
+	if err != nil {
+		p.t.Fatalf("%s: %s", p.name, err)
+	}
+	return pkt
+}
+
+func (p *player) expectError(want error) {
+	p.t.Helper()
+
+	if err := expectError(p.framer.C, want); err != nil {
+		p.t.Fatalf("%s: %s", p.name, err)
+	}
+}
+
+func (p *player) expectGameState(gs GameState) *Packet {
+	p.t.Helper()
+
+	pkt, err := expectGameState(p.framer.C, gs)
+	if err != nil {
+		p.t.Fatalf("%s: %s", p.name, err)
+	}
+	return pkt
+}
+
+// expectQuiet checks nothing else is waiting for the player. The
+// hub answers a player in order, so anything still on its way
+// shows up ahead of the health check
+func (p *player) expectQuiet() {
+	p.t.Helper()
+
+	p.send(PacketHealthCheckReq, []byte{})
+	p.expect(PacketHealthCheckRes)
+}
+
+func TestScriptedGame(t *testing.T) {
+	t.Parallel()
+	s := newScript(t)
+
+	a, b := s.connect("A"), s.connect("B")
+
+	// A creates
+	a.send(PacketCreateGame, []byte{})
+	id := a.expect(PacketCreateGameSuccess).Data()
+	a.expectQuiet()
+	b.expectQuiet()
+
+	// B joins
+	b.send(PacketJoinGame, id)
+	b.expect(PacketJoinGameSuccess)
+	a.expectQuiet()
+	b.expectQuiet()
+
+	// only the host can start
+	b.send(PacketStartGame, id)
+	b.expectError(ERROR_NOT_GAME_HOST)
+
+	// A starts
+	a.send(PacketStartGame, id)
+	a.expect(PacketStartGameSuccess)
+	a.expectGameState(ATTACK)
+	b.expect(PacketStartGameSuccess)
+	b.expectGameState(DEFENSE)
+	a.expectQuiet()
+	b.expectQuiet()
+
+	// A attacks
+	a.attack(TeamTwo)
+	a.expectGameState(RESULT)
+	a.expectGameState(DEFENSE)
+	b.expectGameState(RESULT)
+	b.expectGameState(ATTACK)
+	a.expectQuiet()
+	b.expectQuiet()
+
+	// B can't attack on A's behalf
+	b.Write(fullAttack(a.clientID, TeamOne).data)
+	b.expectError(ERROR_INVALID_AUTH_ID)
+	a.expectQuiet()
+}
+
+func TestScriptedLeave(t *testing.T) {
+	t.Parallel()
+	s := newScript(t)
+
+	a, b := s.connect("A"), s.connect("B")
+
+	a.send(PacketCreateGame, []byte{})
+	id := a.expect(PacketCreateGameSuccess).Data()
+	b.send(PacketJoinGame, id)
+	b.expect(PacketJoinGameSuccess)
+
+	// B leaves before the game starts, A can't start without it
+	b.send(PacketLeaveGame, []byte{})
+	b.expect(PacketLeaveGameSuccess)
+	b.expectQuiet()
+
+	a.send(PacketStartGame, id)
+	a.expectError(ERROR_GAME_NOT_READY)
+	a.expectQuiet()
+}
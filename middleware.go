@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a HandlerFunc to run code around it, see Hub.Use
+type Middleware func(HandlerFunc) HandlerFunc
+
+// route is a handler as it was registered, before any
+// of the hub's middleware is wrapped around it
+type route struct {
+	fn HandlerFunc
+	mw []Middleware
+}
+
+// Handle registers fn for packets of type pktType, replacing
+// whatever was registered for it before. mw wraps fn alone,
+// inside of whatever is added with Use. Has to be called
+// before any connection is served
+func (h *Hub) Handle(pktType PacketType, fn HandlerFunc, mw ...Middleware) {
+	h.routes[pktType] = route{fn: fn, mw: mw}
+	h.handlers[pktType] = h.chain(h.routes[pktType])
+}
+
+// Use wraps every handler in mw, the ones already registered
+// and the ones to come. The first middleware is the outermost.
+// Has to be called before any connection is served
+func (h *Hub) Use(mw ...Middleware) {
+	h.middleware = append(h.middleware, mw...)
+	for pktType, r := range h.routes {
+		h.handlers[pktType] = h.chain(r)
+	}
+}
+
+// chain wraps r in its own middleware and then the hub's
+func (h *Hub) chain(r route) HandlerFunc {
+	fn := r.fn
+	for i := len(r.mw) - 1; i >= 0; i-- {
+		fn = r.mw[i](fn)
+	}
+	for i := len(h.middleware) - 1; i >= 0; i-- {
+		fn = h.middleware[i](fn)
+	}
+	return fn
+}
+
+// Logging logs every packet handled, how long it took and
+// what went wrong if anything did
+func Logging(next HandlerFunc) HandlerFunc {
+	return func(p *Packet, c *Client) error {
+		start := time.Now()
+		err := next(p, c)
+		if err != nil {
+			log.Printf("%s from client %s failed in %s: %s", TypeToString(p.Type()), c.Id(), time.Since(start), err)
+			return err
+		}
+		log.Printf("%s from client %s handled in %s", TypeToString(p.Type()), c.Id(), time.Since(start))
+		return nil
+	}
+}
+
+// Recover turns a panicking handler into ERROR_HANDLER_PANIC
+// so one bad packet can't take the whole server down
+func Recover(next HandlerFunc) HandlerFunc {
+	return func(p *Packet, c *Client) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Handler for %s from client %s panicked: %v\n%s", TypeToString(p.Type()), c.Id(), r, debug.Stack())
+				err = ERROR_HANDLER_PANIC
+			}
+		}()
+		return next(p, c)
+	}
+}
+
+// RequireAuth rejects packets from clients whose session is
+// gone, say ones still in flight after a PacketDisconnect
+func (h *Hub) RequireAuth(next HandlerFunc) HandlerFunc {
+	return func(p *Packet, c *Client) error {
+		if client, ok := h.sessions.Lookup(c.session); !ok || client != c {
+			return ERROR_INVALID_SESSION
+		}
+		return next(p, c)
+	}
+}
+
+// RateLimit lets each client through perSecond times a second
+// on average, in bursts of up to burst. Anything over is turned
+// away with ERROR_RATE_LIMITED
+func RateLimit(perSecond float64, burst int) Middleware {
+	l := &rateLimiter{
+		rate:    perSecond,
+		burst:   float64(burst),
+		buckets: make(map[*Client]*bucket),
+		swept:   time.Now(),
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(p *Packet, c *Client) error {
+			if !l.allow(c, time.Now()) {
+				return ERROR_RATE_LIMITED
+			}
+			return next(p, c)
+		}
+	}
+}
+
+// SetRateLimit puts one RateLimit in front of the game and lobby
+// routes. Health checks, heartbeat acks and disconnects are never
+// turned away, a client over its limit can still keep its
+// connection alive and leave. Has to be called before any
+// connection is served
+func (h *Hub) SetRateLimit(perSecond float64, burst int) {
+	limit := RateLimit(perSecond, burst)
+	for _, pktType := range []PacketType{PacketCreateGame, PacketJoinGame, PacketStartGame, PacketGameState, PacketLeaveGame} {
+		r := h.routes[pktType]
+		h.Handle(pktType, r.fn, append(r.mw[:len(r.mw):len(r.mw)], limit)...)
+	}
+}
+
+// how often a rateLimiter forgets about clients that
+// have been quiet long enough to be back to a full bucket
+const RATE_LIMIT_SWEEP_INTERVAL = time.Minute
+
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[*Client]*bucket
+	swept   time.Time
+}
+
+// bucket holds the requests a client has left, topped
+// up at rate since last
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow(c *Client, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) >= RATE_LIMIT_SWEEP_INTERVAL {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[c]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[c] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets that have refilled, a fresh one
+// is no different. Must hold mu
+func (l *rateLimiter) sweep(now time.Time) {
+	for c, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, c)
+		}
+	}
+	l.swept = now
+}
+
+// HandlerStats is what HandlerMetrics knows about one packet type
+type HandlerStats struct {
+	Count  int
+	Errors int
+	Total  time.Duration
+}
+
+// HandlerMetrics counts the packets handled per type, how
+// many failed and how long they took. Its Middleware does
+// the counting
+type HandlerMetrics struct {
+	mu    sync.Mutex
+	stats map[PacketType]HandlerStats
+}
+
+func NewHandlerMetrics() *HandlerMetrics {
+	return &HandlerMetrics{stats: make(map[PacketType]HandlerStats)}
+}
+
+func (m *HandlerMetrics) Middleware(next HandlerFunc) HandlerFunc {
+	return func(p *Packet, c *Client) error {
+		start := time.Now()
+		err := next(p, c)
+		elapsed := time.Since(start)
+
+		m.mu.Lock()
+		s := m.stats[p.Type()]
+		s.Count++
+		s.Total += elapsed
+		if err != nil {
+			s.Errors++
+		}
+		m.stats[p.Type()] = s
+		m.mu.Unlock()
+
+		return err
+	}
+}
+
+// Snapshot returns a copy of the stats so far
+func (m *HandlerMetrics) Snapshot() map[PacketType]HandlerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap := make(map[PacketType]HandlerStats, len(m.stats))
+	for pktType, s := range m.stats {
+		snap[pktType] = s
+	}
+	return snap
+}
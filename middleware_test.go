@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// packet types past the ones in protocol.json, for handlers
+// registered by whoever embeds the hub
+const (
+	packetEcho    = PacketType(60)
+	packetEchoRes = PacketType(61)
+)
+
+func TestHandleCustomPacket(t *testing.T) {
+	s := newScript(t)
+
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(p *Packet, c *Client) error {
+				if p.Type() == packetEcho {
+					order = append(order, name)
+				}
+				return next(p, c)
+			}
+		}
+	}
+
+	s.hub.Use(trace("outer"))
+	s.hub.Handle(packetEcho, func(p *Packet, c *Client) error {
+		order = append(order, "handler")
+		c.Reply(p, ConstructPacket(EncString, packetEchoRes, p.Data()))
+		return nil
+	}, trace("route"))
+	// added after, still wraps everything
+	s.hub.Use(trace("late"))
+
+	a := s.connect("A")
+	a.send(packetEcho, []byte("hello"))
+	if res := a.expect(packetEchoRes); string(res.Data()) != "hello" {
+		t.Fatalf("Expected the payload echoed. Got %q", res.Data())
+	}
+	a.expectQuiet()
+
+	if want := []string{"outer", "late", "route", "handler"}; !slices.Equal(order, want) {
+		t.Fatalf("Expected middleware to run %v. Got %v", want, order)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	s := newScript(t)
+	s.hub.Handle(packetEcho, func(p *Packet, c *Client) error {
+		panic("bad packet")
+	})
+
+	// the client gets an error and the connection lives on
+	a := s.connect("A")
+	a.send(packetEcho, []byte{})
+	a.expectError(ERROR_HANDLER_PANIC)
+	a.expectQuiet()
+}
+
+func TestRequireAuth(t *testing.T) {
+	hub := NewHub()
+	defer hub.Close()
+
+	client, _ := pipeClient("10000001")
+	defer client.Disconnect()
+
+	handled := 0
+	handler := hub.RequireAuth(func(p *Packet, c *Client) error {
+		handled++
+		return nil
+	})
+	pkt := ConstructPacket(EncString, PacketCreateGame, []byte{})
+
+	if err := handler(&pkt, client); err != ERROR_INVALID_SESSION {
+		t.Fatalf("Expected %v without a session. Got %v", ERROR_INVALID_SESSION, err)
+	}
+
+	client.session, _ = hub.sessions.Issue(client)
+	if err := handler(&pkt, client); err != nil || handled != 1 {
+		t.Fatalf("Expected the handler to run with a session. Got %v", err)
+	}
+
+	hub.sessions.Revoke(client.session)
+	if err := handler(&pkt, client); err != ERROR_INVALID_SESSION || handled != 1 {
+		t.Fatalf("Expected %v once revoked. Got %v", ERROR_INVALID_SESSION, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	l := &rateLimiter{rate: 1, burst: 2, buckets: make(map[*Client]*bucket)}
+	one, two := &Client{}, &Client{}
+
+	now := time.Now()
+	l.swept = now
+	steps := []struct {
+		c     *Client
+		after time.Duration
+		allow bool
+	}{
+		{one, 0, true},
+		{one, 0, true},
+		{one, 0, false},
+		// every client has a bucket of its own
+		{two, 0, true},
+		{one, time.Millisecond * 500, false},
+		{one, time.Millisecond * 500, true},
+		{one, 0, false},
+		// never more than the burst saved up
+		{one, time.Second * 10, true},
+		{one, 0, true},
+		{one, 0, false},
+	}
+	for i, s := range steps {
+		now = now.Add(s.after)
+		if got := l.allow(s.c, now); got != s.allow {
+			t.Fatalf("step %d: expected allow %t. Got %t", i, s.allow, got)
+		}
+	}
+
+	// quiet clients are forgotten
+	l.allow(one, now.Add(RATE_LIMIT_SWEEP_INTERVAL))
+	if _, ok := l.buckets[two]; ok || len(l.buckets) != 1 {
+		t.Fatalf("Expected only the active client to be left. Got %d buckets", len(l.buckets))
+	}
+
+	// and over the wire the client hears about it
+	s := newScript(t)
+	s.hub.SetRateLimit(0, 1)
+
+	a := s.connect("A")
+	a.send(PacketCreateGame, []byte{})
+	a.expect(PacketCreateGameSuccess)
+	a.send(PacketJoinGame, []byte("12345678"))
+	a.expectError(ERROR_RATE_LIMITED)
+
+	// a client over its limit can still check in and leave
+	a.expectQuiet()
+	a.send(PacketDisconnect, []byte{})
+	expectClosed(t, a.framer)
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	m := NewHandlerMetrics()
+
+	fail := errors.New("fail")
+	calls := 0
+	handler := m.Middleware(func(p *Packet, c *Client) error {
+		calls++
+		if calls%2 == 0 {
+			return fail
+		}
+		return nil
+	})
+
+	health := ConstructPacket(EncString, PacketHealthCheckReq, []byte{})
+	leave := ConstructPacket(EncString, PacketLeaveGame, []byte{})
+	for i := 0; i < 3; i++ {
+		handler(&health, nil)
+	}
+	if err := handler(&leave, nil); err != fail {
+		t.Fatalf("Expected the handler error passed on. Got %v", err)
+	}
+
+	snap := m.Snapshot()
+	if s := snap[PacketHealthCheckReq]; s.Count != 3 || s.Errors != 1 {
+		t.Fatalf("Expected 3 health checks with 1 error. Got %+v", s)
+	}
+	if s := snap[PacketLeaveGame]; s.Count != 1 || s.Errors != 1 {
+		t.Fatalf("Expected 1 failed leave. Got %+v", s)
+	}
+}
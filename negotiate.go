@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"slices"
+)
+
+// what the server can speak, best first. A hello is answered
+// with the first of each the client listed as well
+var (
+	serverVersions          = []int{int(VERSION_2), int(VERSION)}
+	serverGameStateVersions = []int{int(GSVERSION)}
+	serverEncodings         = []int{int(EncCustom), int(EncJSON), int(EncString), int(EncBytes)}
+	serverCapabilities      = []string{CAP_COMPRESSION, CAP_HEARTBEAT}
+)
+
+// what the server writes in whatever the client listed, a hello
+// has to have all of them. Game state is the one thing there is a
+// choice for, EncCustom if the client takes it and EncJSON if not
+var serverWriteEncodings = []int{int(EncJSON), int(EncString), int(EncBytes)}
+
+// negotiate picks the protocol a connection is held to out of
+// what the client said it can speak in hello
+func negotiate(hello Hello) (Negotiated, error) {
+	version, ok := pick(serverVersions, hello.Versions)
+	if !ok {
+		return Negotiated{}, ERROR_UNSUPPORTED_VERSION
+	}
+	gsVersion, ok := pick(serverGameStateVersions, hello.GameStateVersions)
+	if !ok {
+		return Negotiated{}, ERROR_UNSUPPORTED_VERSION
+	}
+
+	encodings := hello.Encodings
+	if len(encodings) == 0 {
+		encodings = serverEncodings
+	}
+
+	n := Negotiated{
+		Version:          version,
+		GameStateVersion: gsVersion,
+		Encodings:        common(serverEncodings, encodings),
+		// a capability is only ever used if asked for
+		Capabilities: common(serverCapabilities, hello.Capabilities),
+	}
+	for _, enc := range serverWriteEncodings {
+		if !slices.Contains(n.Encodings, enc) {
+			return Negotiated{}, ERROR_UNSUPPORTED_ENCODING
+		}
+	}
+	// v1 headers have no flags to mark a compressed packet with
+	if n.Version == int(VERSION) {
+		n.Capabilities = slices.DeleteFunc(n.Capabilities, func(c string) bool { return c == CAP_COMPRESSION })
+	}
+	return n, nil
+}
+
+// legacyProtocol is what a client that skipped the hello gets.
+// It speaks whichever version it answered the challenge in and
+// the game state version that was around before the hello
+func legacyProtocol(version uint8) Negotiated {
+	return Negotiated{
+		Version:          int(version),
+		GameStateVersion: int(GSVERSION),
+		Encodings:        serverEncodings,
+	}
+}
+
+// pick returns the first of ours the client also has,
+// or our best if the client didn't list any
+func pick(ours, theirs []int) (int, bool) {
+	if len(theirs) == 0 {
+		return ours[0], true
+	}
+	for _, v := range ours {
+		if slices.Contains(theirs, v) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// common is everything in ours the client also has
+func common[T comparable](ours, theirs []T) []T {
+	both := []T{}
+	for _, v := range ours {
+		if slices.Contains(theirs, v) {
+			both = append(both, v)
+		}
+	}
+	return both
+}
+
+// Protocol returns what was negotiated with the client
+func (c *Client) Protocol() Negotiated {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proto
+}
+
+// Accepts reports whether the client negotiated enc
+func (c *Client) Accepts(enc Encoding) bool {
+	return slices.Contains(c.Protocol().Encodings, int(enc))
+}
+
+// HasCapability reports whether the client asked for
+// name and the server has it
+func (c *Client) HasCapability(name string) bool {
+	return slices.Contains(c.Protocol().Capabilities, name)
+}
+
+// reencode returns pkt in an encoding the client negotiated, with a
+// reference of its own the caller has to release. nil if pkt is fine
+// as it is or there is nothing else it can go out as
+func reencode(pkt *Packet, encodings []int) *Packet {
+	if slices.Contains(encodings, int(pkt.Encoding())) {
+		return nil
+	}
+	if pkt.Type() != PacketGameState || pkt.Encoding() != EncCustom {
+		return nil
+	}
+
+	msg, err := DecodeGameState(pkt)
+	if err != nil {
+		return nil
+	}
+	// Data is JSON already, only nothing at all isn't valid
+	if len(msg.Data) == 0 {
+		msg.Data = nil
+	}
+	re, err := EncodeGameState(EncJSON, msg)
+	if err != nil {
+		log.Printf("Failed to reencode game state as JSON: %s", err)
+		return nil
+	}
+
+	out := AcquirePacket(re.len)
+	copy(out.data, re.data)
+	return out
+}
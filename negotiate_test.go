@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		name  string
+		hello Hello
+		want  Negotiated
+		err   error
+	}{
+		{
+			"takes the best",
+			Hello{},
+			Negotiated{Version: int(VERSION_2), GameStateVersion: int(GSVERSION), Encodings: serverEncodings, Capabilities: []string{}},
+			nil,
+		},
+		{
+			"old client",
+			Hello{Versions: []int{int(VERSION)}, GameStateVersions: []int{int(GSVERSION)}, Encodings: []int{int(EncBytes), int(EncString), int(EncJSON)}},
+			Negotiated{Version: int(VERSION), GameStateVersion: int(GSVERSION), Encodings: []int{int(EncJSON), int(EncString), int(EncBytes)}, Capabilities: []string{}},
+			nil,
+		},
+		{
+			"unknown capabilities are dropped",
+			Hello{Versions: []int{int(VERSION_2), 9}, Capabilities: []string{"teleport"}},
+			Negotiated{Version: int(VERSION_2), GameStateVersion: int(GSVERSION), Encodings: serverEncodings, Capabilities: []string{}},
+			nil,
+		},
+		{
+			"compression",
+			Hello{Capabilities: []string{CAP_COMPRESSION}},
+			Negotiated{Version: int(VERSION_2), GameStateVersion: int(GSVERSION), Encodings: serverEncodings, Capabilities: []string{CAP_COMPRESSION}},
+			nil,
+		},
+		{
+			"compression needs v2",
+			Hello{Versions: []int{int(VERSION)}, Capabilities: []string{CAP_COMPRESSION}},
+			Negotiated{Version: int(VERSION), GameStateVersion: int(GSVERSION), Encodings: serverEncodings, Capabilities: []string{}},
+			nil,
+		},
+		{"no common version", Hello{Versions: []int{9}}, Negotiated{}, ERROR_UNSUPPORTED_VERSION},
+		{"no common game state version", Hello{GameStateVersions: []int{9}}, Negotiated{}, ERROR_UNSUPPORTED_VERSION},
+		{"no common encoding", Hello{Encodings: []int{9}}, Negotiated{}, ERROR_UNSUPPORTED_ENCODING},
+		// the server can't answer in anything else
+		{"only JSON", Hello{Encodings: []int{int(EncJSON)}}, Negotiated{}, ERROR_UNSUPPORTED_ENCODING},
+	}
+
+	for _, c := range cases {
+		got, err := negotiate(c.hello)
+		if err != c.err {
+			t.Errorf("%s: expected error %v. Got %v", c.name, c.err, err)
+			continue
+		}
+		if got.Version != c.want.Version || got.GameStateVersion != c.want.GameStateVersion ||
+			!slices.Equal(got.Encodings, c.want.Encodings) || !slices.Equal(got.Capabilities, c.want.Capabilities) {
+			t.Errorf("%s: expected %+v. Got %+v", c.name, c.want, got)
+		}
+	}
+}
+
+// helloClient dials the server and sends hello ahead
+// of its answer to the challenge
+func helloClient(t *testing.T, addr string, hello Hello) (*Client, *PacketFramer) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(conn)
+
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, client.conn)
+
+	challenge, err := expectPacket(framer.C, PacketAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt, err := EncodeHello(EncJSON, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(pkt.data)
+	client.Write(ConstructPacket(EncString, PacketAuth, challenge.Data()).data)
+
+	return client, framer
+}
+
+func TestServerHello(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+	addr := server.ln.Addr().String()
+
+	client, framer := helloClient(t, addr, Hello{
+		Versions:          []int{int(VERSION_2), int(VERSION)},
+		GameStateVersions: []int{int(GSVERSION)},
+		Encodings:         []int{int(EncJSON), int(EncString), int(EncBytes)},
+	})
+	defer client.Disconnect()
+
+	pkt, err := expectPacket(framer.C, PacketHelloAck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, err := DecodeHelloAck(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto.Version != int(VERSION_2) || !slices.Equal(proto.Encodings, []int{int(EncJSON), int(EncString), int(EncBytes)}) {
+		t.Fatalf("Unexpected protocol %+v", proto)
+	}
+
+	// everything after the ack is in the picked version,
+	// even though the answer to the challenge was v1
+	pkt, err = expectPacket(framer.C, PacketSessionToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Version() != VERSION_2 {
+		t.Fatalf("Expected v2 session token. Got v%d", pkt.Version())
+	}
+
+	client.Write(ConstructPacket(EncCustom, PacketCreateGame, []byte{}).data)
+	if err := expectError(framer.C, ERROR_UNSUPPORTED_ENCODING); err != nil {
+		t.Fatal(err)
+	}
+	client.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	if _, err := expectPacket(framer.C, PacketCreateGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing in common and the connection goes
+	old, oldFramer := helloClient(t, addr, Hello{Versions: []int{9}})
+	defer old.Disconnect()
+
+	if err := expectError(oldFramer.C, ERROR_UNSUPPORTED_VERSION); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, oldFramer)
+}
+
+func TestGameStateEncoding(t *testing.T) {
+	client, framer := pipeClient("10000001")
+	defer client.Disconnect()
+
+	data := []byte(`{"turn":1}`)
+	state := ConstructGameStatePacket(ATTACK, client.clientID, data)
+
+	// the custom layout for those that take it
+	client.Write(state.data)
+	pkt, err := expectPacket(framer.C, PacketGameState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Encoding() != EncCustom {
+		t.Fatalf("Expected EncCustom game state. Got %s", EncToString(pkt.Encoding()))
+	}
+
+	// and JSON for those that don't
+	client.mu.Lock()
+	client.proto.Encodings = serverWriteEncodings
+	client.mu.Unlock()
+
+	client.Write(state.data)
+	pkt, err = expectPacket(framer.C, PacketGameState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Encoding() != EncJSON {
+		t.Fatalf("Expected EncJSON game state. Got %s", EncToString(pkt.Encoding()))
+	}
+	msg, err := DecodeGameState(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.State != ATTACK || msg.ClientID != client.clientID || string(msg.Data) != string(data) {
+		t.Fatalf("Game state doesn't match. Got %+v", msg)
+	}
+}
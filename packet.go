@@ -3,181 +3,480 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Available encoding
-type Encoding uint8
+// size of the ring the framer reads into. Has to be a power
+// of two and hold a few packets so a read never has to wait
+// on the packets in front of it being pulled
+const FRAMER_RING_SIZE = 4 * PACKET_MAX_SIZE
 
-const (
-	EncCustom Encoding = iota
-	EncJSON
-	EncString
-	EncBytes
-)
+type PacketFramer struct {
+	// bytes read off the stream that haven't been framed
+	// yet, buffered of them starting at start
+	ring     []byte
+	start    int
+	buffered int
+	seq      uint16
+	C        chan *Packet
+	errch    chan error
+	// if set and the reader supports deadlines, a read that
+	// takes longer than this fails with os.ErrDeadlineExceeded
+	readTimeout atomic.Int64
+	// fragmented messages still waiting on fragments, by message ID
+	partial map[uint16]*reassembly
+	policy  FramerPolicy
+	// closed by Stop once nobody is reading C anymore
+	done     chan struct{}
+	stopOnce sync.Once
+}
 
-// Available packet types
-type PacketType uint8
+// FramerPolicy decides what a framer does when the
+// stream stops making sense
+type FramerPolicy uint8
 
 const (
-	PacketAuth PacketType = iota // outbound
-	PacketHealthCheckReq
-	PacketHealthCheckRes // outbound
-	PacketError          // outbound
-	PacketCreateGame
-	PacketCreateGameSuccess // outbound
-	PacketJoinGame
-	PacketJoinGameSuccess // outbound
-	PacketStartGame
-	PacketLeaveGame
-	PacketLeaveGameSuccess
-	PacketGameState
-	PacketDisconnect
+	// report the problem and skip ahead to the next
+	// byte that looks like the start of a header
+	PolicyResync FramerPolicy = iota
+	// report the problem and give up on the stream
+	PolicyDisconnect
 )
 
-type PacketFramer struct {
-	buf   []byte
-	idx   int
-	C     chan *Packet
-	errch chan error
+// FrameError is what the framer sends on errch when something
+// is wrong with the stream itself, as opposed to the connection.
+// Unless it is Fatal the framer has recovered and kept going
+type FrameError struct {
+	Err   error
+	Fatal bool
+}
+
+func (e *FrameError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
 }
 
 func NewPacketFramer() *PacketFramer {
 	return &PacketFramer{
-		buf:   make([]byte, PACKET_MAX_SIZE, PACKET_MAX_SIZE),
+		ring:  make([]byte, FRAMER_RING_SIZE),
 		C:     make(chan *Packet, 10),
 		errch: make(chan error, 1), // I have a feeling this will bite me in the butt... update it did!! :'D
+
+		partial: make(map[uint16]*reassembly),
+		done:    make(chan struct{}),
 	}
 }
 
+// Stop tells the framer nobody is reading C anymore. Whoever
+// reads C has to call it once they are done, FrameWithReader
+// returns on its next read instead of blocking on a full C and
+// the packets still on C go back to the pool
+func (p *PacketFramer) Stop() {
+	p.stopOnce.Do(func() { close(p.done) })
+
+	for {
+		select {
+		case pkt := <-p.C:
+			pkt.Release()
+		default:
+			return
+		}
+	}
+}
+
+// stopped reports whether Stop has been called
+func (p *PacketFramer) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetPolicy sets what happens on a bad stream, PolicyResync by
+// default. Must be called before the framer is handed to FrameWithReader
+func (p *PacketFramer) SetPolicy(policy FramerPolicy) {
+	p.policy = policy
+}
+
+// SetReadTimeout sets the read timeout used by FrameWithReader.
+// Can be called while it is running, the timeout applies from
+// the next read on
+func (p *PacketFramer) SetReadTimeout(d time.Duration) {
+	p.readTimeout.Store(int64(d))
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
 func FrameWithReader(framer *PacketFramer, reader io.Reader, v ...interface{}) error {
-	data := make([]byte, 100, 100)
+	deadliner, _ := reader.(readDeadliner)
+
 	for {
-		n, err := reader.Read(data)
+		if timeout := time.Duration(framer.readTimeout.Load()); timeout > 0 && deadliner != nil {
+			deadliner.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		// read straight into the ring, there is always room
+		// for at least one full packet after a pull
+		n, err := reader.Read(framer.free())
+
+		// recovered errors have been reported already
+		perr := framer.advance(n)
+		if framer.stopped() {
+			return nil
+		}
+		if perr != nil && framer.policy == PolicyDisconnect {
+			ferr := &FrameError{Err: perr, Fatal: true}
+			framer.fail(ferr)
+			return ferr
+		}
+
 		if err != nil {
 			if err == io.EOF {
 				log.Printf("Client with conn %s disconnected", v...)
+				// a packet was cut off half way through
+				if framer.buffered > 0 {
+					err = &FrameError{Err: ERROR_PACKET_TRUNCATED, Fatal: true}
+				}
+				// still let the connection know so it can clean up
+				framer.fail(err)
 				return nil
 			}
 			log.Printf("Error reading from connection %v", err)
-			framer.errch <- err
+			framer.fail(err)
 			return err
 		}
-
-		framer.push(data[:n])
 	}
 }
 
+// push adds data to the stream, see advance
 func (p *PacketFramer) push(data []byte) error {
-	n := copy(p.buf[p.idx:], data)
+	var first error
+	for len(data) > 0 {
+		n := copy(p.free(), data)
+		data = data[n:]
 
-	if n < len(data) {
-		p.buf = append(p.buf, data[n:]...)
+		if err := p.advance(n); err != nil {
+			if p.policy == PolicyDisconnect {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
 	}
+	return first
+}
 
-	p.idx += n
+// advance adds the next n bytes of the ring to the stream and
+// sends out every packet they complete. With PolicyResync it
+// keeps going past bad packets, reporting each problem on errch
+// as it goes so the reports line up with the packets around them,
+// and returns the first one. With PolicyDisconnect it stops at
+// the first problem and returns it
+func (p *PacketFramer) advance(n int) error {
+	p.buffered += n
 
+	var first error
 	for {
 		packet, err := p.pull()
-		if err != nil || packet == nil {
-			// this line will cause the server to lock up no joke. unbuffered channels baby smh
-			// def a skill issue on my part ngl
-			// p.errch <- err
-			return err
+		if err == nil && packet != nil && packet.Version() == VERSION_FRAGMENT {
+			// the fragment is used up either way so there
+			// is nothing to resync past on a bad one
+			frag := packet
+			packet, err = p.reassemble(frag)
+			frag.Release()
+			if err == nil && packet == nil {
+				continue
+			}
+		}
+		if err == nil && packet != nil && packet.Flags()&FLAG_COMPRESSED != 0 {
+			packet, err = inflate(packet)
+		}
+
+		if err != nil {
+			log.Printf("Framer error: %s", err)
+			if first == nil {
+				first = err
+			}
+			if p.policy == PolicyDisconnect {
+				return err
+			}
+			p.report(&FrameError{Err: err})
+			if errors.Is(err, ERROR_VERSION_MISMATCH) || errors.Is(err, ERROR_PACKET_LENGTH_MISMATCH) {
+				p.resync()
+			}
+			continue
+		}
+
+		if packet == nil {
+			return first
+		}
+
+		select {
+		case p.C <- packet:
+		case <-p.done:
+			packet.Release()
+			return first
 		}
+	}
+}
+
+// free returns the longest run of the ring that can
+// be written to in one go
+func (p *PacketFramer) free() []byte {
+	if p.buffered == len(p.ring) {
+		return nil
+	}
+
+	end := (p.start + p.buffered) & (len(p.ring) - 1)
+	if end < p.start {
+		return p.ring[end:p.start]
+	}
+	return p.ring[end:]
+}
 
-		p.C <- packet
+// peek copies buffered bytes starting off bytes in
+// into dst without consuming them
+func (p *PacketFramer) peek(dst []byte, off int) int {
+	n := min(len(dst), p.buffered-off)
+	if n <= 0 {
+		return 0
+	}
+
+	from := (p.start + off) & (len(p.ring) - 1)
+	copied := copy(dst[:n], p.ring[from:])
+	copy(dst[copied:n], p.ring)
+	return n
+}
+
+// discard consumes n buffered bytes
+func (p *PacketFramer) discard(n int) {
+	p.start = (p.start + n) & (len(p.ring) - 1)
+	p.buffered -= n
+	// start over at the front so the next read gets the whole ring
+	if p.buffered == 0 {
+		p.start = 0
 	}
 }
 
+// report hands a recovered error to whoever is reading errch.
+// It never blocks, if the last report hasn't been picked up
+// yet this one is only logged
+func (p *PacketFramer) report(err *FrameError) {
+	select {
+	case p.errch <- err:
+	default:
+	}
+}
+
+// fail hands the error the framer gave up on to whoever is
+// reading errch. It never blocks either, whoever was reading
+// may be long gone, say a connection handler that returned on
+// shutdown. If errch is full of reports nobody picked up the
+// oldest makes way, nothing else sends on errch so there is
+// room once it has
+func (p *PacketFramer) fail(err error) {
+	select {
+	case p.errch <- err:
+		return
+	default:
+	}
+	select {
+	case <-p.errch:
+	default:
+	}
+	p.errch <- err
+}
+
+// resync throws away the bad header at the front of the buffer
+// and everything after it up to the next byte that could be the
+// start of a valid one
+func (p *PacketFramer) resync() {
+	var header [PACKET_HEADER_SIZE]byte
+
+	skip := 1
+	for skip < p.buffered && !plausibleHeader(header[:p.peek(header[:], skip)]) {
+		skip++
+	}
+
+	log.Printf("Framer skipped %d bytes to resync", skip)
+	p.discard(skip)
+}
+
+// plausibleHeader checks as much of the header as
+// has arrived so far
+func plausibleHeader(buf []byte) bool {
+	if !SupportedVersion(buf[0]) {
+		return false
+	}
+	if len(buf) < PACKET_HEADER_SIZE {
+		return true
+	}
+	return int(getPacketLength(buf))+headerSize(buf[0]) <= PACKET_MAX_SIZE
+}
+
 func (p *PacketFramer) pull() (*Packet, error) {
-	if p.idx < PACKET_HEADER_SIZE {
+	var header [PACKET_HEADER_SIZE]byte
+	if p.peek(header[:], 0) < PACKET_HEADER_SIZE {
 		return nil, nil
 	}
 
-	if p.buf[0] != VERSION {
+	// v1, v2 and fragments can be mixed on the same stream,
+	// every packet is framed by its own version byte
+	version := header[0]
+	if !SupportedVersion(version) {
 		return nil, ERROR_VERSION_MISMATCH
 	}
 
-	pktLen := getPacketLength(p.buf)
-	fullLen := pktLen + PACKET_HEADER_SIZE
-	if fullLen >= PACKET_MAX_SIZE {
+	fullLen := int(getPacketLength(header[:])) + headerSize(version)
+	if fullLen > PACKET_MAX_SIZE {
 		return nil, ERROR_PACKET_LENGTH_MISMATCH
 	}
 
-	if fullLen <= uint16(p.idx) {
-		out := make([]byte, fullLen, fullLen)
-		copy(out, p.buf[:fullLen])
-		copy(p.buf, p.buf[fullLen:])
-		p.idx -= int(fullLen)
-
-		pkt := NewPacket(out)
-		return &pkt, nil
-	}
-
-	return nil, nil
-}
-
-func TypeToString(t PacketType) string {
-	switch t {
-	case PacketAuth:
-		return "PacketAuth"
-	case PacketHealthCheckReq:
-		return "PacketHealthCheckReq"
-	case PacketHealthCheckRes:
-		return "PacketHealthCheckRes"
-	case PacketError:
-		return "PacketError"
-	case PacketCreateGame:
-		return "PacketCreateGame"
-	case PacketCreateGameSuccess:
-		return "PacketCreateGameSuccess"
-	case PacketJoinGame:
-		return "PacketJoinGame"
-	case PacketJoinGameSuccess:
-		return "PacketJoinGameSuccess"
-	case PacketStartGame:
-		return "PacketStartGame"
-	case PacketGameState:
-		return "PacketGameState"
-	case PacketDisconnect:
-		return "PacketDisconnect"
-	}
-	return ""
-}
-
-func EncToString(e Encoding) string {
-	switch e {
-	case EncCustom:
-		return "EncCustom"
-	case EncJSON:
-		return "EncJSON"
-	case EncString:
-		return "EncString"
-	case EncBytes:
-		return "EncBytes"
-	}
-	return ""
+	if fullLen > p.buffered {
+		return nil, nil
+	}
+
+	pkt := AcquirePacket(fullLen)
+	p.peek(pkt.data, 0)
+	p.discard(fullLen)
+
+	p.seq++
+	pkt.seq = p.seq
+	return pkt, nil
+}
+
+func SupportedVersion(version uint8) bool {
+	return version == VERSION || version == VERSION_2 || version == VERSION_FRAGMENT
+}
+
+func headerSize(version uint8) int {
+	switch version {
+	case VERSION_2:
+		return PACKET_HEADER_SIZE_V2
+	case VERSION_FRAGMENT:
+		return PACKET_HEADER_SIZE_FRAGMENT
+	}
+	return PACKET_HEADER_SIZE
 }
 
 func ConstructPacket(enc Encoding, pktType PacketType, data []byte) Packet {
-	header := []byte{VERSION, bitPack(enc, pktType), 0, 0}
-	binary.BigEndian.PutUint16(header[HEADER_LENGTH_OFFSET:], uint16(len(data)))
+	buf := make([]byte, PACKET_HEADER_SIZE+len(data))
+	putHeader(buf, VERSION, bitPack(enc, pktType), len(data), 0, 0)
+	copy(buf[PACKET_HEADER_SIZE:], data)
 
-	buf := append(header, data...)
+	return NewPacket(buf)
+}
+
+// ConstructPacketV2 is ConstructPacket with a v2 header. seq
+// should be the sequence number of the request being answered
+// or 0 for packets the server sends on its own
+func ConstructPacketV2(enc Encoding, pktType PacketType, seq uint16, data []byte) Packet {
+	buf := make([]byte, PACKET_HEADER_SIZE_V2+len(data))
+	putHeader(buf, VERSION_2, bitPack(enc, pktType), len(data), seq, 0)
+	copy(buf[PACKET_HEADER_SIZE_V2:], data)
 
 	return NewPacket(buf)
 }
 
+// ConstructCompressedPacket is ConstructPacketV2 for a peer that
+// negotiated compression. data over COMPRESSION_THRESHOLD is sent
+// deflated with FLAG_COMPRESSED set, as long as that's smaller
+func ConstructCompressedPacket(enc Encoding, pktType PacketType, seq uint16, data []byte) Packet {
+	compressed, ok := Compress(data)
+	if !ok {
+		return ConstructPacketV2(enc, pktType, seq, data)
+	}
+
+	pkt := ConstructPacketV2(enc, pktType, seq, compressed)
+	pkt.data[HEADER_FLAGS_OFFSET] = FLAG_COMPRESSED
+	return pkt
+}
+
+// putHeader writes a v1 or v2 header to the front of buf
+func putHeader(buf []byte, version uint8, encType uint8, length int, seq uint16, flags uint8) {
+	buf[0] = version
+	buf[ENC_TYPE_OFFSET] = encType
+	binary.BigEndian.PutUint16(buf[HEADER_LENGTH_OFFSET:], uint16(length))
+	if version == VERSION {
+		return
+	}
+	binary.BigEndian.PutUint16(buf[HEADER_SEQ_OFFSET:], seq)
+	buf[HEADER_FLAGS_OFFSET] = flags
+	buf[HEADER_FLAGS_OFFSET+1] = 0
+}
+
+// Reframe rewrites the header of a packet for version, stamping
+// seq into v2 headers. A v1 packet headed for a v1 client is
+// returned as is
+func Reframe(data []byte, version uint8, seq uint16) []byte {
+	if data[0] == version && version == VERSION {
+		return data
+	}
+
+	pkt := NewPacket(data)
+	out := make([]byte, headerSize(version)+len(pkt.Data()))
+	reframe(out, &pkt, version, seq)
+	return out
+}
+
+// reframePooled is Reframe into a packet from the pool
+func reframePooled(pkt *Packet, version uint8, seq uint16) *Packet {
+	out := AcquirePacket(headerSize(version) + len(pkt.Data()))
+	reframe(out.data, pkt, version, seq)
+	return out
+}
+
+func reframe(dst []byte, pkt *Packet, version uint8, seq uint16) {
+	putHeader(dst, version, pkt.data[ENC_TYPE_OFFSET], len(pkt.Data()), seq, pkt.Flags())
+	copy(dst[headerSize(version):], pkt.Data())
+}
+
 func ConstructErrorData(err error) ([]byte, error) {
-	data, er := json.Marshal(NewError(err))
+	return marshalError(NewError(err))
+}
+
+func marshalError(e Error) ([]byte, error) {
+	data, er := json.Marshal(e)
 	if er != nil {
 		return []byte{}, er
 	}
 	return data, nil
 }
 
+// ConstructErrorPacket wraps err in a PacketError. A marshal
+// failure falls back to the plain error message
+func ConstructErrorPacket(err error) Packet {
+	return constructErrorPacket(NewError(err))
+}
+
+// ConstructReplyErrorPacket is ConstructErrorPacket for an
+// error caused by req, the reply points back at it
+func ConstructReplyErrorPacket(err error, req *Packet) Packet {
+	return constructErrorPacket(NewRequestError(err, req))
+}
+
+func constructErrorPacket(e Error) Packet {
+	data, er := marshalError(e)
+	if er != nil {
+		log.Printf("Failed to marshal error %s: %s", e.Message, er)
+		data = []byte(e.Message)
+	}
+	return ConstructPacket(EncString, PacketError, data)
+}
+
 func getPacketLength(data []byte) uint16 {
 	return binary.BigEndian.Uint16(data[HEADER_LENGTH_OFFSET:])
 }
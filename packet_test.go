@@ -2,7 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestFramer(t *testing.T) {
@@ -32,3 +38,275 @@ func TestPacketFunctions(t *testing.T) {
 		}
 	}
 }
+
+func TestFramerMixedVersions(t *testing.T) {
+	framer := NewPacketFramer()
+
+	v1 := ConstructPacket(EncString, PacketJoinGame, []byte("123456"))
+	v2 := ConstructPacketV2(EncString, PacketJoinGame, 42, []byte("654321"))
+
+	// both back to back in one push
+	framer.push(append(append([]byte{}, v1.data...), v2.data...))
+
+	res := <-framer.C
+	if res.Version() != VERSION || res.Seq() != 1 || string(res.Data()) != "123456" {
+		t.Errorf("Expected v1 packet 1 with data 123456. Got v%d packet %d with data %s", res.Version(), res.Seq(), res.Data())
+	}
+
+	res = <-framer.C
+	if res.Version() != VERSION_2 || res.Seq() != 42 || string(res.Data()) != "654321" {
+		t.Errorf("Expected v2 packet 42 with data 654321. Got v%d packet %d with data %s", res.Version(), res.Seq(), res.Data())
+	}
+	if res.Type() != PacketJoinGame || res.Encoding() != EncString {
+		t.Errorf("Expected %s %s. Got %s %s", EncToString(EncString), TypeToString(PacketJoinGame), EncToString(res.Encoding()), TypeToString(res.Type()))
+	}
+
+	if err := framer.push([]byte{9, 0, 0, 0}); err != ERROR_VERSION_MISMATCH {
+		t.Errorf("Expected %v. Got %v", ERROR_VERSION_MISMATCH, err)
+	}
+}
+
+func TestReframe(t *testing.T) {
+	v1 := ConstructPacket(EncJSON, PacketCreateGameSuccess, []byte("123456"))
+
+	if out := Reframe(v1.data, VERSION, 7); !bytes.Equal(out, v1.data) {
+		t.Errorf("Expected v1 packet to be left alone. Got %v", out)
+	}
+
+	v2 := NewPacket(Reframe(v1.data, VERSION_2, 7))
+	if !bytes.Equal(v2.data, ConstructPacketV2(EncJSON, PacketCreateGameSuccess, 7, []byte("123456")).data) {
+		t.Errorf("Unexpected v2 packet %v", v2.data)
+	}
+
+	back := Reframe(v2.data, VERSION, 0)
+	if !bytes.Equal(back, v1.data) {
+		t.Errorf("Expected %v. Got %v", v1.data, back)
+	}
+}
+
+// frameStream runs data through FrameWithReader and returns
+// every packet and error it produced
+func frameStream(policy FramerPolicy, data []byte) ([]*Packet, []error) {
+	framer := NewPacketFramer()
+	framer.SetPolicy(policy)
+
+	// generous so FrameWithReader never blocks on us
+	framer.C = make(chan *Packet, 100)
+	framer.errch = make(chan error, 100)
+
+	FrameWithReader(framer, bytes.NewReader(data), "test")
+	close(framer.C)
+	close(framer.errch)
+
+	var pkts []*Packet
+	for pkt := range framer.C {
+		pkts = append(pkts, pkt)
+	}
+	var errs []error
+	for err := range framer.errch {
+		errs = append(errs, err)
+	}
+	return pkts, errs
+}
+
+func TestFramerRecovery(t *testing.T) {
+	health := ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data
+	oversize := []byte{VERSION, bitPack(EncString, PacketJoinGame), 0xFF, 0xFF}
+
+	cases := []struct {
+		name   string
+		stream [][]byte
+		// packets and errors expected with PolicyResync
+		pkts int
+		errs []error
+	}{
+		{"garbage", [][]byte{[]byte("GET / HTTP/1.1\r\n"), health}, 1, []error{ERROR_VERSION_MISMATCH, io.EOF}},
+		{"garbage between packets", [][]byte{health, {0xDE, 0xAD, 0xBE, 0xEF}, health}, 2, []error{ERROR_VERSION_MISMATCH, io.EOF}},
+		{"oversize", [][]byte{oversize, health}, 1, []error{ERROR_PACKET_LENGTH_MISMATCH, io.EOF}},
+		{"truncated", [][]byte{health, health[:2]}, 1, []error{ERROR_PACKET_TRUNCATED}},
+	}
+
+	for _, c := range cases {
+		stream := bytes.Join(c.stream, nil)
+
+		pkts, errs := frameStream(PolicyResync, stream)
+		if len(pkts) != c.pkts {
+			t.Errorf("%s: expected %d packets. Got %d", c.name, c.pkts, len(pkts))
+		}
+		for _, pkt := range pkts {
+			if pkt.Type() != PacketHealthCheckReq {
+				t.Errorf("%s: expected %s. Got %s", c.name, TypeToString(PacketHealthCheckReq), TypeToString(pkt.Type()))
+			}
+		}
+		if len(errs) != len(c.errs) {
+			t.Errorf("%s: expected errors %v. Got %v", c.name, c.errs, errs)
+			continue
+		}
+		for i, err := range errs {
+			if !errors.Is(err, c.errs[i]) {
+				t.Errorf("%s: expected error %v. Got %v", c.name, c.errs[i], err)
+			}
+		}
+
+		// the first problem ends the stream under PolicyDisconnect
+		_, errs = frameStream(PolicyDisconnect, stream)
+		var ferr *FrameError
+		if len(errs) != 1 || !errors.As(errs[0], &ferr) || !ferr.Fatal || !errors.Is(ferr, c.errs[0]) {
+			t.Errorf("%s: expected a single fatal %v. Got %v", c.name, c.errs[0], errs)
+		}
+	}
+}
+
+func TestFramerNobodyListening(t *testing.T) {
+	framer := NewPacketFramer()
+
+	// a report nobody picks up is left sitting in errch
+	done := make(chan error, 1)
+	go func() {
+		done <- FrameWithReader(framer, bytes.NewReader([]byte("garbage")))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Framer blocked on errch with nobody reading it")
+	}
+	// and makes way for the error the stream ended on
+	if err := <-framer.errch; err != io.EOF {
+		t.Fatalf("Expected %v. Got %v", io.EOF, err)
+	}
+}
+
+func TestFramerStop(t *testing.T) {
+	framer := NewPacketFramer()
+
+	// more packets than fit C, nobody reads any of them
+	health := ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data
+	stream := bytes.Repeat(health, cap(framer.C)*4)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- FrameWithReader(framer, bytes.NewReader(stream))
+	}()
+
+	// wait for the framer to fill C up and block on it
+	for len(framer.C) < cap(framer.C) {
+		time.Sleep(time.Millisecond)
+	}
+	framer.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Framer blocked on C after Stop")
+	}
+}
+
+func TestFramerWrapAround(t *testing.T) {
+	framer := NewPacketFramer()
+
+	// odd sized packets pushed a few bytes at a time end up
+	// straddling the end of the ring over and over
+	data := bytes.Repeat([]byte{0xAB}, 333)
+	pkt := ConstructPacket(EncBytes, PacketGameState, data)
+	stream := bytes.Repeat(pkt.data, 3*FRAMER_RING_SIZE/len(pkt.data))
+
+	go func() {
+		for len(stream) > 0 {
+			n := min(len(stream), 7)
+			framer.push(stream[:n])
+			stream = stream[n:]
+		}
+		close(framer.C)
+	}()
+
+	count := 0
+	for res := range framer.C {
+		count++
+		if !bytes.Equal(res.data, pkt.data) {
+			t.Fatalf("Data mismatch on packet %d", count)
+		}
+		res.Release()
+	}
+	if want := 3 * FRAMER_RING_SIZE / len(pkt.data); count != want {
+		t.Errorf("Expected %d packets. Got %d", want, count)
+	}
+}
+
+func BenchmarkFramer(b *testing.B) {
+	for _, size := range []int{64, 512, MAX_DATA_SIZE} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			framer := NewPacketFramer()
+			pkt := ConstructPacket(EncBytes, PacketGameState, make([]byte, size))
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(pkt.data)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				framer.push(pkt.data)
+				(<-framer.C).Release()
+			}
+		})
+	}
+}
+
+// discardConn throws away writes without the timers
+// net.Pipe sets up for every write deadline
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+func (discardConn) Close() error                       { return nil }
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, players := range []int{2, 8, 32} {
+		b.Run(fmt.Sprintf("%dclients", players), func(b *testing.B) {
+			clients := make([]*Client, players)
+			for i := range clients {
+				clients[i] = NewClient(discardConn{})
+				clients[i].clientID = ClientID(fmt.Sprintf("%08d", i))
+			}
+			game := NewGame(clients[0], validateGamePkt)
+			game.clients = clients
+			defer func() {
+				for _, c := range clients {
+					c.Disconnect()
+				}
+			}()
+
+			pkt := ConstructGameStatePacket(RESULT, "", make([]byte, 256))
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(pkt.data) * players))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				game.broadCast(pkt)
+				// let the writers catch up before the queues fill
+				if i%(CLIENT_QUEUE_SIZE/2) == 0 {
+					for _, c := range clients {
+						for len(c.outq) > 0 {
+							runtime.Gosched()
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// every packet type has a name, the stringer used to be kept
+// in sync by hand and missed PacketLeaveGame
+func TestTypeToString(t *testing.T) {
+	for pt := PacketAuth; pt < packetTypeCount; pt++ {
+		if TypeToString(pt) == "" {
+			t.Errorf("PacketType %d has no name", pt)
+		}
+	}
+	if TypeToString(PacketLeaveGameSuccess) != "PacketLeaveGameSuccess" {
+		t.Errorf("Expected PacketLeaveGameSuccess. Got %s", TypeToString(PacketLeaveGameSuccess))
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Packets read off the wire and packets queued up for writing
+// come out of packetPool so a busy connection isn't allocating
+// a new buffer for every packet. Whoever acquires a packet owns
+// one reference to it, anyone else holding on to it has to
+// Retain it first, and the last Release puts it back
+var packetPool = sync.Pool{
+	New: func() any {
+		return &Packet{data: make([]byte, 0, PACKET_MAX_SIZE)}
+	},
+}
+
+// AcquirePacket returns a packet with room for n bytes of
+// header and data. Anything bigger than PACKET_MAX_SIZE, like
+// a reassembled message, is allocated and never pooled
+func AcquirePacket(n int) *Packet {
+	if n > PACKET_MAX_SIZE {
+		pkt := NewPacket(make([]byte, n))
+		return &pkt
+	}
+
+	pkt := packetPool.Get().(*Packet)
+	pkt.data = pkt.data[:n]
+	pkt.len = n
+	pkt.seq = 0
+	pkt.refs = 1
+	pkt.pooled = true
+	return pkt
+}
+
+// Retain adds a reference to p, it stays valid until
+// Release has been called once more
+func (p *Packet) Retain() {
+	if p.pooled {
+		atomic.AddInt32(&p.refs, 1)
+	}
+}
+
+// Release drops a reference to p and hands it back to the pool
+// once nobody is left holding it. p must not be touched after
+// releasing it. Packets that didn't come from the pool are left
+// to the garbage collector
+func (p *Packet) Release() {
+	if !p.pooled {
+		return
+	}
+
+	if atomic.AddInt32(&p.refs, -1) == 0 {
+		packetPool.Put(p)
+	}
+}
@@ -0,0 +1,596 @@
+// Code generated by protogen from protocol.json. DO NOT EDIT.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+const (
+	VERSION              = uint8(1)
+	PACKET_MAX_SIZE      = 1024
+	PACKET_HEADER_SIZE   = 4
+	HEADER_LENGTH_OFFSET = 2
+	ENC_TYPE_OFFSET      = uint8(1)
+	MAX_DATA_SIZE        = PACKET_MAX_SIZE - PACKET_HEADER_SIZE
+	// version of the game state sub header
+	GSVERSION = uint8(1)
+)
+
+// offsets into the GameStateMessage layout
+const (
+	GS_VERSION_OFFSET   = uint8(0)
+	GS_TYPE_OFFSET      = uint8(1)
+	GS_CLIENT_ID_OFFSET = uint8(2)
+	GS_DATA_OFFSET      = uint8(10)
+)
+
+type (
+	ClientID string
+	GameID   string
+)
+
+// Available encoding
+type Encoding uint8
+
+const (
+	EncCustom Encoding = iota
+	EncJSON
+	EncString
+	EncBytes
+)
+
+func EncToString(v Encoding) string {
+	switch v {
+	case EncCustom:
+		return "EncCustom"
+	case EncJSON:
+		return "EncJSON"
+	case EncString:
+		return "EncString"
+	case EncBytes:
+		return "EncBytes"
+	}
+	return ""
+}
+
+// Available packet types
+type PacketType uint8
+
+const (
+	PacketAuth PacketType = iota // outbound
+	PacketHealthCheckReq
+	PacketHealthCheckRes // outbound
+	PacketError          // outbound
+	PacketCreateGame
+	PacketCreateGameSuccess // outbound
+	PacketJoinGame
+	PacketJoinGameSuccess // outbound
+	PacketStartGame
+	PacketLeaveGame
+	PacketLeaveGameSuccess
+	PacketGameState
+	PacketDisconnect
+	PacketStartGameSuccess // outbound
+	PacketSessionToken     // outbound
+	PacketResume
+	PacketResumeSuccess  // outbound
+	PacketServerShutdown // outbound
+	PacketHeartbeat      // outbound
+	PacketHeartbeatAck
+	PacketHello
+	PacketHelloAck    // outbound
+	PacketBind        // udp only
+	PacketBindSuccess // outbound, udp only
+	PacketAck         // udp only, the seq in the header is the one acknowledged
+	PacketBindToken
+	PacketBindTokenSuccess // outbound, the token PacketBind takes
+	packetTypeCount
+)
+
+func TypeToString(v PacketType) string {
+	switch v {
+	case PacketAuth:
+		return "PacketAuth"
+	case PacketHealthCheckReq:
+		return "PacketHealthCheckReq"
+	case PacketHealthCheckRes:
+		return "PacketHealthCheckRes"
+	case PacketError:
+		return "PacketError"
+	case PacketCreateGame:
+		return "PacketCreateGame"
+	case PacketCreateGameSuccess:
+		return "PacketCreateGameSuccess"
+	case PacketJoinGame:
+		return "PacketJoinGame"
+	case PacketJoinGameSuccess:
+		return "PacketJoinGameSuccess"
+	case PacketStartGame:
+		return "PacketStartGame"
+	case PacketLeaveGame:
+		return "PacketLeaveGame"
+	case PacketLeaveGameSuccess:
+		return "PacketLeaveGameSuccess"
+	case PacketGameState:
+		return "PacketGameState"
+	case PacketDisconnect:
+		return "PacketDisconnect"
+	case PacketStartGameSuccess:
+		return "PacketStartGameSuccess"
+	case PacketSessionToken:
+		return "PacketSessionToken"
+	case PacketResume:
+		return "PacketResume"
+	case PacketResumeSuccess:
+		return "PacketResumeSuccess"
+	case PacketServerShutdown:
+		return "PacketServerShutdown"
+	case PacketHeartbeat:
+		return "PacketHeartbeat"
+	case PacketHeartbeatAck:
+		return "PacketHeartbeatAck"
+	case PacketHello:
+		return "PacketHello"
+	case PacketHelloAck:
+		return "PacketHelloAck"
+	case PacketBind:
+		return "PacketBind"
+	case PacketBindSuccess:
+		return "PacketBindSuccess"
+	case PacketAck:
+		return "PacketAck"
+	case PacketBindToken:
+		return "PacketBindToken"
+	case PacketBindTokenSuccess:
+		return "PacketBindTokenSuccess"
+	}
+	return ""
+}
+
+type GameState uint8
+
+const (
+	ATTACK GameState = iota
+	DEFENSE
+	RESULT   // outbound
+	WAITING  // game has not started yet
+	FINISHED // game is over, no more game state is accepted
+)
+
+func GameStateToString(v GameState) string {
+	switch v {
+	case ATTACK:
+		return "Attack"
+	case DEFENSE:
+		return "Defense"
+	case RESULT:
+		return "Result"
+	case WAITING:
+		return "Waiting"
+	case FINISHED:
+		return "Finished"
+	}
+	return "Invalid"
+}
+
+type TeamID uint8
+
+const (
+	TeamNone TeamID = iota
+	TeamOne
+	TeamTwo
+)
+
+type CharacterID uint8
+
+const (
+	UnitOne CharacterID = iota + 1
+	UnitTwo
+	UnitThree
+)
+
+type Target uint8
+
+const (
+	EnemyTeam Target = iota
+	OwnTeam
+)
+
+// GameRef names a game. As a string, bytes or custom
+// payload it is just the game ID
+type GameRef struct {
+	GameID GameID `json:"gameId"`
+}
+
+func (m GameRef) MarshalCustom() ([]byte, error) {
+	buf := make([]byte, 0, 0+len(m.GameID))
+	buf = append(buf, m.GameID...)
+	return buf, nil
+}
+
+func (m *GameRef) UnmarshalCustom(data []byte) error {
+	m.GameID = GameID(data[0:])
+	return nil
+}
+
+func (m GameRef) MarshalBinary() ([]byte, error) {
+	return m.MarshalCustom()
+}
+
+func (m *GameRef) UnmarshalBinary(data []byte) error {
+	return m.UnmarshalCustom(data)
+}
+
+func (m GameRef) MarshalText() ([]byte, error) {
+	return m.MarshalCustom()
+}
+
+func (m *GameRef) UnmarshalText(data []byte) error {
+	return m.UnmarshalCustom(data)
+}
+
+// Heartbeat carries the nonce a heartbeat is acknowledged
+// with. As bytes or a custom payload it is the nonce as 8
+// big endian bytes
+type Heartbeat struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+func (m Heartbeat) MarshalCustom() ([]byte, error) {
+	buf := make([]byte, 8, 8)
+	binary.BigEndian.PutUint64(buf[0:], uint64(m.Nonce))
+	return buf, nil
+}
+
+func (m *Heartbeat) UnmarshalCustom(data []byte) error {
+	if len(data) != 8 {
+		return ERROR_INVALID_HEARTBEAT
+	}
+
+	m.Nonce = uint64(binary.BigEndian.Uint64(data[0:]))
+	return nil
+}
+
+func (m Heartbeat) MarshalBinary() ([]byte, error) {
+	return m.MarshalCustom()
+}
+
+func (m *Heartbeat) UnmarshalBinary(data []byte) error {
+	return m.UnmarshalCustom(data)
+}
+
+// GameStateMessage is a game state update. As a custom payload it
+// uses the game state sub header. Decoded from a packet Data still
+// points into the packet so it is only good for as long as the packet is
+type GameStateMessage struct {
+	Version  uint8           `json:"version"`
+	State    GameState       `json:"state"`
+	ClientID ClientID        `json:"clientId"`
+	Data     json.RawMessage `json:"data"`
+}
+
+func (m GameStateMessage) MarshalCustom() ([]byte, error) {
+	buf := make([]byte, 10, 10+len(m.Data))
+	buf[GS_VERSION_OFFSET] = uint8(m.Version)
+	buf[GS_TYPE_OFFSET] = uint8(m.State)
+	copy(buf[GS_CLIENT_ID_OFFSET:GS_CLIENT_ID_OFFSET+8], m.ClientID)
+	buf = append(buf, m.Data...)
+	return buf, nil
+}
+
+func (m *GameStateMessage) UnmarshalCustom(data []byte) error {
+	if len(data) < 10 {
+		return ERROR_INVALID_GAME_STATE
+	}
+
+	m.Version = uint8(data[GS_VERSION_OFFSET])
+	m.State = GameState(data[GS_TYPE_OFFSET])
+	m.ClientID = ClientID(data[GS_CLIENT_ID_OFFSET : GS_CLIENT_ID_OFFSET+8])
+	m.Data = json.RawMessage(data[GS_DATA_OFFSET:])
+	return nil
+}
+
+type Move struct {
+	Name   string `json:"name"`
+	Damage int    `json:"damage"` // negative heals
+	Target Target `json:"target"`
+	Shield bool   `json:"shield,omitempty"`
+}
+
+// Attack mirrors the Attack type the client queues up.
+// Only the move name is trusted, the rest of the move
+// is looked up from Moves
+type Attack struct {
+	CharacterID     CharacterID `json:"characterId"`
+	TargetID        CharacterID `json:"targetId"`
+	CharacterTeamID TeamID      `json:"characterTeamId"`
+	TargetTeamID    TeamID      `json:"targetTeamId"`
+	Attack          Move        `json:"attack"`
+}
+
+// AttackResult is an Attack as the server resolved it. The
+// move damage is replaced with what was actually applied so
+// clients can keep rendering attack.damage as they do now
+type AttackResult struct {
+	Attack
+	TargetHealth int `json:"targetHealth"`
+}
+
+type TurnResult struct {
+	Team    TeamID         `json:"teamId"`
+	Results []AttackResult `json:"results"`
+	Winner  TeamID         `json:"winner,omitempty"`
+}
+
+// StartInfo confirms the start of a game to each client
+// along with the seat they were given
+type StartInfo struct {
+	GameID GameID   `json:"gameId"`
+	Team   TeamID   `json:"teamId"`
+	Host   ClientID `json:"host"`
+}
+
+// TurnState is sent to each client on every phase change.
+// The game state type of the packet carrying it is the
+// phase of the client receiving it, ATTACK or DEFENSE
+type TurnState struct {
+	Turn       int    `json:"turn"`
+	ActiveTeam TeamID `json:"activeTeam"`
+	Team       TeamID `json:"teamId"`
+}
+
+// ResumeInfo tells a resumed client who it is again
+// and where it was seated
+type ResumeInfo struct {
+	ClientID ClientID `json:"clientId"`
+	GameID   GameID   `json:"gameId"`
+	Team     TeamID   `json:"teamId"`
+}
+
+// ShutdownInfo is sent to every client when the server starts
+// shutting down. Deadline is when running games will be stopped,
+// zero if they get as long as they need
+type ShutdownInfo struct {
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+// Hello is what a client can speak. It is optional and sent in
+// answer to the auth challenge, before the actual answer. Empty
+// version and encoding lists mean the client takes whatever
+// the server picks
+type Hello struct {
+	Versions          []int    `json:"versions"` // packet header versions
+	GameStateVersions []int    `json:"gameStateVersions"`
+	Encodings         []int    `json:"encodings,omitempty"` // must include EncJSON, EncString and EncBytes, game state is EncCustom if listed
+	Capabilities      []string `json:"capabilities,omitempty"`
+}
+
+// Negotiated is what the server picked out of a Hello
+// and holds the connection to until it goes away
+type Negotiated struct {
+	Version          int      `json:"version"`
+	GameStateVersion int      `json:"gameStateVersion"`
+	Encodings        []int    `json:"encodings"`
+	Capabilities     []string `json:"capabilities,omitempty"`
+}
+
+// Bind ties the UDP endpoint it is sent from to the
+// TCP session Token was handed out to by PacketBindToken.
+// As a string, bytes or custom payload it is just the token
+type Bind struct {
+	Token string `json:"token"`
+}
+
+func (m Bind) MarshalCustom() ([]byte, error) {
+	buf := make([]byte, 0, 0+len(m.Token))
+	buf = append(buf, m.Token...)
+	return buf, nil
+}
+
+func (m *Bind) UnmarshalCustom(data []byte) error {
+	m.Token = string(data[0:])
+	return nil
+}
+
+func (m Bind) MarshalBinary() ([]byte, error) {
+	return m.MarshalCustom()
+}
+
+func (m *Bind) UnmarshalBinary(data []byte) error {
+	return m.UnmarshalCustom(data)
+}
+
+func (m Bind) MarshalText() ([]byte, error) {
+	return m.MarshalCustom()
+}
+
+func (m *Bind) UnmarshalText(data []byte) error {
+	return m.UnmarshalCustom(data)
+}
+
+// Error is the struct containing all
+// necessary fields to create a JSON
+// error response
+type Error struct {
+	Code    int         `json:"code"`
+	Err     string      `json:"error"`
+	Message string      `json:"message"`
+	Request *RequestRef `json:"request,omitempty"`
+}
+
+// RequestRef points an error back at the packet that caused it
+type RequestRef struct {
+	ID   uint16     `json:"id"`
+	Type PacketType `json:"type"`
+}
+
+// EncodeError wraps msg in a PacketError
+func EncodeError(enc Encoding, msg Error) (Packet, error) {
+	return Encode(enc, PacketError, msg)
+}
+
+// DecodeError decodes the Error carried by a PacketError
+func DecodeError(p *Packet) (Error, error) {
+	var msg Error
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeCreateGameSuccess wraps msg in a PacketCreateGameSuccess
+func EncodeCreateGameSuccess(enc Encoding, msg GameRef) (Packet, error) {
+	return Encode(enc, PacketCreateGameSuccess, msg)
+}
+
+// DecodeCreateGameSuccess decodes the GameRef carried by a PacketCreateGameSuccess
+func DecodeCreateGameSuccess(p *Packet) (GameRef, error) {
+	var msg GameRef
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeJoinGame wraps msg in a PacketJoinGame
+func EncodeJoinGame(enc Encoding, msg GameRef) (Packet, error) {
+	return Encode(enc, PacketJoinGame, msg)
+}
+
+// DecodeJoinGame decodes the GameRef carried by a PacketJoinGame
+func DecodeJoinGame(p *Packet) (GameRef, error) {
+	var msg GameRef
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeJoinGameSuccess wraps msg in a PacketJoinGameSuccess
+func EncodeJoinGameSuccess(enc Encoding, msg GameRef) (Packet, error) {
+	return Encode(enc, PacketJoinGameSuccess, msg)
+}
+
+// DecodeJoinGameSuccess decodes the GameRef carried by a PacketJoinGameSuccess
+func DecodeJoinGameSuccess(p *Packet) (GameRef, error) {
+	var msg GameRef
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeStartGame wraps msg in a PacketStartGame
+func EncodeStartGame(enc Encoding, msg GameRef) (Packet, error) {
+	return Encode(enc, PacketStartGame, msg)
+}
+
+// DecodeStartGame decodes the GameRef carried by a PacketStartGame
+func DecodeStartGame(p *Packet) (GameRef, error) {
+	var msg GameRef
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeGameState wraps msg in a PacketGameState
+func EncodeGameState(enc Encoding, msg GameStateMessage) (Packet, error) {
+	return Encode(enc, PacketGameState, msg)
+}
+
+// DecodeGameState decodes the GameStateMessage carried by a PacketGameState
+func DecodeGameState(p *Packet) (GameStateMessage, error) {
+	var msg GameStateMessage
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeStartGameSuccess wraps msg in a PacketStartGameSuccess
+func EncodeStartGameSuccess(enc Encoding, msg StartInfo) (Packet, error) {
+	return Encode(enc, PacketStartGameSuccess, msg)
+}
+
+// DecodeStartGameSuccess decodes the StartInfo carried by a PacketStartGameSuccess
+func DecodeStartGameSuccess(p *Packet) (StartInfo, error) {
+	var msg StartInfo
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeResumeSuccess wraps msg in a PacketResumeSuccess
+func EncodeResumeSuccess(enc Encoding, msg ResumeInfo) (Packet, error) {
+	return Encode(enc, PacketResumeSuccess, msg)
+}
+
+// DecodeResumeSuccess decodes the ResumeInfo carried by a PacketResumeSuccess
+func DecodeResumeSuccess(p *Packet) (ResumeInfo, error) {
+	var msg ResumeInfo
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeServerShutdown wraps msg in a PacketServerShutdown
+func EncodeServerShutdown(enc Encoding, msg ShutdownInfo) (Packet, error) {
+	return Encode(enc, PacketServerShutdown, msg)
+}
+
+// DecodeServerShutdown decodes the ShutdownInfo carried by a PacketServerShutdown
+func DecodeServerShutdown(p *Packet) (ShutdownInfo, error) {
+	var msg ShutdownInfo
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeHeartbeat wraps msg in a PacketHeartbeat
+func EncodeHeartbeat(enc Encoding, msg Heartbeat) (Packet, error) {
+	return Encode(enc, PacketHeartbeat, msg)
+}
+
+// DecodeHeartbeat decodes the Heartbeat carried by a PacketHeartbeat
+func DecodeHeartbeat(p *Packet) (Heartbeat, error) {
+	var msg Heartbeat
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeHeartbeatAck wraps msg in a PacketHeartbeatAck
+func EncodeHeartbeatAck(enc Encoding, msg Heartbeat) (Packet, error) {
+	return Encode(enc, PacketHeartbeatAck, msg)
+}
+
+// DecodeHeartbeatAck decodes the Heartbeat carried by a PacketHeartbeatAck
+func DecodeHeartbeatAck(p *Packet) (Heartbeat, error) {
+	var msg Heartbeat
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeHello wraps msg in a PacketHello
+func EncodeHello(enc Encoding, msg Hello) (Packet, error) {
+	return Encode(enc, PacketHello, msg)
+}
+
+// DecodeHello decodes the Hello carried by a PacketHello
+func DecodeHello(p *Packet) (Hello, error) {
+	var msg Hello
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeHelloAck wraps msg in a PacketHelloAck
+func EncodeHelloAck(enc Encoding, msg Negotiated) (Packet, error) {
+	return Encode(enc, PacketHelloAck, msg)
+}
+
+// DecodeHelloAck decodes the Negotiated carried by a PacketHelloAck
+func DecodeHelloAck(p *Packet) (Negotiated, error) {
+	var msg Negotiated
+	err := Decode(p, &msg)
+	return msg, err
+}
+
+// EncodeBind wraps msg in a PacketBind
+func EncodeBind(enc Encoding, msg Bind) (Packet, error) {
+	return Encode(enc, PacketBind, msg)
+}
+
+// DecodeBind decodes the Bind carried by a PacketBind
+func DecodeBind(p *Packet) (Bind, error) {
+	var msg Bind
+	err := Decode(p, &msg)
+	return msg, err
+}
@@ -1,31 +1,57 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
+	"log"
 	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
 )
 
+// v2 keeps the v1 header as is and tacks a sequence number
+// and a flags byte on the end
+//
+// |  Version  |  Enc/Type  |  Length  |  Seq     |  Flags  |  Reserved
+//
+//	1 byte      1 byte       2 bytes    2 bytes    1 byte    1 byte
 const (
-	VERSION              = uint8(1)
-	PACKET_MAX_SIZE      = 1024
-	PACKET_HEADER_SIZE   = 4
-	HEADER_LENGTH_OFFSET = 2
-	ENC_TYPE_OFFSET      = uint8(1)
-	MAX_DATA_SIZE        = PACKET_MAX_SIZE - PACKET_HEADER_SIZE
+	VERSION_2             = uint8(2)
+	PACKET_HEADER_SIZE_V2 = 8
+	HEADER_SEQ_OFFSET     = 4
+	HEADER_FLAGS_OFFSET   = 6
+	MAX_DATA_SIZE_V2      = PACKET_MAX_SIZE - PACKET_HEADER_SIZE_V2
 )
 
 var (
 	// Packet
-	ERROR_VERSION_MISMATCH       = errors.New("Version mismatch error")
-	ERROR_PACKET_LENGTH_MISMATCH = errors.New("Packet length mismatch error")
-	ERROR_CLIENT_ID_GENERATION   = errors.New("Error generating random ID for client")
+	ERROR_VERSION_MISMATCH             = errors.New("Version mismatch error")
+	ERROR_UNSUPPORTED_VERSION          = errors.New("No protocol version in common with the client")
+	ERROR_PACKET_LENGTH_MISMATCH       = errors.New("Packet length mismatch error")
+	ERROR_PACKET_TRUNCATED             = errors.New("Stream ended part way through a packet")
+	ERROR_INVALID_FRAGMENT             = errors.New("Fragment is out of order or doesn't match its message")
+	ERROR_MESSAGE_TOO_LARGE            = errors.New("Fragmented message is too large")
+	ERROR_TOO_MANY_FRAGMENTED_MESSAGES = errors.New("Too many fragmented messages in flight")
+	ERROR_UNSUPPORTED_ENCODING         = errors.New("Payload encoding is not supported for this message")
+	ERROR_INVALID_PAYLOAD              = errors.New("Payload could not be decoded")
+	ERROR_INVALID_COMPRESSION          = errors.New("Compressed payload could not be inflated")
+	ERROR_CLIENT_ID_GENERATION         = errors.New("Error generating random ID for client")
 	// server
 	ERROR_NO_HANDLER_REGISTERED = errors.New("No handler registered for current packet type")
 	ERROR_SERVER_TIMEOUT        = errors.New("Error server timed out while attempting to complete request")
+	ERROR_SERVER_SHUTTING_DOWN  = errors.New("Server is shutting down")
+	ERROR_CLIENT_TOO_SLOW       = errors.New("Client is not keeping up with writes")
+	ERROR_INVALID_HEARTBEAT     = errors.New("Invalid heartbeat acknowledgement")
+	ERROR_HANDLER_PANIC         = errors.New("Server failed while handling the request")
+	ERROR_RATE_LIMITED          = errors.New("Too many requests, slow down")
 	// auth
-	ERROR_INVALID_AUTH_PKT = errors.New("Invalid authentication packet")
-	ERROR_INVALID_AUTH_ID  = errors.New("Invalid authentication attempt")
-	ERROR_AUTH_TIMEOUT     = errors.New("Authentication attempt timed out")
+	ERROR_INVALID_AUTH_PKT  = errors.New("Invalid authentication packet")
+	ERROR_INVALID_AUTH_ID   = errors.New("Invalid authentication attempt")
+	ERROR_AUTH_TIMEOUT      = errors.New("Authentication attempt timed out")
+	ERROR_INVALID_SESSION   = errors.New("Session is invalid or expired")
+	ERROR_ALREADY_LOGGED_IN = errors.New("Client is already logged in, resume the session instead")
 	// game
 	ERROR_INVALID_GAME_ID             = errors.New("GameID is invalid")
 	ERROR_INVALID_GAME_JOIN_ATTEMPT   = errors.New("Cannot join game while currently in game")
@@ -33,31 +59,316 @@ var (
 	ERROR_CLIENT_NOT_IN_GAME          = errors.New("Client not registered with game")
 	ERROR_INVALID_CREATE_GAME_ATTEMPT = errors.New("Cannot create game while currently in game")
 	ERROR_INVALID_GAME_STATE          = errors.New("Client game state is invalid")
+	ERROR_INVALID_ATTACK              = errors.New("Attack is invalid")
+	ERROR_GAME_OVER                   = errors.New("Game is already over")
+	ERROR_GAME_FULL                   = errors.New("Game has no open seats")
+	ERROR_GAME_ALREADY_STARTED        = errors.New("Game has already started")
+	ERROR_NOT_GAME_HOST               = errors.New("Only the host can start the game")
+	ERROR_GAME_NOT_READY              = errors.New("Game needs two players to start")
+	ERROR_GAME_FINISHED               = errors.New("Game has already finished")
 	// test
 	ERROR_INVALID_HQ_RES = errors.New("Invalid health check response") // testing
 )
 
+// most packets a disconnected client can miss before
+// the oldest ones start getting dropped
+const MAX_MISSED_PACKETS = 128
+
+const (
+	// most packets that can be waiting on a client before it
+	// is considered too slow and disconnected
+	CLIENT_QUEUE_SIZE = 256
+	// how long a single write can block before the client
+	// is considered dead
+	WRITE_TIMEOUT = time.Second * 5
+)
+
 // Client is for a connected client
 // contains connection and packet framer
 // for formatting byte stream
+//
+// The game fields are shared between the goroutine
+// handling the connection and the goroutine of the
+// game the client is seated in, so they are guarded
+// by mu and only touched through the seat methods
 type Client struct {
-	conn     net.Conn
+	conn     Conn
 	clientID ClientID
-	gameID   GameID
-	gamePump chan<- *Packet
+	session  string
+
+	mu     sync.Mutex
+	gameID GameID
+	game   *Game
+	team   TeamID
+	// protocol version the client spoke when it authenticated,
+	// everything written to it is framed the same way
+	version uint8
+	// what the hello settled on, see negotiate
+	proto Negotiated
+	// set while the connection is lost and the session is
+	// waiting to be resumed, writes are kept in missed
+	offline bool
+	missed  []outbound
+	// taken off outq by a writer after the client went
+	// offline, park puts them back ahead of missed
+	parked []outbound
+	// set once outq overflowed and conn is being closed,
+	// writes are turned away until the client resumes
+	stalled bool
+	hb      heartbeat
+	// ID of the last message that had to be fragmented
+	msgID uint16
+	// set while game state goes out over UDP, see UDPServer
+	udp *udpEndpoint
+
+	// writes are queued up in outq and drained onto conn by a
+	// writer goroutine so a slow client only ever holds itself
+	// up. stop and done belong to the writer currently running
+	outq chan outbound
+	stop chan struct{}
+	done chan struct{}
+}
+
+// outbound is a packet waiting on a connection along with
+// the request it answers, if any. The queue owns one reference
+// to pkt, whoever takes it off the queue releases it
+type outbound struct {
+	pkt *Packet
+	seq uint16
 }
 
 // NewClient creates a client given a connection
 // and generates a new PacketFramer for use
-func NewClient(conn net.Conn) *Client {
-	return &Client{
-		conn: conn,
+func NewClient(conn Conn) *Client {
+	c := &Client{
+		conn:    conn,
+		version: VERSION,
+		proto:   legacyProtocol(VERSION),
+		outq:    make(chan outbound, CLIENT_QUEUE_SIZE),
 	}
+
+	c.mu.Lock()
+	c.startWriter()
+	c.mu.Unlock()
+
+	return c
 }
 
-// Implements client as a writer
+// Implements client as a writer. data is queued up and written
+// in the background, write errors are only logged
 func (c *Client) Write(data []byte) (int, error) {
-	return c.conn.Write(data)
+	return c.write(data, 0)
+}
+
+// Reply writes pkt as the answer to req. Clients speaking v2
+// get the sequence number of req back in the header
+func (c *Client) Reply(req *Packet, pkt Packet) (int, error) {
+	var seq uint16
+	if req != nil {
+		seq = req.Seq()
+	}
+	return c.write(pkt.data, seq)
+}
+
+func (c *Client) write(data []byte, seq uint16) (int, error) {
+	pkt := AcquirePacket(len(data))
+	copy(pkt.data, data)
+
+	return c.enqueue(pkt, seq)
+}
+
+// enqueue queues pkt up for writing, taking over the reference
+// the caller holds. Lets a packet be shared by every client it
+// goes out to instead of being copied for each of them
+func (c *Client) enqueue(pkt *Packet, seq uint16) (int, error) {
+	out := outbound{pkt: pkt, seq: seq}
+	n := pkt.len
+
+	c.mu.Lock()
+
+	if n > PACKET_MAX_SIZE && !c.canFragment() {
+		c.mu.Unlock()
+		pkt.Release()
+		return 0, ERROR_MESSAGE_TOO_LARGE
+	}
+
+	if c.offline {
+		c.miss(out)
+		c.mu.Unlock()
+		return n, nil
+	}
+
+	if !c.stalled {
+		select {
+		case c.outq <- out:
+			c.mu.Unlock()
+			return n, nil
+		default:
+		}
+	}
+	pkt.Release()
+
+	// the client hasn't kept up, cut it loose and let the
+	// connection handler clean up after it. Closed outside of
+	// mu, a stalled connection can take its time to close and
+	// the caller might be a game with everyone else to serve
+	conn := c.conn
+	first := !c.stalled
+	c.stalled = true
+	c.mu.Unlock()
+
+	if first {
+		log.Printf("Client %s fell %d packets behind, disconnecting", c.Id(), CLIENT_QUEUE_SIZE)
+		conn.Close()
+	}
+
+	return 0, ERROR_CLIENT_TOO_SLOW
+}
+
+// miss keeps out for when the client resumes. Must hold mu
+func (c *Client) miss(out outbound) {
+	if len(c.missed) == MAX_MISSED_PACKETS {
+		c.missed[0].pkt.Release()
+		c.missed = c.missed[1:]
+	}
+	c.missed = append(c.missed, out)
+}
+
+// startWriter starts draining outq onto the current
+// connection. Must hold mu
+func (c *Client) startWriter() {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.writeLoop(c.conn, c.stop, c.done)
+}
+
+// stopWriter tells the running writer to flush what is left
+// in outq and exit. Returns a channel closed once it has. Must
+// hold mu
+func (c *Client) stopWriter() chan struct{} {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	return c.done
+}
+
+func (c *Client) writeLoop(conn Conn, stop, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case out := <-c.outq:
+			c.send(conn, out)
+		case <-stop:
+			for {
+				select {
+				case out := <-c.outq:
+					c.send(conn, out)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) send(conn Conn, out outbound) {
+	if pkt := reencode(out.pkt, c.Protocol().Encodings); pkt != nil {
+		out.pkt.Release()
+		out.pkt = pkt
+	}
+
+	c.mu.Lock()
+	if c.offline {
+		c.parked = append(c.parked, out)
+		c.mu.Unlock()
+		return
+	}
+	if c.udp != nil && reliableOverUDP(out.pkt.Type()) {
+		if c.udp.sendReliable(out, slices.Contains(c.proto.Capabilities, CAP_COMPRESSION)) {
+			c.mu.Unlock()
+			out.pkt.Release()
+			return
+		}
+	}
+	wire := c.wire(out)
+	frags, err := c.fragment(wire, out.seq)
+	c.mu.Unlock()
+
+	defer out.pkt.Release()
+	defer wire.Release()
+
+	if err != nil {
+		// queued up before the client came back speaking v1
+		log.Printf("Dropping %s for client %s: %s", TypeToString(out.pkt.Type()), c.Id(), err)
+		return
+	}
+	if frags == nil {
+		c.writeFrame(conn, wire.data)
+		return
+	}
+	for _, frag := range frags {
+		if !c.writeFrame(conn, frag) {
+			return
+		}
+	}
+}
+
+// writeFrame writes a single frame, returning false once
+// the connection is no good anymore
+func (c *Client) writeFrame(conn Conn, frame []byte) bool {
+	conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	if _, err := conn.Write(frame); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("Write to client %s timed out, disconnecting", c.Id())
+			conn.Close()
+			return false
+		}
+		if !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error writing to client %s: %s", c.Id(), err)
+		}
+		return false
+	}
+	return true
+}
+
+// wire returns out as this client expects it framed, with a
+// reference of its own the caller has to release. Must hold mu
+func (c *Client) wire(out outbound) *Packet {
+	// everything is constructed as v1, only v2 clients need it
+	// reframed. v1 clients get the packet untouched
+	if c.version == VERSION_2 {
+		if slices.Contains(c.proto.Capabilities, CAP_COMPRESSION) {
+			if pkt := compressPooled(out.pkt, out.seq); pkt != nil {
+				return pkt
+			}
+		}
+		return reframePooled(out.pkt, c.version, out.seq)
+	}
+	out.pkt.Retain()
+	return out.pkt
+}
+
+// fragment splits pkt up if it is too big for one packet.
+// Returns nil if it fits. Must hold mu
+func (c *Client) fragment(pkt *Packet, seq uint16) ([][]byte, error) {
+	if pkt.len <= PACKET_MAX_SIZE {
+		return nil, nil
+	}
+	if !c.canFragment() {
+		return nil, ERROR_MESSAGE_TOO_LARGE
+	}
+	c.msgID++
+	return Fragment(pkt.data, c.msgID, seq), nil
+}
+
+// canFragment reports whether the client can put fragments
+// back together. They are v2 packets underneath, a client
+// that speaks v1 can't even tell where one ends. Must hold mu
+func (c *Client) canFragment() bool {
+	return c.version == VERSION_2
 }
 
 func (c *Client) Id() string {
@@ -65,19 +376,186 @@ func (c *Client) Id() string {
 }
 
 func (c *Client) Addr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.conn.RemoteAddr()
 }
 
+// Disconnect flushes whatever is still queued up
+// and closes the connection
 func (c *Client) Disconnect() {
-	c.conn.Close()
+	c.mu.Lock()
+	conn := c.conn
+	done := c.stopWriter()
+	c.mu.Unlock()
+
+	<-done
+	conn.Close()
+}
+
+// release flushes the queue and stops the writer without
+// closing the connection, so another client can take it over
+func (c *Client) release() {
+	c.mu.Lock()
+	done := c.stopWriter()
+	c.mu.Unlock()
+
+	<-done
+}
+
+// detach marks the client offline if conn is still the
+// connection it is using. Returns false if the client has
+// already been resumed on another connection
+func (c *Client) detach(conn Conn) bool {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return false
+	}
+	c.offline = true
+	done := c.stopWriter()
+	c.mu.Unlock()
+
+	return c.park(done)
+}
+
+// park waits on the writer behind done to stop and moves
+// everything it didn't get out over to missed, ahead of what
+// was written since, so it goes out in order once the client
+// is back. Returns false if the client was resumed in the
+// meantime. Must not hold mu, the writer needs it to finish
+func (c *Client) park(done chan struct{}) bool {
+	<-done
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.offline {
+		return false
+	}
+
+	pending := c.parked
+	c.parked = nil
+	for len(c.outq) > 0 {
+		pending = append(pending, <-c.outq)
+	}
+	c.missed = append(pending, c.missed...)
+
+	if over := len(c.missed) - MAX_MISSED_PACKETS; over > 0 {
+		for _, out := range c.missed[:over] {
+			out.pkt.Release()
+		}
+		c.missed = c.missed[over:]
+	}
+	return true
+}
+
+// attach moves a resumed client over to conn and returns the
+// connection it replaces. greeting and everything written while
+// the client was away are first in line for the new writer so
+// nothing arrives out of order. The client may have come
+// back speaking another protocol version so it is taken from fresh,
+// the client the new connection negotiated as
+func (c *Client) attach(fresh *Client, req *Packet, greeting Packet) Conn {
+	proto := fresh.Protocol()
+
+	c.mu.Lock()
+	old := c.conn
+	conn := fresh.conn
+	c.conn = conn
+	c.version = fresh.version
+	c.proto = proto
+
+	// still attached to a dead peer, its writer has to be
+	// done with the queue before the new one takes over
+	c.offline = true
+	done := c.stopWriter()
+	c.mu.Unlock()
+
+	c.park(done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// queued rather than written here so a slow connection
+	// can't hold up everyone else waiting on mu. park left
+	// outq empty and missed is capped well short of it
+	pkt := AcquirePacket(len(greeting.data))
+	copy(pkt.data, greeting.data)
+	c.outq <- outbound{pkt: pkt, seq: req.Seq()}
+	for _, out := range c.missed {
+		c.outq <- out
+	}
+
+	c.offline = false
+	c.stalled = false
+	c.missed = nil
+	c.hb.missed = 0
+	c.startWriter()
+
+	return old
+}
+
+// GameID returns the game the client is seated in, if any
+func (c *Client) GameID() GameID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gameID
+}
+
+// Game returns the game the client is seated in along
+// with the team it is playing as
+func (c *Client) Game() (*Game, TeamID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.game, c.team
+}
+
+// seat puts the client in g as team, failing if the
+// client is already seated in a game
+func (c *Client) seat(g *Game, team TeamID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.game != nil {
+		return false
+	}
+
+	c.gameID = g.id
+	c.game = g
+	c.team = team
+	return true
+}
+
+// unseat removes the client from g. Does nothing if the
+// client has already moved on to another game
+func (c *Client) unseat(g *Game) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.game != g {
+		return
+	}
+
+	c.gameID = ""
+	c.game = nil
+	c.team = TeamNone
 }
 
 // Packet is the way of interpreting data from our
-// clients. data contains a header field of
-// length PACKET_HEADER_SIZE
+// clients. data contains a header field of length
+// PACKET_HEADER_SIZE or PACKET_HEADER_SIZE_V2
+// depending on its version
 type Packet struct {
 	data []byte
 	len  int
+	// position of the packet in the stream it was read
+	// from, starting at 1. v1 has nowhere to put it so
+	// the framer counts, v2 carries it in the header
+	seq uint16
+	// packets from packetPool are reference counted, see Release
+	refs   int32
+	pooled bool
 }
 
 // Constructor that returns a packet
@@ -106,16 +584,28 @@ func (p *Packet) Type() PacketType {
 
 // Method to grab just the data from the packet
 func (p *Packet) Data() []byte {
-	return p.data[PACKET_HEADER_SIZE:]
+	return p.data[headerSize(p.Version()):]
+}
+
+func (p *Packet) Version() uint8 {
+	return p.data[0]
 }
 
-// Error is the struct containing all
-// necessary fields to create a JSON
-// error response
-type Error struct {
-	Code    int    `json:"code"`
-	Err     string `json:"error"`
-	Message string `json:"message"`
+// Seq returns the correlation ID of the packet. For v1 it
+// is only known for packets that went through a framer
+func (p *Packet) Seq() uint16 {
+	if p.Version() != VERSION {
+		return binary.BigEndian.Uint16(p.data[HEADER_SEQ_OFFSET:])
+	}
+	return p.seq
+}
+
+// Flags is always empty for v1 packets
+func (p *Packet) Flags() uint8 {
+	if p.Version() != VERSION {
+		return p.data[HEADER_FLAGS_OFFSET]
+	}
+	return 0
 }
 
 func NewError(err error) Error {
@@ -126,13 +616,36 @@ func NewError(err error) Error {
 	}
 }
 
+// NewRequestError is NewError for an error caused by req
+func NewRequestError(err error, req *Packet) Error {
+	e := NewError(err)
+	e.Request = &RequestRef{ID: req.Seq(), Type: req.Type()}
+	return e
+}
+
 func errorToString(err error) string {
 	switch err {
 	// packet errors
 	case ERROR_VERSION_MISMATCH:
 		return "Version mismatch"
+	case ERROR_UNSUPPORTED_VERSION:
+		return "No protocol version in common"
 	case ERROR_PACKET_LENGTH_MISMATCH:
 		return "Packet length mismatch"
+	case ERROR_PACKET_TRUNCATED:
+		return "Stream ended part way through a packet"
+	case ERROR_INVALID_FRAGMENT:
+		return "Fragment is out of order or doesn't match its message"
+	case ERROR_MESSAGE_TOO_LARGE:
+		return "Fragmented message is too large"
+	case ERROR_TOO_MANY_FRAGMENTED_MESSAGES:
+		return "Too many fragmented messages in flight"
+	case ERROR_UNSUPPORTED_ENCODING:
+		return "Payload encoding is not supported for this message"
+	case ERROR_INVALID_PAYLOAD:
+		return "Payload could not be decoded"
+	case ERROR_INVALID_COMPRESSION:
+		return "Compressed payload is corrupt"
 	case ERROR_CLIENT_ID_GENERATION:
 		return "Failed to generate random ID for client"
 	// server errors
@@ -140,6 +653,16 @@ func errorToString(err error) string {
 		return "No handler registered for current packet type"
 	case ERROR_SERVER_TIMEOUT:
 		return "Server timed out while attempting to complete request"
+	case ERROR_SERVER_SHUTTING_DOWN:
+		return "Server is shutting down"
+	case ERROR_CLIENT_TOO_SLOW:
+		return "Client is not keeping up with writes"
+	case ERROR_INVALID_HEARTBEAT:
+		return "Invalid heartbeat acknowledgement"
+	case ERROR_HANDLER_PANIC:
+		return "Server failed while handling the request"
+	case ERROR_RATE_LIMITED:
+		return "Too many requests"
 	// auth errors
 	case ERROR_INVALID_AUTH_PKT:
 		return "Invalid authentication packet"
@@ -147,6 +670,10 @@ func errorToString(err error) string {
 		return "Invalid authentication attempt"
 	case ERROR_AUTH_TIMEOUT:
 		return "Authentication attempt timed out"
+	case ERROR_INVALID_SESSION:
+		return "Session is invalid or expired"
+	case ERROR_ALREADY_LOGGED_IN:
+		return "Client is already logged in"
 	// game errors
 	case ERROR_INVALID_GAME_ID:
 		return "Invalid game ID"
@@ -160,6 +687,20 @@ func errorToString(err error) string {
 		return "Cannot create a new game while already in one"
 	case ERROR_INVALID_GAME_STATE:
 		return "Client's game state is invalid"
+	case ERROR_INVALID_ATTACK:
+		return "Attack is invalid"
+	case ERROR_GAME_OVER:
+		return "Game is already over"
+	case ERROR_GAME_FULL:
+		return "Game has no open seats"
+	case ERROR_GAME_ALREADY_STARTED:
+		return "Game has already started"
+	case ERROR_NOT_GAME_HOST:
+		return "Only the host can start the game"
+	case ERROR_GAME_NOT_READY:
+		return "Game needs two players to start"
+	case ERROR_GAME_FINISHED:
+		return "Game has already finished"
 	// test errors
 	case ERROR_INVALID_HQ_RES:
 		return "Invalid health check response"
@@ -174,8 +715,24 @@ func errorToStatusCode(err error) int {
 	// packet errors
 	case ERROR_VERSION_MISMATCH:
 		return 400
+	case ERROR_UNSUPPORTED_VERSION:
+		return 426
 	case ERROR_PACKET_LENGTH_MISMATCH:
 		return 400
+	case ERROR_PACKET_TRUNCATED:
+		return 400
+	case ERROR_INVALID_FRAGMENT:
+		return 400
+	case ERROR_MESSAGE_TOO_LARGE:
+		return 413
+	case ERROR_TOO_MANY_FRAGMENTED_MESSAGES:
+		return 429
+	case ERROR_UNSUPPORTED_ENCODING:
+		return 415
+	case ERROR_INVALID_PAYLOAD:
+		return 400
+	case ERROR_INVALID_COMPRESSION:
+		return 400
 	case ERROR_CLIENT_ID_GENERATION:
 		return 500
 	// server errors
@@ -183,6 +740,16 @@ func errorToStatusCode(err error) int {
 		return 404
 	case ERROR_SERVER_TIMEOUT:
 		return 504
+	case ERROR_SERVER_SHUTTING_DOWN:
+		return 503
+	case ERROR_CLIENT_TOO_SLOW:
+		return 503
+	case ERROR_INVALID_HEARTBEAT:
+		return 400
+	case ERROR_HANDLER_PANIC:
+		return 500
+	case ERROR_RATE_LIMITED:
+		return 429
 	// auth errors
 	case ERROR_INVALID_AUTH_PKT:
 		return 401
@@ -190,6 +757,10 @@ func errorToStatusCode(err error) int {
 		return 403
 	case ERROR_AUTH_TIMEOUT:
 		return 408
+	case ERROR_INVALID_SESSION:
+		return 401
+	case ERROR_ALREADY_LOGGED_IN:
+		return 409
 	// game errors
 	case ERROR_INVALID_GAME_ID:
 		return 400
@@ -203,6 +774,20 @@ func errorToStatusCode(err error) int {
 		return 403
 	case ERROR_INVALID_GAME_STATE:
 		return 400
+	case ERROR_INVALID_ATTACK:
+		return 400
+	case ERROR_GAME_OVER:
+		return 409
+	case ERROR_GAME_FULL:
+		return 409
+	case ERROR_GAME_ALREADY_STARTED:
+		return 409
+	case ERROR_NOT_GAME_HOST:
+		return 403
+	case ERROR_GAME_NOT_READY:
+		return 409
+	case ERROR_GAME_FINISHED:
+		return 410
 	// test errors
 	case ERROR_INVALID_HQ_RES:
 		return 500
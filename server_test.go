@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientWriteQueue(t *testing.T) {
+	client, framer := pipeClient("10000001")
+	defer client.Disconnect()
+
+	for i := 0; i < 10; i++ {
+		pkt := ConstructPacket(EncBytes, PacketHealthCheckRes, []byte{byte(i)})
+		if _, err := client.Write(pkt.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		pkt, err := expectPacket(framer.C, PacketHealthCheckRes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Data()[0] != byte(i) {
+			t.Fatalf("Expected packet %d. Got %d", i, pkt.Data()[0])
+		}
+	}
+}
+
+func TestClientSlowConsumer(t *testing.T) {
+	// nobody ever reads from remote
+	server, remote := net.Pipe()
+	client := NewClient(server)
+	client.clientID = "10000001"
+
+	pkt := ConstructPacket(EncString, PacketHealthCheckRes, []byte("Im alive :D"))
+
+	// Write never blocks, it gives up on the client once
+	// the queue is full instead
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < CLIENT_QUEUE_SIZE*2; i++ {
+			if _, err := client.Write(pkt.data); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != ERROR_CLIENT_TOO_SLOW {
+			t.Fatalf("Expected %v. Got %v", ERROR_CLIENT_TOO_SLOW, err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Write blocked on a stalled client")
+	}
+
+	// and the connection is closed so the handler cleans up
+	remote.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, PACKET_MAX_SIZE)
+	for {
+		if _, err := remote.Read(buf); err != nil {
+			if err != io.EOF {
+				t.Fatalf("Expected connection to be closed. Got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestStalledClientDoesNotStallGame(t *testing.T) {
+	one, framer := pipeClient("10000001")
+	defer one.Disconnect()
+
+	server, _ := net.Pipe()
+	two := NewClient(server)
+	two.clientID = "10000002"
+	// Disconnect would sit out the write timeout trying to flush
+	defer server.Close()
+
+	game := NewGame(one, validateGamePkt)
+	one.seat(game, TeamOne)
+	two.seat(game, TeamTwo)
+	game.clients = append(game.clients, two)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			game.broadCast(ConstructPacket(EncString, PacketHealthCheckRes, []byte("Im alive :D")))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Broadcast blocked on a stalled client")
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := expectPacket(framer.C, PacketHealthCheckRes); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// slowReader holds up every read, a peer that is
+// still there but barely keeping up
+type slowReader struct {
+	net.Conn
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond * 5)
+	return r.Conn.Read(p)
+}
+
+func TestClientResumeOnLivePeer(t *testing.T) {
+	server, remote := net.Pipe()
+	client := NewClient(server)
+	client.clientID = "10000001"
+	defer client.Disconnect()
+
+	oldFramer := NewPacketFramer()
+	go FrameWithReader(oldFramer, slowReader{remote})
+
+	write := func(i int) {
+		client.Write(ConstructPacket(EncBytes, PacketHealthCheckRes, []byte{byte(i)}).data)
+	}
+	for i := 0; i < 10; i++ {
+		write(i)
+	}
+
+	// the old connection is still up when the client resumes,
+	// whatever it didn't get has to follow on the new one
+	fresh, framer := pipeClient(client.clientID)
+	fresh.release()
+	req := ConstructPacket(EncString, PacketResume, []byte{})
+	old := client.attach(fresh, &req, ConstructPacket(EncString, PacketResumeSuccess, []byte{}))
+	old.Close()
+
+	for i := 10; i < 20; i++ {
+		write(i)
+	}
+
+	// C is buffered, drained once the reader is done
+	<-oldFramer.errch
+	next := 0
+	for len(oldFramer.C) > 0 {
+		pkt := <-oldFramer.C
+		if int(pkt.Data()[0]) != next {
+			t.Fatalf("Expected packet %d on the old connection. Got %d", next, pkt.Data()[0])
+		}
+		next++
+	}
+
+	if _, err := expectPacket(framer.C, PacketResumeSuccess); err != nil {
+		t.Fatal(err)
+	}
+	for ; next < 20; next++ {
+		pkt, err := expectPacket(framer.C, PacketHealthCheckRes)
+		if err != nil {
+			t.Fatalf("Packet %d: %s", next, err)
+		}
+		if int(pkt.Data()[0]) != next {
+			t.Fatalf("Expected packet %d on the new connection. Got %d", next, pkt.Data()[0])
+		}
+	}
+}
+
+func TestClientResumeOnStalledConn(t *testing.T) {
+	client, _ := pipeClient("10000001")
+	client.detach(client.conn)
+	for i := 0; i < 10; i++ {
+		client.Write(ConstructPacket(EncBytes, PacketHealthCheckRes, []byte{byte(i)}).data)
+	}
+
+	// nobody reads from the new connection either
+	server, _ := net.Pipe()
+	defer server.Close()
+	fresh := NewClient(server)
+	fresh.release()
+
+	done := make(chan struct{})
+	go func() {
+		req := ConstructPacket(EncString, PacketResume, []byte{})
+		client.attach(fresh, &req, ConstructPacket(EncString, PacketResumeSuccess, []byte{}))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Resume blocked on writing to the new connection")
+	}
+	// and the client is free for everyone else
+	client.GameID()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// how long a dropped client keeps its seat
+const SESSION_GRACE_PERIOD = time.Second * 30
+
+// Session is handed out on authentication and lets a client
+// that lost its connection pick up where it left off
+type Session struct {
+	token  string
+	client *Client
+	// binds a UDP endpoint and nothing else, it goes out
+	// in the clear and can't be allowed to resume
+	bind string
+	// running while the client is disconnected
+	timer *time.Timer
+}
+
+// SessionStore keeps every issued session until it is
+// revoked or its client has been gone for too long
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	// bind tokens to the sessions they were handed out for
+	binds map[string]*Session
+	grace time.Duration
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+		binds:    make(map[string]*Session),
+		grace:    SESSION_GRACE_PERIOD,
+	}
+}
+
+func GenerateSessionToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Issue creates a session for c and returns its token. A
+// ClientID gets one session at a time, a second login would
+// have the two connections playing the same seat
+func (s *SessionStore) Issue(c *Client) (string, error) {
+	token := GenerateSessionToken()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sess := range s.sessions {
+		if sess.client.clientID == c.clientID {
+			return "", ERROR_ALREADY_LOGGED_IN
+		}
+	}
+	s.sessions[token] = &Session{token: token, client: c}
+
+	return token, nil
+}
+
+// Park starts the grace period for a dropped client. If the
+// client hasn't resumed by the time it runs out onExpire
+// is called and the session is gone for good
+func (s *SessionStore) Park(token string, onExpire func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok {
+		return
+	}
+
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(s.grace, func() {
+		s.mu.Lock()
+		// resumed or parked again while we were waiting on the lock
+		expired := s.sessions[token] == sess && sess.timer == timer
+		if expired {
+			delete(s.sessions, token)
+			delete(s.binds, sess.bind)
+		}
+		s.mu.Unlock()
+
+		if expired {
+			log.Printf("Session for client %s expired", sess.client.Id())
+			onExpire()
+		}
+	})
+	sess.timer = timer
+}
+
+// Resume hands back the client behind token and stops
+// its grace period
+func (s *SessionStore) Resume(token string) (*Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok {
+		return nil, ERROR_INVALID_SESSION
+	}
+
+	if sess.timer != nil {
+		sess.timer.Stop()
+		sess.timer = nil
+	}
+
+	return sess.client, nil
+}
+
+// Lookup returns the client behind token, if it has a session
+func (s *SessionStore) Lookup(token string) (*Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok {
+		return nil, false
+	}
+	return sess.client, true
+}
+
+// Revoke forgets the session behind token
+func (s *SessionStore) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok {
+		return
+	}
+
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+	delete(s.sessions, token)
+	delete(s.binds, sess.bind)
+}
+
+// BindToken hands out a new bind token for the session behind
+// token, the one it had before stops working
+func (s *SessionStore) BindToken(token string) (string, error) {
+	bind := GenerateSessionToken()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok {
+		return "", ERROR_INVALID_SESSION
+	}
+
+	delete(s.binds, sess.bind)
+	sess.bind = bind
+	s.binds[bind] = sess
+
+	return bind, nil
+}
+
+// LookupBind returns the client bind was handed out to
+func (s *SessionStore) LookupBind(bind string) (*Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.binds[bind]
+	if !ok {
+		return nil, false
+	}
+	return sess.client, true
+}
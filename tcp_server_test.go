@@ -1,259 +1,703 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
 	"math/rand/v2"
 	"net"
-	"os"
-	"path/filepath"
 	"regexp"
 	"sync"
 	"testing"
 	"time"
 )
 
-type req func(C chan *Packet, c *Client) error
-
-var requests = []req{
-	sendHealthCheck,
-	sendPacketCreateGame,
-	sendInvalidPacketJoinGame,
-	sendTwoCreateGameRequests,
-}
-
-type TestLogger struct {
-	logger   *log.Logger
-	errcnt   int
-	hqReq    int
-	cgReq    int
-	twocgReq int
-	invjgReq int
-}
-
-func (tl *TestLogger) Println(v ...interface{}) {
-	tl.logger.Println(v...)
-}
-
-func (tl *TestLogger) Printf(format string, v ...interface{}) {
-	tl.logger.Printf(format, v...)
-}
-
-func (tl *TestLogger) PrintErr(err error) {
-	tl.errcnt++
-	tl.logger.Printf("Error - %v", err)
-}
-
-func (tl *TestLogger) IncHQReq() {
-	tl.hqReq++
-}
-
-func (tl *TestLogger) IncCGReq() {
-	tl.cgReq++
-}
-
-func (tl *TestLogger) IncTwoCGReq() {
-	tl.twocgReq++
-}
+// TestServer walks a client through everything it
+// can do outside of a game, one scenario at a time
+func TestServer(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(s *script)
+	}{
+		{"health check", func(s *script) {
+			a := s.connect("A")
+			a.send(PacketHealthCheckReq, []byte{})
+			if res := a.expect(PacketHealthCheckRes); string(res.Data()) != "Im alive :D" {
+				s.t.Fatalf("Unexpected health check response %q", res.Data())
+			}
+			a.expectQuiet()
+		}},
+		{"create game", func(s *script) {
+			a := s.connect("A")
+			a.send(PacketCreateGame, []byte{})
+			if id := a.expect(PacketCreateGameSuccess).Data(); !isValidID(string(id)) {
+				s.t.Fatalf("Invalid game id %q", id)
+			}
+			a.expectQuiet()
+		}},
+		{"create game twice", func(s *script) {
+			a := s.connect("A")
+			a.send(PacketCreateGame, []byte{})
+			a.expect(PacketCreateGameSuccess)
+			a.send(PacketCreateGame, []byte{})
+			a.expectError(ERROR_INVALID_CREATE_GAME_ATTEMPT)
+			a.expectQuiet()
+		}},
+		{"join missing game", func(s *script) {
+			a := s.connect("A")
+			a.send(PacketJoinGame, []byte("123456"))
+			a.expectError(ERROR_INVALID_GAME_ID)
+			a.send(PacketJoinGame, []byte("12345678"))
+			a.expectError(ERROR_INVALID_GAME_ID)
+			a.expectQuiet()
+		}},
+	}
 
-func (tl *TestLogger) IncInvJGReq() {
-	tl.invjgReq++
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			c.run(newScript(t))
+		})
+	}
 }
 
-func (tl *TestLogger) LogResults() {
-	tl.Printf("Health Check requests sent: %d", tl.hqReq)
-	tl.Printf("Create Game requests sent: %d", tl.cgReq)
-	tl.Printf("Double Creaqte Game requests sent: %d", tl.cgReq)
-	tl.Printf("Invalid Join Game requests sent: %d", tl.invjgReq)
-	tl.Printf("Error count: %d", tl.errcnt)
-}
+// TestGameManagerStress hammers the game manager from many clients
+// at once. Run with -race, the point is the detector staying quiet
+func TestGameManagerStress(t *testing.T) {
+	m := NewGameManager()
+
+	const (
+		clientCnt = 40
+		opCnt     = 200
+	)
+
+	var (
+		idmu sync.Mutex
+		ids  []GameID
+	)
+	randomGame := func() GameID {
+		idmu.Lock()
+		defer idmu.Unlock()
+		if len(ids) == 0 {
+			return "100000"
+		}
+		return ids[randomI(len(ids), 0)]
+	}
 
-var TestLog TestLogger
+	clients := make([]*Client, clientCnt)
+	for i := range clients {
+		clients[i] = drainedClient(ClientID(fmt.Sprintf("%08d", 10000000+i)))
+	}
 
-func initLogger(t *testing.T) {
-	absPath, err := filepath.Abs("./log")
-	if err != nil {
-		t.Fatalf("Failed to init logger: %v", err)
+	wg := new(sync.WaitGroup)
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			for i := 0; i < opCnt; i++ {
+				switch randomI(6, 0) {
+				case 0:
+					if m.CreateNewGame(c, nil) == nil {
+						idmu.Lock()
+						ids = append(ids, c.GameID())
+						idmu.Unlock()
+					}
+				case 1:
+					m.JoinGame(c, randomGame(), nil)
+				case 2:
+					m.StartGame(c, c.GameID(), nil)
+				case 3:
+					m.Disconnect(c)
+				case 4:
+					if game, _ := c.Game(); game != nil {
+						game.send(attackPacket(c.clientID, attack(UnitThree, UnitOne, TeamTwo, "Slash")), c)
+					}
+				case 5:
+					// a different goroutine leaving for the same client,
+					// same as a dropped connection racing a leave packet
+					done := make(chan interface{})
+					go func() {
+						m.Disconnect(c)
+						close(done)
+					}()
+					m.JoinGame(c, randomGame(), nil)
+					<-done
+				}
+			}
+		}(c)
 	}
+	wg.Wait()
 
-	testLog, err := os.OpenFile(absPath+"/test-log.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o666)
-	if err != nil {
-		t.Fatalf("Failed to init logger: %v", err)
+	for _, c := range clients {
+		m.Disconnect(c)
 	}
 
-	TestLog.logger = log.New(testLog, "[Test Log] ", log.Ldate|log.Ltime|log.Lshortfile)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.games) != 0 {
+		t.Errorf("Expected every game to end once all clients left. %d still running", len(m.games))
+	}
 }
 
-const (
-	LOCAL_ADDR = "127.0.0.1:3000"
-)
-
-func TestServer(t *testing.T) {
-	initLogger(t)
-
-	server := NewTCPServer(LOCAL_ADDR)
+// TestServerStress does the same over real connections so the
+// handlers, framers and games all run on their own goroutines
+func TestServerStress(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	// dropped clients hold their seat until this runs out
+	hub.SetSessionGracePeriod(time.Millisecond * 50)
 	if err := server.Start(); err != nil {
-		t.Fatal(err.Error())
+		t.Fatal(err)
 	}
+	defer hub.Close()
+	defer server.Close()
 
-	errch := make(chan error)
-	defer close(errch)
-	go func() {
-		for err := range errch {
-			if err != nil {
-				TestLog.PrintErr(err)
-				t.Error(err.Error())
-			}
-		}
-	}()
+	const (
+		clientCnt = 20
+		opCnt     = 50
+	)
+
+	var (
+		idmu sync.Mutex
+		ids  []string
+	)
 
 	wg := new(sync.WaitGroup)
-	clients := []*Client{}
-	for i := 0; i < 10; i++ {
-		conn, err := net.Dial("tcp", LOCAL_ADDR)
+	for i := 0; i < clientCnt; i++ {
+		conn, err := net.Dial("tcp", server.ln.Addr().String())
 		if err != nil {
 			t.Fatal(err)
 		}
 		client := NewClient(conn)
-		clients = append(clients, client)
 
-		// TODO find a way to get a request that fails auth
 		framer := NewPacketFramer()
-		go FrameWithReader(framer, client.conn)
+		framed := make(chan struct{})
+		go func() {
+			FrameWithReader(framer, client.conn)
+			close(framed)
+		}()
 		if err := authenticate(framer.C, client); err != nil {
-			errch <- err
+			t.Fatal(err)
 		}
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := randomRequests(framer.C, client); err != nil {
-				errch <- err
+
+			// read loop keeps track of our id and any game we
+			// created so we have something to join and start.
+			// It runs until the connection is gone
+			idch := make(chan string, opCnt)
+			read := make(chan struct{})
+			go func() {
+				defer close(read)
+				for {
+					select {
+					case pkt := <-framer.C:
+						if pkt.Type() == PacketCreateGameSuccess {
+							select {
+							case idch <- string(pkt.Data()):
+							default:
+							}
+						}
+						pkt.Release()
+					case <-framer.errch:
+						return
+					}
+				}
+			}()
+			// nothing of this client outlives the test
+			defer func() {
+				client.Disconnect()
+				<-read
+				framer.Stop()
+				<-framed
+			}()
+
+			for j := 0; j < opCnt; j++ {
+				select {
+				case id := <-idch:
+					idmu.Lock()
+					ids = append(ids, id)
+					idmu.Unlock()
+				default:
+				}
+
+				idmu.Lock()
+				id := "100000"
+				if len(ids) != 0 {
+					id = ids[randomI(len(ids), 0)]
+				}
+				idmu.Unlock()
+
+				switch randomI(5, 0) {
+				case 0:
+					client.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+				case 1:
+					client.Write(ConstructPacket(EncString, PacketJoinGame, []byte(id)).data)
+				case 2:
+					client.Write(ConstructPacket(EncString, PacketStartGame, []byte(id)).data)
+				case 3:
+					client.Write(ConstructPacket(EncString, PacketLeaveGame, []byte{}).data)
+				case 4:
+					client.Write(attackPacket(client.clientID, attack(UnitThree, UnitOne, TeamTwo, "Slash")).data)
+				}
 			}
 		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		hub.gamemgr.mu.Lock()
+		n := len(hub.gamemgr.games)
+		hub.gamemgr.mu.Unlock()
 
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected every game to end once all clients disconnected. %d still running", n)
+		}
+		time.Sleep(time.Millisecond * 10)
 	}
+}
 
-	wg.Wait()
-	for _, c := range clients {
-		c.Disconnect()
+func dialClient(t *testing.T, addr string) (*Client, *PacketFramer) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
 	}
+	client := NewClient(conn)
 
-	server.Close()
-	TestLog.LogResults()
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, client.conn)
+	if err := authenticate(framer.C, client); err != nil {
+		t.Fatal(err)
+	}
+
+	return client, framer
 }
 
-func randomI(max, min int) int {
-	return rand.IntN(max-min) + min
+// startTestGame has a host create a game, a guest join
+// it and the host start it, draining everything up to the
+// first turn
+func startTestGame(t *testing.T, addr string) (host, guest *Client, hostFramer, guestFramer *PacketFramer) {
+	host, hostFramer = dialClient(t, addr)
+	guest, guestFramer = dialClient(t, addr)
+
+	host.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	pkt, err := expectPacket(hostFramer.C, PacketCreateGameSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guest.Write(ConstructPacket(EncString, PacketJoinGame, pkt.Data()).data)
+	if _, err := expectPacket(guestFramer.C, PacketJoinGameSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	host.Write(ConstructPacket(EncString, PacketStartGame, pkt.Data()).data)
+	for _, framer := range []*PacketFramer{hostFramer, guestFramer} {
+		if _, err := expectPacket(framer.C, PacketStartGameSuccess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := expectGameState(hostFramer.C, ATTACK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(guestFramer.C, DEFENSE); err != nil {
+		t.Fatal(err)
+	}
+
+	return host, guest, hostFramer, guestFramer
 }
 
-func randomRequests(C chan *Packet, c *Client) error {
-	req := requests[randomI(len(requests), 0)]
-	if err := req(C, c); err != nil {
-		return err
+func fullAttack(id ClientID, target TeamID) *Packet {
+	return attackPacket(id,
+		attack(UnitOne, UnitOne, target, "Dark Pulse"),
+		attack(UnitTwo, UnitOne, target, "Arcane Burst"),
+		attack(UnitThree, UnitOne, target, "Slash"),
+	)
+}
+
+func TestSessionResume(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+	addr := server.ln.Addr().String()
+
+	host, guest, hostFramer, _ := startTestGame(t, addr)
+	defer host.Disconnect()
+
+	// guest drops and misses the host's turn
+	guest.Disconnect()
+	time.Sleep(time.Millisecond * 50)
+
+	host.Write(fullAttack(host.clientID, TeamTwo).data)
+	if _, err := expectGameState(hostFramer.C, RESULT); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(hostFramer.C, DEFENSE); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed := NewClient(conn)
+	defer resumed.Disconnect()
+
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, resumed.conn)
+	if _, err := expectPacket(framer.C, PacketAuth); err != nil {
+		t.Fatal(err)
+	}
+	resumed.Write(ConstructPacket(EncString, PacketResume, []byte(guest.session)).data)
+
+	pkt, err := expectPacket(framer.C, PacketResumeSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info ResumeInfo
+	if err := json.Unmarshal(pkt.Data(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ClientID != guest.clientID || info.Team != TeamTwo {
+		t.Fatalf("Unexpected resume info %+v", info)
+	}
+
+	// missed broadcasts come back in order
+	if _, err := expectGameState(framer.C, RESULT); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(framer.C, ATTACK); err != nil {
+		t.Fatal(err)
+	}
+
+	// and the seat is ours to play
+	resumed.Write(fullAttack(guest.clientID, TeamOne).data)
+	if _, err := expectGameState(framer.C, RESULT); err != nil {
+		t.Fatal(err)
 	}
-	return nil
 }
 
-func authenticate(C chan *Packet, c *Client) error {
-	select {
-	case pkt := <-C:
-		c.Write(ConstructPacket(EncString, PacketAuth, pkt.Data()).data)
-	case <-time.After(time.Second * 5):
-		return ERROR_AUTH_TIMEOUT
+func TestSessionExpires(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	hub.SetSessionGracePeriod(time.Millisecond * 50)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
 	}
+	defer hub.Close()
+	defer server.Close()
+	addr := server.ln.Addr().String()
 
-	return nil
+	host, guest, hostFramer, _ := startTestGame(t, addr)
+	defer host.Disconnect()
+
+	guest.Disconnect()
+
+	// the seat is given up once the grace period runs out
+	pkt, err := expectGameState(hostFramer.C, RESULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res TurnResult
+	if err := json.Unmarshal(gameStateData(pkt.Data()), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != TeamOne {
+		t.Fatalf("Expected host to win by forfeit. Got winner %d", res.Winner)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	late := NewClient(conn)
+	defer late.Disconnect()
+
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, late.conn)
+	if _, err := expectPacket(framer.C, PacketAuth); err != nil {
+		t.Fatal(err)
+	}
+	late.Write(ConstructPacket(EncString, PacketResume, []byte(guest.session)).data)
+
+	if err := expectError(framer.C, ERROR_INVALID_SESSION); err != nil {
+		t.Fatal(err)
+	}
 }
 
-func sendHealthCheck(C chan *Packet, c *Client) error {
-	c.Write(ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data)
-	defer c.Disconnect()
-	TestLog.IncHQReq()
+func expectReplyError(t *testing.T, C chan *Packet, want error, id uint16, pktType PacketType) {
+	t.Helper()
 
-	select {
-	case pkt := <-C:
-		if pkt.Type() != PacketHealthCheckRes {
-			return ERROR_INVALID_HQ_RES
-		}
-	case <-time.After(time.Second * 5):
-		return ERROR_AUTH_TIMEOUT
+	pkt, err := expectPacket(C, PacketError)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	return nil
+	var got Error
+	if err := json.Unmarshal(pkt.Data(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Message != want.Error() || got.Code != errorToStatusCode(want) {
+		t.Fatalf("Expected %q. Got %+v", want, got)
+	}
+	if got.Request == nil || got.Request.ID != id || got.Request.Type != pktType {
+		t.Fatalf("Expected error for request %d of type %s. Got %+v", id, TypeToString(pktType), got.Request)
+	}
 }
 
-func sendPacketCreateGame(C chan *Packet, c *Client) error {
-	c.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
-	defer c.Disconnect()
-	TestLog.IncCGReq()
+func TestErrorCorrelation(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	hub.SetGameStateValidationFunc(validateGamePkt)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+
+	host, guest, hostFramer, guestFramer := startTestGame(t, server.ln.Addr().String())
+	defer host.Disconnect()
+	defer guest.Disconnect()
+
+	// the guest has sent auth and join so far
+	guest.Write(ConstructPacket(EncString, PacketJoinGame, []byte("nope")).data)
+	expectReplyError(t, guestFramer.C, ERROR_INVALID_GAME_JOIN_ATTEMPT, 3, PacketJoinGame)
+
+	// errors from inside the game come back to the sender only
+	guest.Write(fullAttack(guest.clientID, TeamOne).data)
+	expectReplyError(t, guestFramer.C, ERROR_INVALID_GAME_STATE, 4, PacketGameState)
+
+	// the host has sent auth, create and start
+	host.Write(attackPacket(host.clientID, attack(UnitOne, UnitOne, TeamOne, "Dark Pulse")).data)
+	expectReplyError(t, hostFramer.C, ERROR_INVALID_ATTACK, 4, PacketGameState)
 
 	select {
-	case pkt := <-C:
-		if pkt.Type() != PacketCreateGameSuccess {
-			return ERROR_INVALID_CREATE_GAME_ATTEMPT
-		}
+	case pkt := <-guestFramer.C:
+		t.Fatalf("Expected nothing for the guest. Got %s with data %s", TypeToString(pkt.Type()), pkt.Data())
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestProtocolV2Correlation(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(conn)
+	defer client.Disconnect()
 
-		if !isValidID(string(pkt.Data())) {
-			return constructError("Invalid game id of val %s", string(pkt.Data()))
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, client.conn)
+
+	// the challenge always goes out as v1
+	pkt, err := expectPacket(framer.C, PacketAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(ConstructPacketV2(EncString, PacketAuth, 100, pkt.Data()).data)
+
+	expect := func(pktType PacketType, seq uint16) *Packet {
+		t.Helper()
+		pkt, err := expectPacket(framer.C, pktType)
+		if err != nil {
+			t.Fatal(err)
 		}
-	case <-time.After(time.Second * 5):
-		return ERROR_SERVER_TIMEOUT
+		if pkt.Version() != VERSION_2 || pkt.Seq() != seq {
+			t.Fatalf("Expected v2 reply to %d. Got v%d reply to %d", seq, pkt.Version(), pkt.Seq())
+		}
+		return pkt
 	}
 
-	return nil
-}
+	expect(PacketSessionToken, 100)
 
-func sendTwoCreateGameRequests(C chan *Packet, c *Client) error {
-	c.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
-	defer c.Disconnect()
-	TestLog.IncTwoCGReq()
+	client.Write(ConstructPacketV2(EncString, PacketCreateGame, 101, []byte{}).data)
+	expect(PacketCreateGameSuccess, 101)
 
-	select {
-	case pkt := <-C:
-		if pkt.Type() != PacketCreateGameSuccess {
-			return ERROR_INVALID_CREATE_GAME_ATTEMPT
+	client.Write(ConstructPacketV2(EncString, PacketJoinGame, 102, []byte("123456")).data)
+	pkt = expect(PacketError, 102)
+
+	var e Error
+	if err := json.Unmarshal(pkt.Data(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Request == nil || e.Request.ID != 102 || e.Request.Type != PacketJoinGame {
+		t.Fatalf("Expected error for request 102. Got %+v", e.Request)
+	}
+
+	// v1 packets are still understood mid stream
+	client.Write(ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data)
+	expect(PacketHealthCheckRes, 4)
+}
+
+// expectClosed waits for the server to close the connection
+// behind framer, skipping anything still in flight
+func expectClosed(t *testing.T, framer *PacketFramer) {
+	t.Helper()
+
+	for {
+		select {
+		case <-framer.C:
+		case <-framer.errch:
+			return
+		case <-time.After(time.Second * 5):
+			t.Fatal("Expected connection to be closed")
 		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := server.ln.Addr().String()
+
+	host, guest, hostFramer, guestFramer := startTestGame(t, addr)
+	defer host.Disconnect()
+	defer guest.Disconnect()
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		server.Close()
+		done <- hub.Shutdown(ctx)
+	}()
 
-		if !isValidID(string(pkt.Data())) {
-			return constructError("Invalid game id of val %s", string(pkt.Data()))
+	for _, framer := range []*PacketFramer{hostFramer, guestFramer} {
+		if _, err := expectPacket(framer.C, PacketServerShutdown); err != nil {
+			t.Fatal(err)
 		}
-	case <-time.After(time.Second * 5):
-		return ERROR_SERVER_TIMEOUT
 	}
 
-	c.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatal("Expected listener to be closed")
+	}
+
+	// the turn in progress still gets resolved
+	host.Write(fullAttack(host.clientID, TeamTwo).data)
+	if _, err := expectGameState(guestFramer.C, RESULT); err != nil {
+		t.Fatal(err)
+	}
+
+	expectClosed(t, hostFramer)
+	expectClosed(t, guestFramer)
+
 	select {
-	case pkt := <-C:
-		if pkt.Type() != PacketError {
-			return constructError("Expected PacketError. Got %s", TypeToString(pkt.Type()))
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected clean shutdown. Got %v", err)
 		}
 	case <-time.After(time.Second * 5):
-		return ERROR_SERVER_TIMEOUT
+		t.Fatal(ERROR_SERVER_TIMEOUT)
 	}
-	return nil
 }
 
-func sendInvalidPacketJoinGame(C chan *Packet, c *Client) error {
-	c.Write(ConstructPacket(EncBytes, PacketJoinGame, []byte("12345678")).data)
-	defer c.Disconnect()
-	TestLog.IncInvJGReq()
+func TestServerShutdownDeadline(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
 
-	select {
-	case pkt := <-C:
-		if pkt.Type() == PacketCreateGameSuccess {
-			return ERROR_INVALID_CREATE_GAME_ATTEMPT
+	host, guest, hostFramer, guestFramer := startTestGame(t, server.ln.Addr().String())
+	defer host.Disconnect()
+	defer guest.Disconnect()
+
+	// nobody attacks so the game is stopped at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	server.Close()
+	if err := hub.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v. Got %v", context.DeadlineExceeded, err)
+	}
+
+	if _, err := expectPacket(hostFramer.C, PacketServerShutdown); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, hostFramer)
+	expectClosed(t, guestFramer)
+
+	if n := len(hub.gamemgr.running()); n != 0 {
+		t.Fatalf("Expected every game to be stopped. %d still running", n)
+	}
+}
+
+func TestServerFramerPolicy(t *testing.T) {
+	for _, policy := range []FramerPolicy{PolicyResync, PolicyDisconnect} {
+		hub := NewHub()
+		server := NewTCPServer("127.0.0.1:0", hub)
+		hub.SetFramerPolicy(policy)
+		if err := server.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		client, framer := dialClient(t, server.ln.Addr().String())
+
+		garbage := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+		health := ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data
+		client.Write(append(garbage, health...))
+
+		if err := expectError(framer.C, ERROR_VERSION_MISMATCH); err != nil {
+			t.Fatal(err)
 		}
 
-		if pkt.Type() != PacketError {
-			return constructError("Wanted PacketJoinGameFailure. Got %v", TypeToString(pkt.Type()))
+		switch policy {
+		case PolicyResync:
+			if _, err := expectPacket(framer.C, PacketHealthCheckRes); err != nil {
+				t.Fatal(err)
+			}
+		case PolicyDisconnect:
+			expectClosed(t, framer)
 		}
 
+		client.Disconnect()
+		server.Close()
+		hub.Close()
+	}
+}
+
+func randomI(max, min int) int {
+	return rand.IntN(max-min) + min
+}
+
+func authenticate(C chan *Packet, c *Client) error {
+	select {
+	case pkt := <-C:
+		c.clientID = ClientID(pkt.Data())
+		c.Write(ConstructPacket(EncString, PacketAuth, pkt.Data()).data)
 	case <-time.After(time.Second * 5):
-		return ERROR_SERVER_TIMEOUT
+		return ERROR_AUTH_TIMEOUT
 	}
 
+	pkt, err := expectPacket(C, PacketSessionToken)
+	if err != nil {
+		return err
+	}
+	c.session = string(pkt.Data())
+
 	return nil
 }
 
@@ -262,11 +706,6 @@ func isValidID(id string) bool {
 	return re.MatchString(id)
 }
 
-func constructError(err string, v ...interface{}) error {
-	str := fmt.Sprintf(err, v...)
-	return errors.New(str)
-}
-
 // const (
 // 	PacketAuth PacketType = iota // outbound
 // 	PacketHealthCheckReq
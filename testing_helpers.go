@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
 )
 
 // const (
@@ -68,3 +77,123 @@ func newEncodedString(message string) []byte {
 
 	return buf.Bytes()
 }
+
+// dialWS opens a client side websocket to a WSServer so tests
+// can speak the packet protocol the same way a browser would
+func dialWS(addr, path string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	encKey := base64.StdEncoding.EncodeToString(key)
+
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + encKey + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("Websocket upgrade failed with status %s", res.Status)
+	}
+
+	if res.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(encKey) {
+		conn.Close()
+		return nil, ERROR_WS_PROTOCOL
+	}
+
+	return newWSConn(conn, br, true), nil
+}
+
+// pipeClient returns a server side client backed by net.Pipe and
+// a framer reading everything the server writes to it
+func pipeClient(id ClientID) (*Client, *PacketFramer) {
+	server, remote := net.Pipe()
+	client := NewClient(server)
+	client.clientID = id
+
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, remote)
+
+	return client, framer
+}
+
+// expectPacket waits for the next packet and checks its type
+func expectPacket(C chan *Packet, t PacketType) (*Packet, error) {
+	select {
+	case pkt := <-C:
+		if pkt.Type() != t {
+			return nil, fmt.Errorf("Expected %s. Got %s with data %s", TypeToString(t), TypeToString(pkt.Type()), pkt.Data())
+		}
+		return pkt, nil
+	case <-time.After(time.Second * 5):
+		return nil, ERROR_SERVER_TIMEOUT
+	}
+}
+
+// expectGameState waits for a game state packet of type gs
+func expectGameState(C chan *Packet, gs GameState) (*Packet, error) {
+	select {
+	case pkt := <-C:
+		if pkt.Type() != PacketGameState {
+			return nil, fmt.Errorf("Expected PacketGameState. Got %s with data %s", TypeToString(pkt.Type()), pkt.Data())
+		}
+		if gameState(pkt.Data()) != gs {
+			return nil, fmt.Errorf("Expected game state %s. Got %s", GameStateToString(gs), GameStateToString(gameState(pkt.Data())))
+		}
+		return pkt, nil
+	case <-time.After(time.Second * 5):
+		return nil, ERROR_SERVER_TIMEOUT
+	}
+}
+
+// expectError waits for an error packet carrying want
+func expectError(C chan *Packet, want error) error {
+	pkt, err := expectPacket(C, PacketError)
+	if err != nil {
+		return err
+	}
+
+	var got Error
+	if err := json.Unmarshal(pkt.Data(), &got); err != nil {
+		return err
+	}
+	if got.Message != want.Error() {
+		return fmt.Errorf("Expected error %q. Got %q", want, got.Message)
+	}
+	return nil
+}
+
+func attackPacket(id ClientID, attacks ...Attack) *Packet {
+	data, _ := json.Marshal(attacks)
+	pkt := ConstructGameStatePacket(ATTACK, id, data)
+	return &pkt
+}
+
+// drainedClient returns a server side client whose
+// peer throws away everything written to it
+func drainedClient(id ClientID) *Client {
+	server, remote := net.Pipe()
+	client := NewClient(server)
+	client.clientID = id
+
+	go io.Copy(io.Discard, remote)
+
+	return client
+}
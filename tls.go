@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// ClientCertMapper decides which ClientID a verified client
+// certificate belongs to
+type ClientCertMapper func(cert *x509.Certificate) (ClientID, error)
+
+// CommonNameID maps a client certificate to its common name,
+// which has to be a ClientID like any a token would carry
+func CommonNameID(cert *x509.Certificate) (ClientID, error) {
+	id := ClientID(cert.Subject.CommonName)
+	if !validClientID(id) {
+		return "", ERROR_INVALID_AUTH_ID
+	}
+	return id, nil
+}
+
+// SetTLS serves TLS with the certificate and key in certFile and
+// keyFile. Has to be called before Start
+func (t *TCPServer) SetTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	t.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	return nil
+}
+
+// SetTLSConfig serves TLS with cfg as is. Has to be called before Start
+func (t *TCPServer) SetTLSConfig(cfg *tls.Config) {
+	t.tlsConfig = cfg
+}
+
+// SetClientCertAuth asks TLS clients for a certificate signed by one
+// of the CAs in caFile. A client that presents one is authenticated
+// by it, mapID picks its ClientID and the credential it answers the
+// challenge with is ignored. Clients without one still go through
+// the Authenticator. mapID defaults to CommonNameID. Has to be called
+// after SetTLS or SetTLSConfig
+func (t *TCPServer) SetClientCertAuth(caFile string, mapID ClientCertMapper) error {
+	if t.tlsConfig == nil {
+		return errors.New("client certificates need TLS, call SetTLS first")
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("client CA file has no usable certificates")
+	}
+
+	if mapID == nil {
+		mapID = CommonNameID
+	}
+
+	t.tlsConfig.ClientCAs = pool
+	t.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	t.hub.certID = mapID
+	return nil
+}
+
+// listen opens the listener Start accepts on, wrapped
+// in TLS if it has been configured
+func (t *TCPServer) listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.tlsConfig != nil {
+		ln = tls.NewListener(ln, t.tlsConfig)
+	}
+	return ln, nil
+}
+
+// connectionStater is a Conn that went through a TLS handshake
+type connectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// certClientID returns the ClientID of the verified client
+// certificate on conn. ok is false if there isn't one
+func (h *Hub) certClientID(conn Conn) (ClientID, bool, error) {
+	tlsConn, isTLS := conn.(connectionStater)
+	if !isTLS || h.certID == nil {
+		return "", false, nil
+	}
+
+	// the handshake is long done by the time the client answered
+	// the challenge, VerifiedChains is only set for certificates
+	// that checked out against ClientCAs
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", false, nil
+	}
+
+	id, err := h.certID(state.VerifiedChains[0][0])
+	if err != nil {
+		return "", false, err
+	}
+	return id, true, nil
+}
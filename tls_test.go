@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority for the test
+// suite, nothing in here is ever written outside of TempDir
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tcp_server test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	cert, key, certPEM, _ := createCert(t, template, nil, nil)
+	return &testCA{cert: cert, key: key, pem: certPEM}
+}
+
+// issue signs a leaf certificate for cn. Server certificates
+// are good for 127.0.0.1, client ones for client auth
+func (ca *testCA) issue(t *testing.T, cn string, server bool) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	_, _, certPEM, keyPEM = createCert(t, template, ca.cert, ca.key)
+	return certPEM, keyPEM
+}
+
+// createCert signs template with parent, self signed if parent is nil
+func createCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, key, certPEM, keyPEM
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startTLSServer starts a server with a certificate from ca,
+// client certificates from ca are accepted if clientAuth is set
+func startTLSServer(t *testing.T, ca *testCA, clientAuth bool) *TCPServer {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, "127.0.0.1", true)
+
+	server := NewTCPServer("127.0.0.1:0", NewHub())
+	if err := server.SetTLS(writeFile(t, "server.pem", certPEM), writeFile(t, "server.key", keyPEM)); err != nil {
+		t.Fatal(err)
+	}
+	if clientAuth {
+		if err := server.SetClientCertAuth(writeFile(t, "ca.pem", ca.pem), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// dialTLS connects to server trusting ca, presenting cert if there is one
+func dialTLS(t *testing.T, server *TCPServer, ca *testCA, cert *tls.Certificate) (*Client, *PacketFramer) {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+
+	conn, err := tls.Dial("tcp", server.ln.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(conn)
+
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, client.conn)
+	return client, framer
+}
+
+// serverSideID is the ClientID the server gave the connection behind client
+func serverSideID(server *TCPServer, client *Client) ClientID {
+	server.hub.mu.Lock()
+	defer server.hub.mu.Unlock()
+
+	for _, c := range server.hub.clients {
+		if c.Addr().String() == client.conn.(net.Conn).LocalAddr().String() {
+			return c.clientID
+		}
+	}
+	return ""
+}
+
+func TestTLSServer(t *testing.T) {
+	ca := newTestCA(t)
+	server := startTLSServer(t, ca, false)
+	defer server.hub.Close()
+	defer server.Close()
+
+	client, framer := dialTLS(t, server, ca, nil)
+	defer client.Disconnect()
+
+	challenge, err := expectPacket(framer.C, PacketAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(ConstructPacket(EncString, PacketAuth, challenge.Data()).data)
+	if _, err := expectPacket(framer.C, PacketSessionToken); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Write(ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data)
+	if _, err := expectPacket(framer.C, PacketHealthCheckRes); err != nil {
+		t.Fatal(err)
+	}
+
+	// cleartext clients never get as far as a challenge. Two
+	// packets so there is a whole TLS record header to reject
+	conn, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	plain := NewPacketFramer()
+	go FrameWithReader(plain, conn)
+	health := ConstructPacket(EncString, PacketHealthCheckReq, []byte{}).data
+	conn.Write(append(health, health...))
+	select {
+	case pkt := <-plain.C:
+		t.Fatalf("Expected nothing over cleartext. Got %s", TypeToString(pkt.Type()))
+	case <-plain.errch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected cleartext connection to be closed")
+	}
+}
+
+func TestTLSClientCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+	server := startTLSServer(t, ca, true)
+	defer server.hub.Close()
+	defer server.Close()
+
+	certPEM, keyPEM := ca.issue(t, "10000042", false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate is the credential, whatever comes back
+	// in answer to the challenge doesn't matter
+	client, framer := dialTLS(t, server, ca, &cert)
+	defer client.Disconnect()
+
+	if _, err := expectPacket(framer.C, PacketAuth); err != nil {
+		t.Fatal(err)
+	}
+	client.Write(ConstructPacket(EncString, PacketAuth, []byte("not the challenge")).data)
+	if _, err := expectPacket(framer.C, PacketSessionToken); err != nil {
+		t.Fatal(err)
+	}
+	if id := serverSideID(server, client); id != "10000042" {
+		t.Fatalf("Expected ClientID 10000042 from the certificate. Got %q", id)
+	}
+
+	// no certificate and it's up to the Authenticator
+	anon, anonFramer := dialTLS(t, server, ca, nil)
+	defer anon.Disconnect()
+
+	if _, err := expectPacket(anonFramer.C, PacketAuth); err != nil {
+		t.Fatal(err)
+	}
+	anon.Write(ConstructPacket(EncString, PacketAuth, []byte("not the challenge")).data)
+	if err := expectError(anonFramer.C, ERROR_INVALID_AUTH_ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// a certificate from the CA whose common name isn't a ClientID
+	certPEM, keyPEM = ca.issue(t, "admin", false)
+	odd, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	misnamed, misnamedFramer := dialTLS(t, server, ca, &odd)
+	defer misnamed.Disconnect()
+
+	if _, err := expectPacket(misnamedFramer.C, PacketAuth); err != nil {
+		t.Fatal(err)
+	}
+	misnamed.Write(ConstructPacket(EncString, PacketAuth, []byte("not the challenge")).data)
+	if err := expectError(misnamedFramer.C, ERROR_INVALID_AUTH_ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// and a certificate from anyone else doesn't get through the handshake
+	other := newTestCA(t)
+	certPEM, keyPEM = other.issue(t, "10000043", false)
+	forged, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imposter, imposterFramer := dialTLS(t, server, ca, &forged)
+	defer imposter.Disconnect()
+
+	select {
+	case pkt := <-imposterFramer.C:
+		t.Fatalf("Expected the handshake to fail. Got %s", TypeToString(pkt.Type()))
+	case <-imposterFramer.errch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected the handshake to fail")
+	}
+}
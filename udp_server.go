@@ -0,0 +1,582 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// UDPServer carries game state for clients that already have a TCP
+// session, trading TCP's head of line blocking for a few lost
+// packets. Every datagram is a single v2 packet whose seq is the
+// sender's own datagram counter, not a request ID
+//
+// A client binds its UDP endpoint by sending PacketBind with a bind
+// token it asked for over TCP with PacketBindToken. The bind token
+// goes out in the clear, so it is good for binding and nothing
+// else, it can't resume the session. From then on the
+// PacketGameState it sends over UDP is handled as if it came over
+// TCP, and the game state it is sent goes out over UDP instead
+//
+// Datagrams aren't authenticated one by one. Whatever comes from a
+// bound source address is trusted to be from its client, anyone
+// able to send from that address can play as them
+//
+// Game state is reliable: each one is acknowledged with a PacketAck
+// carrying its seq and is resent until it is. Everything else is
+// fire and forget, and dropped if something newer got there first
+//
+// Every endpoint has its packets handled on a goroutine of its own,
+// a game that is slow to take them only ever holds up its own
+// players. Game state that finds the endpoint's queue full is
+// dropped without an ack and left for the client to resend
+type UDPServer struct {
+	addr string
+	hub  *Hub
+	conn *net.UDPConn
+
+	mu        sync.Mutex
+	endpoints map[string]*udpEndpoint
+
+	quitch    chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+const (
+	// how long a reliable packet waits on its ack before it is resent
+	UDP_RESEND_INTERVAL = time.Millisecond * 100
+	// resends before giving up on UDP and falling back to TCP
+	UDP_MAX_RESENDS = 10
+	// how far behind the newest seq a datagram can be and still
+	// be told apart from a duplicate
+	UDP_WINDOW = 64
+	// packets an endpoint can have waiting on its handlers
+	// before game state is dropped unacked
+	UDP_QUEUE_SIZE = 16
+)
+
+// reliableOverUDP is the set of packet types that are
+// acknowledged and resent, and the only ones handled
+// when they come in over UDP
+func reliableOverUDP(t PacketType) bool {
+	return t == PacketGameState
+}
+
+func NewUDPServer(addr string, hub *Hub) *UDPServer {
+	return &UDPServer{
+		addr:      addr,
+		hub:       hub,
+		endpoints: make(map[string]*udpEndpoint),
+		quitch:    make(chan struct{}),
+	}
+}
+
+func (u *UDPServer) Start() error {
+	laddr, err := net.ResolveUDPAddr("udp", u.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	u.conn = conn
+
+	u.wg.Add(2)
+	go u.readLoop()
+	go u.resendLoop()
+
+	log.Printf("UDP server listening on %s", u.addr)
+
+	return nil
+}
+
+func (u *UDPServer) Close() error {
+	err := u.conn.Close()
+	u.closeOnce.Do(func() { close(u.quitch) })
+	u.wg.Wait()
+
+	u.mu.Lock()
+	eps := u.endpoints
+	u.endpoints = make(map[string]*udpEndpoint)
+	u.mu.Unlock()
+
+	// whatever was still in flight goes over TCP instead
+	for _, ep := range eps {
+		if ep.client.unbindUDP(ep) {
+			ep.fallback()
+		}
+	}
+	return err
+}
+
+func (u *UDPServer) readLoop() {
+	defer u.wg.Done()
+
+	buf := make([]byte, PACKET_MAX_SIZE)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("UDP read error: %s", err)
+			continue
+		}
+
+		pkt, err := parseDatagram(buf[:n])
+		if err != nil {
+			log.Printf("Dropping datagram from %s: %s", addr, err)
+			continue
+		}
+		u.handle(pkt, addr)
+	}
+}
+
+// parseDatagram checks data holds exactly one v2 packet
+// and returns a pooled copy of it, inflated if need be
+func parseDatagram(data []byte) (*Packet, error) {
+	if len(data) < PACKET_HEADER_SIZE_V2 || data[0] != VERSION_2 {
+		return nil, ERROR_VERSION_MISMATCH
+	}
+	if int(getPacketLength(data))+PACKET_HEADER_SIZE_V2 != len(data) {
+		return nil, ERROR_PACKET_LENGTH_MISMATCH
+	}
+
+	pkt := AcquirePacket(len(data))
+	copy(pkt.data, data)
+	if pkt.Flags()&FLAG_COMPRESSED != 0 {
+		return inflate(pkt)
+	}
+	return pkt, nil
+}
+
+func (u *UDPServer) handle(pkt *Packet, addr *net.UDPAddr) {
+	defer pkt.Release()
+
+	// nothing is sent back to a source that hasn't shown a session
+	// token. addr is whatever the datagram claims, answering it
+	// would make the server a reflector for spoofed traffic
+	if pkt.Type() == PacketBind {
+		if err := u.bind(pkt, addr); err != nil {
+			log.Printf("UDP bind from %s failed: %s", addr, err)
+		}
+		return
+	}
+
+	u.mu.Lock()
+	ep := u.endpoints[addr.String()]
+	u.mu.Unlock()
+	if ep == nil {
+		return
+	}
+	ep.client.alive()
+
+	if pkt.Type() == PacketAck {
+		ep.acked(pkt.Seq())
+		return
+	}
+
+	reliable := reliableOverUDP(pkt.Type())
+	// only the read loop adds to inq, there is
+	// still room once it has been checked for
+	if reliable && len(ep.inq) == cap(ep.inq) {
+		return
+	}
+
+	fresh, newest := ep.receive(pkt.Seq())
+	if reliable {
+		// acked even if it is a duplicate, the
+		// first ack might be what got lost
+		u.writeTo(addr, ConstructPacket(EncBytes, PacketAck, []byte{}), pkt.Seq())
+	}
+	if !fresh || (!reliable && !newest) {
+		return
+	}
+
+	if !reliable {
+		ep.write(ConstructReplyErrorPacket(ERROR_NO_HANDLER_REGISTERED, pkt))
+		return
+	}
+	pkt.Retain()
+	ep.inq <- pkt
+}
+
+// bind ties addr to the client behind the bind token in pkt.
+// A client binding again, say from behind a NAT that picked a new
+// port, replaces its old endpoint
+func (u *UDPServer) bind(pkt *Packet, addr *net.UDPAddr) error {
+	msg, err := DecodeBind(pkt)
+	if err != nil {
+		return err
+	}
+	client, ok := u.hub.sessions.LookupBind(msg.Token)
+	if !ok {
+		return ERROR_INVALID_SESSION
+	}
+
+	ep := &udpEndpoint{
+		srv:     u,
+		addr:    addr,
+		client:  client,
+		pending: make(map[uint16]*unacked),
+		inq:     make(chan *Packet, UDP_QUEUE_SIZE),
+		quit:    make(chan struct{}),
+	}
+	u.wg.Add(1)
+	go ep.handleLoop()
+
+	u.mu.Lock()
+	taken := u.endpoints[addr.String()]
+	u.endpoints[addr.String()] = ep
+	u.mu.Unlock()
+
+	if taken != nil {
+		taken.stop()
+		if taken.client.unbindUDP(taken) {
+			taken.fallback()
+		}
+	}
+	if old := client.bindUDP(ep); old != nil {
+		u.forget(old)
+	}
+
+	ep.write(ConstructPacket(EncBytes, PacketBindSuccess, []byte{}))
+	log.Printf("Bound UDP endpoint %s to client %s", addr, client.Id())
+
+	return nil
+}
+
+// forget removes ep and hands whatever it still had in flight
+// back to TCP. The client has to be unbound from it already
+func (u *UDPServer) forget(ep *udpEndpoint) {
+	u.remove(ep)
+	ep.fallback()
+}
+
+// remove takes ep out of the endpoints, unless
+// its address has been bound again since
+func (u *UDPServer) remove(ep *udpEndpoint) {
+	ep.stop()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.endpoints[ep.addr.String()] == ep {
+		delete(u.endpoints, ep.addr.String())
+	}
+}
+
+// writeTo sends pkt to addr as a v2 datagram stamped with seq
+func (u *UDPServer) writeTo(addr *net.UDPAddr, pkt Packet, seq uint16) {
+	if _, err := u.conn.WriteToUDP(Reframe(pkt.data, VERSION_2, seq), addr); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("UDP write to %s failed: %s", addr, err)
+	}
+}
+
+// resendLoop resends reliable packets that haven't been acked
+func (u *UDPServer) resendLoop() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(UDP_RESEND_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			u.mu.Lock()
+			eps := make([]*udpEndpoint, 0, len(u.endpoints))
+			for _, ep := range u.endpoints {
+				eps = append(eps, ep)
+			}
+			u.mu.Unlock()
+
+			for _, ep := range eps {
+				if !ep.resend(now) && ep.client.unbindUDP(ep) {
+					log.Printf("UDP endpoint %s stopped acking, client %s is back on TCP", ep.addr, ep.client.Id())
+					u.forget(ep)
+				}
+			}
+		case <-u.quitch:
+			return
+		}
+	}
+}
+
+// udpEndpoint is a bound client on the other end of the UDPServer
+type udpEndpoint struct {
+	srv    *UDPServer
+	addr   *net.UDPAddr
+	client *Client
+
+	mu      sync.Mutex
+	seq     uint16
+	window  seqWindow
+	pending map[uint16]*unacked
+
+	// packets waiting on handleLoop, closing quit stops it
+	inq      chan *Packet
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// unacked is a reliable packet waiting on its ack. orig is what
+// was queued up for the client, kept to fall back to TCP with
+type unacked struct {
+	orig  outbound
+	dgram *Packet
+	sent  time.Time
+	tries int
+}
+
+// handleLoop runs the handlers for the packets on inq
+func (ep *udpEndpoint) handleLoop() {
+	defer ep.srv.wg.Done()
+
+	for {
+		select {
+		case pkt := <-ep.inq:
+			ep.dispatch(pkt)
+			pkt.Release()
+		case <-ep.quit:
+			ep.drain()
+			return
+		case <-ep.srv.quitch:
+			ep.drain()
+			return
+		}
+	}
+}
+
+func (ep *udpEndpoint) dispatch(pkt *Packet) {
+	handler, ok := ep.srv.hub.handlers[pkt.Type()]
+	if !ok {
+		ep.write(ConstructReplyErrorPacket(ERROR_NO_HANDLER_REGISTERED, pkt))
+		return
+	}
+	if err := handler(pkt, ep.client); err != nil {
+		log.Println(err)
+		ep.write(ConstructReplyErrorPacket(err, pkt))
+	}
+}
+
+// drain releases whatever was left on inq
+func (ep *udpEndpoint) drain() {
+	for {
+		select {
+		case pkt := <-ep.inq:
+			pkt.Release()
+		default:
+			return
+		}
+	}
+}
+
+// stop ends handleLoop once the packet it is on is handled
+func (ep *udpEndpoint) stop() {
+	ep.quitOnce.Do(func() { close(ep.quit) })
+}
+
+// receive runs seq through the replay window
+func (ep *udpEndpoint) receive(seq uint16) (fresh, newest bool) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.window.accept(seq)
+}
+
+// write sends pkt once, no questions asked
+func (ep *udpEndpoint) write(pkt Packet) {
+	ep.mu.Lock()
+	ep.seq++
+	seq := ep.seq
+	ep.mu.Unlock()
+
+	ep.srv.writeTo(ep.addr, pkt, seq)
+}
+
+// sendReliable sends out and keeps it around until it is acked,
+// taking a reference of its own. Returns false if it doesn't fit
+// a datagram and has to go over TCP
+func (ep *udpEndpoint) sendReliable(out outbound, compress bool) bool {
+	pkt := out.pkt
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	seq := ep.seq + 1
+	var dgram *Packet
+	if compress {
+		dgram = compressPooled(pkt, seq)
+	}
+	if dgram == nil {
+		dgram = reframePooled(pkt, VERSION_2, seq)
+	}
+	if dgram.len > PACKET_MAX_SIZE {
+		dgram.Release()
+		return false
+	}
+
+	ep.seq = seq
+	pkt.Retain()
+	ep.pending[seq] = &unacked{orig: out, dgram: dgram, sent: time.Now()}
+
+	// under mu so an ack can't put dgram back in the pool mid write
+	ep.srv.conn.WriteToUDP(dgram.data, ep.addr)
+	return true
+}
+
+func (ep *udpEndpoint) acked(seq uint16) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if u, ok := ep.pending[seq]; ok {
+		u.orig.pkt.Release()
+		u.dgram.Release()
+		delete(ep.pending, seq)
+	}
+}
+
+// resend sends everything that has waited too long on
+// its ack again, oldest first. Returns false once something has been
+// resent UDP_MAX_RESENDS times without an ack
+func (ep *udpEndpoint) resend(now time.Time) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	for _, seq := range sortedSeqs(ep.pending) {
+		u := ep.pending[seq]
+		if now.Sub(u.sent) < UDP_RESEND_INTERVAL {
+			continue
+		}
+		if u.tries == UDP_MAX_RESENDS {
+			return false
+		}
+		u.tries++
+		u.sent = now
+		ep.srv.conn.WriteToUDP(u.dgram.data, ep.addr)
+	}
+	return true
+}
+
+// fallback queues everything still waiting on an ack up on TCP,
+// in the order it was sent. The client has to be unbound first
+// or it all comes right back
+func (ep *udpEndpoint) fallback() {
+	ep.mu.Lock()
+	pending := ep.pending
+	ep.pending = make(map[uint16]*unacked)
+	ep.mu.Unlock()
+
+	for _, seq := range sortedSeqs(pending) {
+		pending[seq].dgram.Release()
+		ep.client.enqueue(pending[seq].orig.pkt, pending[seq].orig.seq)
+	}
+}
+
+// drop releases everything still waiting on an ack
+func (ep *udpEndpoint) drop() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	for seq, u := range ep.pending {
+		u.orig.pkt.Release()
+		u.dgram.Release()
+		delete(ep.pending, seq)
+	}
+}
+
+// sortedSeqs returns the seqs in pending oldest first
+func sortedSeqs(pending map[uint16]*unacked) []uint16 {
+	seqs := make([]uint16, 0, len(pending))
+	for seq := range pending {
+		seqs = append(seqs, seq)
+	}
+	slices.SortFunc(seqs, func(a, b uint16) int {
+		return int(int16(a - b))
+	})
+	return seqs
+}
+
+// bindUDP sends the client's game state over ep from
+// now on. Returns the endpoint it replaces, if any
+func (c *Client) bindUDP(ep *udpEndpoint) *udpEndpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.udp
+	c.udp = ep
+	return old
+}
+
+// unbindUDP puts the client back on TCP if ep is still
+// its endpoint. Returns false if it isn't
+func (c *Client) unbindUDP(ep *udpEndpoint) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.udp != ep {
+		return false
+	}
+	c.udp = nil
+	return true
+}
+
+// closeUDP unbinds the client from UDP for good, once
+// its session is gone. Anything in flight is dropped
+func (c *Client) closeUDP() {
+	c.mu.Lock()
+	ep := c.udp
+	c.udp = nil
+	c.mu.Unlock()
+
+	if ep != nil {
+		ep.srv.remove(ep)
+		ep.drop()
+	}
+}
+
+// seqWindow remembers which of the last UDP_WINDOW sequence
+// numbers have been received. Sequence numbers wrap, anything
+// up to half the uint16 range ahead counts as newer
+type seqWindow struct {
+	started bool
+	highest uint16
+	// bit i is set if highest-i has been received
+	seen uint64
+}
+
+// accept marks seq as received. fresh is false for duplicates and
+// for anything too far behind to tell, newest is true if seq is
+// ahead of everything received before it
+func (w *seqWindow) accept(seq uint16) (fresh, newest bool) {
+	if !w.started {
+		w.started, w.highest, w.seen = true, seq, 1
+		return true, true
+	}
+
+	diff := int(int16(seq - w.highest))
+	switch {
+	case diff > 0:
+		if diff >= UDP_WINDOW {
+			w.seen = 0
+		} else {
+			w.seen <<= uint(diff)
+		}
+		w.seen |= 1
+		w.highest = seq
+		return true, true
+	case -diff >= UDP_WINDOW:
+		return false, false
+	}
+
+	bit := uint64(1) << uint(-diff)
+	if w.seen&bit != 0 {
+		return false, false
+	}
+	w.seen |= bit
+	return true, false
+}
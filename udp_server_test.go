@@ -0,0 +1,377 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSeqWindow(t *testing.T) {
+	var w seqWindow
+
+	steps := []struct {
+		seq           uint16
+		fresh, newest bool
+	}{
+		{1, true, true},
+		{2, true, true},
+		{2, false, false},
+		{5, true, true},
+		{3, true, false},
+		{3, false, false},
+		{1, false, false},
+		{5 + UDP_WINDOW, true, true},
+		// too far behind to tell it from a duplicate
+		{5, false, false},
+		{65535, false, false},
+	}
+	for i, s := range steps {
+		fresh, newest := w.accept(s.seq)
+		if fresh != s.fresh || newest != s.newest {
+			t.Errorf("step %d: seq %d expected fresh %t newest %t. Got %t %t", i, s.seq, s.fresh, s.newest, fresh, newest)
+		}
+	}
+
+	// sequence numbers wrap
+	w = seqWindow{}
+	for _, seq := range []uint16{65534, 65535, 0, 1} {
+		if fresh, newest := w.accept(seq); !fresh || !newest {
+			t.Fatalf("Expected %d to be newest across the wrap", seq)
+		}
+	}
+	if fresh, _ := w.accept(65535); fresh {
+		t.Fatal("Expected 65535 to be a duplicate after the wrap")
+	}
+}
+
+// udpPeer is the client end of a UDP endpoint
+type udpPeer struct {
+	conn *net.UDPConn
+	C    chan *Packet
+}
+
+func dialUDP(t *testing.T, u *UDPServer) *udpPeer {
+	t.Helper()
+
+	conn, err := net.DialUDP("udp", nil, u.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	peer := &udpPeer{conn: conn, C: make(chan *Packet, 64)}
+	go func() {
+		buf := make([]byte, PACKET_MAX_SIZE)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if pkt, err := parseDatagram(buf[:n]); err == nil {
+				peer.C <- pkt
+			}
+		}
+	}()
+	return peer
+}
+
+func (p *udpPeer) send(pkt Packet, seq uint16) {
+	p.conn.Write(Reframe(pkt.data, VERSION_2, seq))
+}
+
+// bindToken asks for a bind token over c's TCP connection
+func bindToken(t *testing.T, c *Client, framer *PacketFramer) string {
+	t.Helper()
+
+	c.Write(ConstructPacket(EncString, PacketBindToken, []byte{}).data)
+	pkt, err := expectPacket(framer.C, PacketBindTokenSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pkt.Data())
+}
+
+// bind binds the peer to the session token was handed out for
+func (p *udpPeer) bind(t *testing.T, token string) {
+	t.Helper()
+
+	pkt, err := EncodeBind(EncString, Bind{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(pkt, 1)
+	if _, err := expectPacket(p.C, PacketBindSuccess); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectSilence fails if anything comes back for a while
+func (p *udpPeer) expectSilence(t *testing.T) {
+	t.Helper()
+
+	select {
+	case pkt := <-p.C:
+		t.Fatalf("Expected no reply. Got %s", TypeToString(pkt.Type()))
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// expectGameState waits for a game state datagram of
+// type gs and acks it
+func (p *udpPeer) expectGameState(t *testing.T, gs GameState) *Packet {
+	t.Helper()
+
+	pkt, err := expectGameState(p.C, gs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(ConstructPacket(EncBytes, PacketAck, []byte{}), pkt.Seq())
+	return pkt
+}
+
+func startUDPServer(t *testing.T) (*TCPServer, *UDPServer) {
+	t.Helper()
+	return startUDPServerWith(t, NewHub())
+}
+
+// startUDPServerWith is startUDPServer for a hub
+// with handlers of the test's own
+func startUDPServerWith(t *testing.T, hub *Hub) (*TCPServer, *UDPServer) {
+	t.Helper()
+
+	server := NewTCPServer("127.0.0.1:0", hub)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(hub.Close)
+	t.Cleanup(func() { server.Close() })
+
+	udp := NewUDPServer("127.0.0.1:0", hub)
+	if err := udp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+
+	return server, udp
+}
+
+func TestUDPGameState(t *testing.T) {
+	server, udp := startUDPServer(t)
+
+	host, guest, hostFramer, guestFramer := startTestGame(t, server.ln.Addr().String())
+	defer host.Disconnect()
+	defer guest.Disconnect()
+
+	hostUDP, guestUDP := dialUDP(t, udp), dialUDP(t, udp)
+	hostUDP.bind(t, bindToken(t, host, hostFramer))
+	guestUDP.bind(t, bindToken(t, guest, guestFramer))
+
+	// the turn goes in over UDP and is acked
+	attack := fullAttack(host.clientID, TeamTwo)
+	hostUDP.send(*attack, 2)
+	ack, err := expectPacket(hostUDP.C, PacketAck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Seq() != 2 {
+		t.Fatalf("Expected ack for seq 2. Got %d", ack.Seq())
+	}
+
+	// and what comes of it goes out over UDP
+	hostUDP.expectGameState(t, RESULT)
+	hostUDP.expectGameState(t, DEFENSE)
+	guestUDP.expectGameState(t, RESULT)
+	guestUDP.expectGameState(t, ATTACK)
+
+	// a duplicate is acked again but not played twice
+	hostUDP.send(*attack, 2)
+	if _, err := expectPacket(hostUDP.C, PacketAck); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-hostUDP.C:
+		t.Fatalf("Expected the duplicate to be dropped. Got %s", TypeToString(pkt.Type()))
+	case pkt := <-hostFramer.C:
+		t.Fatalf("Expected nothing over TCP. Got %s", TypeToString(pkt.Type()))
+	case pkt := <-guestFramer.C:
+		t.Fatalf("Expected nothing over TCP. Got %s", TypeToString(pkt.Type()))
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestUDPResend(t *testing.T) {
+	server, udp := startUDPServer(t)
+
+	host, guest, _, guestFramer := startTestGame(t, server.ln.Addr().String())
+	defer host.Disconnect()
+	defer guest.Disconnect()
+
+	guestUDP := dialUDP(t, udp)
+	guestUDP.bind(t, bindToken(t, guest, guestFramer))
+
+	host.Write(fullAttack(host.clientID, TeamTwo).data)
+
+	// unacked game state comes round again with the same seq
+	first, err := expectGameState(guestUDP.C, RESULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(guestUDP.C, ATTACK); err != nil {
+		t.Fatal(err)
+	}
+	again, err := expectGameState(guestUDP.C, RESULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Seq() != first.Seq() {
+		t.Fatalf("Expected resend of seq %d. Got %d", first.Seq(), again.Seq())
+	}
+
+	// until the server gives up and it all goes over TCP, in order
+	if _, err := expectGameState(guestFramer.C, RESULT); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expectGameState(guestFramer.C, ATTACK); err != nil {
+		t.Fatal(err)
+	}
+
+	// and stays there
+	guest.Write(fullAttack(guest.clientID, TeamOne).data)
+	if _, err := expectGameState(guestFramer.C, RESULT); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPUnbound(t *testing.T) {
+	server, udp := startUDPServer(t)
+
+	client, framer := dialClient(t, server.ln.Addr().String())
+	defer client.Disconnect()
+
+	// sources without a session get no answer, not even an error
+	peer := dialUDP(t, udp)
+	peer.send(*fullAttack(client.clientID, TeamTwo), 1)
+	peer.expectSilence(t)
+
+	pkt, _ := EncodeBind(EncString, Bind{Token: "not a session"})
+	peer.send(pkt, 2)
+	peer.expectSilence(t)
+
+	// sessions that are gone take their endpoint with them
+	peer.bind(t, bindToken(t, client, framer))
+	client.Write(ConstructPacket(EncString, PacketDisconnect, []byte{}).data)
+	time.Sleep(time.Millisecond * 50)
+
+	peer.send(*fullAttack(client.clientID, TeamTwo), 4)
+	peer.expectSilence(t)
+}
+
+func TestUDPBindToken(t *testing.T) {
+	server, udp := startUDPServer(t)
+	addr := server.ln.Addr().String()
+
+	client, framer := dialClient(t, addr)
+	defer client.Disconnect()
+
+	// the session token is no good for binding
+	peer := dialUDP(t, udp)
+	pkt, _ := EncodeBind(EncString, Bind{Token: client.session})
+	peer.send(pkt, 1)
+	peer.expectSilence(t)
+
+	// and a bind token stops working once another is asked for
+	stale := bindToken(t, client, framer)
+	token := bindToken(t, client, framer)
+	pkt, _ = EncodeBind(EncString, Bind{Token: stale})
+	peer.send(pkt, 2)
+	peer.expectSilence(t)
+	peer.bind(t, token)
+
+	// a bind token can't resume the session it binds to
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thief := NewClient(conn)
+	defer thief.Disconnect()
+
+	thiefFramer := NewPacketFramer()
+	go FrameWithReader(thiefFramer, thief.conn)
+	if _, err := expectPacket(thiefFramer.C, PacketAuth); err != nil {
+		t.Fatal(err)
+	}
+	thief.Write(ConstructPacket(EncString, PacketResume, []byte(token)).data)
+	if err := expectError(thiefFramer.C, ERROR_INVALID_SESSION); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPSlowHandler(t *testing.T) {
+	hub := NewHub()
+
+	// the first client's game state never gets past
+	// its handler until the test lets it
+	block := make(chan struct{})
+	handled := make(chan ClientID, 64)
+	var slow atomic.Value
+	hub.Handle(PacketGameState, func(p *Packet, c *Client) error {
+		if c.clientID == slow.Load() {
+			<-block
+		}
+		handled <- c.clientID
+		return nil
+	})
+	server, udp := startUDPServerWith(t, hub)
+	defer close(block)
+
+	slowClient, slowFramer := dialClient(t, server.ln.Addr().String())
+	defer slowClient.Disconnect()
+	fastClient, fastFramer := dialClient(t, server.ln.Addr().String())
+	defer fastClient.Disconnect()
+	slow.Store(slowClient.clientID)
+
+	slowUDP, fastUDP := dialUDP(t, udp), dialUDP(t, udp)
+	slowUDP.bind(t, bindToken(t, slowClient, slowFramer))
+	fastUDP.bind(t, bindToken(t, fastClient, fastFramer))
+
+	// one in the handler and a full queue behind it are acked,
+	// the rest are dropped for the client to send again
+	for seq := uint16(2); seq < 2+UDP_QUEUE_SIZE+4; seq++ {
+		slowUDP.send(*fullAttack(slowClient.clientID, TeamTwo), seq)
+		time.Sleep(time.Millisecond)
+	}
+	acks := 0
+	for done := false; !done; {
+		select {
+		case pkt := <-slowUDP.C:
+			if pkt.Type() == PacketAck {
+				acks++
+			}
+		case <-time.After(time.Millisecond * 200):
+			done = true
+		}
+	}
+	if acks > UDP_QUEUE_SIZE+1 {
+		t.Errorf("Expected at most %d acks. Got %d", UDP_QUEUE_SIZE+1, acks)
+	}
+
+	// and nobody else is kept waiting on them
+	fastUDP.send(*fullAttack(fastClient.clientID, TeamTwo), 2)
+	select {
+	case id := <-handled:
+		if id != fastClient.clientID {
+			t.Fatalf("Expected %s to be handled. Got %s", fastClient.clientID, id)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("A slow handler held up another client's UDP")
+	}
+}
+
+func TestUDPCloseTwice(t *testing.T) {
+	_, udp := startUDPServer(t)
+
+	udp.Close()
+	udp.Close()
+}
@@ -0,0 +1,715 @@
+// Code generated by protogen from protocol.json. DO NOT EDIT.
+
+export type ClientID = string;
+export type GameID = string;
+
+export const VERSION = 1;
+export const PACKET_MAX_SIZE = 1024;
+export const PACKET_HEADER_SIZE = 4;
+export const HEADER_LENGTH_OFFSET = 2;
+export const ENC_TYPE_OFFSET = 1;
+export const MAX_DATA_SIZE = PACKET_MAX_SIZE - PACKET_HEADER_SIZE;
+// version of the game state sub header
+export const GSVERSION = 1;
+
+export const GS_VERSION_OFFSET = 0;
+export const GS_TYPE_OFFSET = 1;
+export const GS_CLIENT_ID_OFFSET = 2;
+export const GS_DATA_OFFSET = 10;
+
+// Available encoding
+export enum Encoding {
+  EncCustom,
+  EncJSON,
+  EncString,
+  EncBytes,
+}
+
+// Available packet types
+export enum PacketType {
+  PacketAuth, // outbound
+  PacketHealthCheckReq,
+  PacketHealthCheckRes, // outbound
+  PacketError, // outbound
+  PacketCreateGame,
+  PacketCreateGameSuccess, // outbound
+  PacketJoinGame,
+  PacketJoinGameSuccess, // outbound
+  PacketStartGame,
+  PacketLeaveGame,
+  PacketLeaveGameSuccess,
+  PacketGameState,
+  PacketDisconnect,
+  PacketStartGameSuccess, // outbound
+  PacketSessionToken, // outbound
+  PacketResume,
+  PacketResumeSuccess, // outbound
+  PacketServerShutdown, // outbound
+  PacketHeartbeat, // outbound
+  PacketHeartbeatAck,
+  PacketHello,
+  PacketHelloAck, // outbound
+  PacketBind, // udp only
+  PacketBindSuccess, // outbound, udp only
+  PacketAck, // udp only, the seq in the header is the one acknowledged
+  PacketBindToken,
+  PacketBindTokenSuccess, // outbound, the token PacketBind takes
+}
+
+export enum GameState {
+  ATTACK,
+  DEFENSE,
+  RESULT, // outbound
+  WAITING, // game has not started yet
+  FINISHED, // game is over, no more game state is accepted
+}
+
+export enum TeamID {
+  TeamNone,
+  TeamOne,
+  TeamTwo,
+}
+
+export enum CharacterID {
+  UnitOne = 1,
+  UnitTwo,
+  UnitThree,
+}
+
+export enum Target {
+  EnemyTeam,
+  OwnTeam,
+}
+
+// GameRef names a game. As a string, bytes or custom
+// payload it is just the game ID
+export type GameRef = {
+  gameId: GameID;
+};
+
+// Heartbeat carries the nonce a heartbeat is acknowledged
+// with. As bytes or a custom payload it is the nonce as 8
+// big endian bytes
+export type Heartbeat = {
+  nonce: bigint;
+};
+
+// GameStateMessage is a game state update. As a custom payload it
+// uses the game state sub header. Decoded from a packet Data still
+// points into the packet so it is only good for as long as the packet is
+export type GameStateMessage = {
+  version: number;
+  state: GameState;
+  clientId: ClientID;
+  data: unknown;
+};
+
+export type Move = {
+  name: string;
+  damage: number; // negative heals
+  target: Target;
+  shield?: boolean;
+};
+
+// Attack mirrors the Attack type the client queues up.
+// Only the move name is trusted, the rest of the move
+// is looked up from Moves
+export type Attack = {
+  characterId: CharacterID;
+  targetId: CharacterID;
+  characterTeamId: TeamID;
+  targetTeamId: TeamID;
+  attack: Move;
+};
+
+// AttackResult is an Attack as the server resolved it. The
+// move damage is replaced with what was actually applied so
+// clients can keep rendering attack.damage as they do now
+export type AttackResult = Attack & {
+  targetHealth: number;
+};
+
+export type TurnResult = {
+  teamId: TeamID;
+  results: AttackResult[];
+  winner?: TeamID;
+};
+
+// StartInfo confirms the start of a game to each client
+// along with the seat they were given
+export type StartInfo = {
+  gameId: GameID;
+  teamId: TeamID;
+  host: ClientID;
+};
+
+// TurnState is sent to each client on every phase change.
+// The game state type of the packet carrying it is the
+// phase of the client receiving it, ATTACK or DEFENSE
+export type TurnState = {
+  turn: number;
+  activeTeam: TeamID;
+  teamId: TeamID;
+};
+
+// ResumeInfo tells a resumed client who it is again
+// and where it was seated
+export type ResumeInfo = {
+  clientId: ClientID;
+  gameId: GameID;
+  teamId: TeamID;
+};
+
+// ShutdownInfo is sent to every client when the server starts
+// shutting down. Deadline is when running games will be stopped,
+// zero if they get as long as they need
+export type ShutdownInfo = {
+  deadline?: string;
+};
+
+// Hello is what a client can speak. It is optional and sent in
+// answer to the auth challenge, before the actual answer. Empty
+// version and encoding lists mean the client takes whatever
+// the server picks
+export type Hello = {
+  versions: number[]; // packet header versions
+  gameStateVersions: number[];
+  encodings?: number[]; // must include EncJSON, EncString and EncBytes, game state is EncCustom if listed
+  capabilities?: string[];
+};
+
+// Negotiated is what the server picked out of a Hello
+// and holds the connection to until it goes away
+export type Negotiated = {
+  version: number;
+  gameStateVersion: number;
+  encodings: number[];
+  capabilities?: string[];
+};
+
+// Bind ties the UDP endpoint it is sent from to the
+// TCP session Token was handed out to by PacketBindToken.
+// As a string, bytes or custom payload it is just the token
+export type Bind = {
+  token: string;
+};
+
+// Error is the struct containing all
+// necessary fields to create a JSON
+// error response
+export type Error = {
+  code: number;
+  error: string;
+  message: string;
+  request?: RequestRef;
+};
+
+// RequestRef points an error back at the packet that caused it
+export type RequestRef = {
+  id: number;
+  type: PacketType;
+};
+
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+// bigints don't survive JSON.stringify, they are sent as plain
+// numbers and are only exact below 2^53
+function toJSON(msg: unknown): Uint8Array {
+  return textEncoder.encode(JSON.stringify(msg, (_, v) => typeof v === "bigint" ? Number(v) : v));
+}
+
+function fromJSON<T>(data: Uint8Array): T {
+  return JSON.parse(textDecoder.decode(data)) as T;
+}
+
+export type Packet = {
+  encoding: Encoding;
+  type: PacketType;
+  data: Uint8Array;
+};
+
+export function bitPack(enc: Encoding, type: PacketType): number {
+  return ((enc & 0x3) << 6) | (type & 0x3f);
+}
+
+// encodePacket frames data with a v1 header
+export function encodePacket(enc: Encoding, type: PacketType, data: Uint8Array): Uint8Array {
+  const buf = new Uint8Array(PACKET_HEADER_SIZE + data.length);
+  buf[0] = VERSION;
+  buf[ENC_TYPE_OFFSET] = bitPack(enc, type);
+  new DataView(buf.buffer).setUint16(HEADER_LENGTH_OFFSET, data.length);
+  buf.set(data, PACKET_HEADER_SIZE);
+  return buf;
+}
+
+// decodePacket reads the v1 packet at the front of buf. Returns
+// null until the whole packet has arrived
+export function decodePacket(buf: Uint8Array): { packet: Packet, size: number } | null {
+  if (buf.length < PACKET_HEADER_SIZE) {
+    return null;
+  }
+  if (buf[0] !== VERSION) {
+    throw new Error(`Unsupported packet version ${buf[0]}`);
+  }
+
+  const length = new DataView(buf.buffer, buf.byteOffset, buf.byteLength).getUint16(HEADER_LENGTH_OFFSET);
+  const size = PACKET_HEADER_SIZE + length;
+  if (buf.length < size) {
+    return null;
+  }
+
+  return {
+    packet: {
+      encoding: (buf[ENC_TYPE_OFFSET] >> 6) & 0x3,
+      type: buf[ENC_TYPE_OFFSET] & 0x3f,
+      data: buf.slice(PACKET_HEADER_SIZE, size),
+    },
+    size,
+  };
+}
+
+export function encodeGameRefPayload(msg: GameRef, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+    case Encoding.EncCustom:
+    case Encoding.EncBytes:
+    case Encoding.EncString:
+      {
+        const rest = textEncoder.encode(msg.gameId);
+        const buf = new Uint8Array(rest.length);
+        buf.set(rest, 0);
+        return buf;
+      }
+  }
+  throw new Error(`GameRef can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeGameRefPayload(data: Uint8Array, enc: Encoding): GameRef {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<GameRef>(data);
+    case Encoding.EncCustom:
+    case Encoding.EncBytes:
+    case Encoding.EncString:
+      {
+        return {
+          gameId: textDecoder.decode(data.subarray(0)),
+        };
+      }
+  }
+  throw new Error(`GameRef can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeHeartbeatPayload(msg: Heartbeat, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+    case Encoding.EncCustom:
+    case Encoding.EncBytes:
+      {
+        const buf = new Uint8Array(8);
+        const view = new DataView(buf.buffer);
+        view.setBigUint64(0, BigInt(msg.nonce));
+        return buf;
+      }
+  }
+  throw new Error(`Heartbeat can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeHeartbeatPayload(data: Uint8Array, enc: Encoding): Heartbeat {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<Heartbeat>(data);
+    case Encoding.EncCustom:
+    case Encoding.EncBytes:
+      {
+        if (data.length !== 8) {
+          throw new Error(`Heartbeat payload should be 8 bytes, got ${data.length}`);
+        }
+        const view = new DataView(data.buffer, data.byteOffset, data.byteLength);
+        return {
+          nonce: view.getBigUint64(0),
+        };
+      }
+  }
+  throw new Error(`Heartbeat can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeGameStateMessagePayload(msg: GameStateMessage, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+    case Encoding.EncCustom:
+      {
+        const rest = msg.data === undefined || msg.data === null ? new Uint8Array() : toJSON(msg.data);
+        const buf = new Uint8Array(10 + rest.length);
+        const view = new DataView(buf.buffer);
+        view.setUint8(GS_VERSION_OFFSET, msg.version);
+        view.setUint8(GS_TYPE_OFFSET, msg.state);
+        buf.set(textEncoder.encode(msg.clientId).subarray(0, 8), GS_CLIENT_ID_OFFSET);
+        buf.set(rest, GS_DATA_OFFSET);
+        return buf;
+      }
+  }
+  throw new Error(`GameStateMessage can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeGameStateMessagePayload(data: Uint8Array, enc: Encoding): GameStateMessage {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<GameStateMessage>(data);
+    case Encoding.EncCustom:
+      {
+        if (data.length < 10) {
+          throw new Error(`GameStateMessage payload should be at least 10 bytes, got ${data.length}`);
+        }
+        const view = new DataView(data.buffer, data.byteOffset, data.byteLength);
+        return {
+          version: view.getUint8(GS_VERSION_OFFSET),
+          state: view.getUint8(GS_TYPE_OFFSET),
+          clientId: textDecoder.decode(data.subarray(GS_CLIENT_ID_OFFSET, GS_CLIENT_ID_OFFSET + 8)),
+          data: data.length > GS_DATA_OFFSET ? fromJSON<unknown>(data.subarray(GS_DATA_OFFSET)) : null,
+        };
+      }
+  }
+  throw new Error(`GameStateMessage can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeMovePayload(msg: Move, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`Move can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeMovePayload(data: Uint8Array, enc: Encoding): Move {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<Move>(data);
+  }
+  throw new Error(`Move can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeAttackPayload(msg: Attack, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`Attack can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeAttackPayload(data: Uint8Array, enc: Encoding): Attack {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<Attack>(data);
+  }
+  throw new Error(`Attack can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeAttackResultPayload(msg: AttackResult, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`AttackResult can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeAttackResultPayload(data: Uint8Array, enc: Encoding): AttackResult {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<AttackResult>(data);
+  }
+  throw new Error(`AttackResult can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeTurnResultPayload(msg: TurnResult, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`TurnResult can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeTurnResultPayload(data: Uint8Array, enc: Encoding): TurnResult {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<TurnResult>(data);
+  }
+  throw new Error(`TurnResult can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeStartInfoPayload(msg: StartInfo, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`StartInfo can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeStartInfoPayload(data: Uint8Array, enc: Encoding): StartInfo {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<StartInfo>(data);
+  }
+  throw new Error(`StartInfo can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeTurnStatePayload(msg: TurnState, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`TurnState can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeTurnStatePayload(data: Uint8Array, enc: Encoding): TurnState {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<TurnState>(data);
+  }
+  throw new Error(`TurnState can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeResumeInfoPayload(msg: ResumeInfo, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`ResumeInfo can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeResumeInfoPayload(data: Uint8Array, enc: Encoding): ResumeInfo {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<ResumeInfo>(data);
+  }
+  throw new Error(`ResumeInfo can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeShutdownInfoPayload(msg: ShutdownInfo, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`ShutdownInfo can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeShutdownInfoPayload(data: Uint8Array, enc: Encoding): ShutdownInfo {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<ShutdownInfo>(data);
+  }
+  throw new Error(`ShutdownInfo can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeHelloPayload(msg: Hello, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`Hello can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeHelloPayload(data: Uint8Array, enc: Encoding): Hello {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<Hello>(data);
+  }
+  throw new Error(`Hello can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeNegotiatedPayload(msg: Negotiated, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`Negotiated can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeNegotiatedPayload(data: Uint8Array, enc: Encoding): Negotiated {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<Negotiated>(data);
+  }
+  throw new Error(`Negotiated can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeBindPayload(msg: Bind, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+    case Encoding.EncCustom:
+    case Encoding.EncBytes:
+    case Encoding.EncString:
+      {
+        const rest = textEncoder.encode(msg.token);
+        const buf = new Uint8Array(rest.length);
+        buf.set(rest, 0);
+        return buf;
+      }
+  }
+  throw new Error(`Bind can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeBindPayload(data: Uint8Array, enc: Encoding): Bind {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<Bind>(data);
+    case Encoding.EncCustom:
+    case Encoding.EncBytes:
+    case Encoding.EncString:
+      {
+        return {
+          token: textDecoder.decode(data.subarray(0)),
+        };
+      }
+  }
+  throw new Error(`Bind can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeErrorPayload(msg: Error, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`Error can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeErrorPayload(data: Uint8Array, enc: Encoding): Error {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<Error>(data);
+  }
+  throw new Error(`Error can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeRequestRefPayload(msg: RequestRef, enc: Encoding): Uint8Array {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return toJSON(msg);
+  }
+  throw new Error(`RequestRef can't be sent as ${Encoding[enc]}`);
+}
+
+export function decodeRequestRefPayload(data: Uint8Array, enc: Encoding): RequestRef {
+  switch (enc) {
+    case Encoding.EncJSON:
+      return fromJSON<RequestRef>(data);
+  }
+  throw new Error(`RequestRef can't be read as ${Encoding[enc]}`);
+}
+
+export function encodeError(msg: Error, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketError, encodeErrorPayload(msg, enc));
+}
+
+export function decodeError(pkt: Packet): Error {
+  return decodeErrorPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeCreateGameSuccess(msg: GameRef, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketCreateGameSuccess, encodeGameRefPayload(msg, enc));
+}
+
+export function decodeCreateGameSuccess(pkt: Packet): GameRef {
+  return decodeGameRefPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeJoinGame(msg: GameRef, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketJoinGame, encodeGameRefPayload(msg, enc));
+}
+
+export function decodeJoinGame(pkt: Packet): GameRef {
+  return decodeGameRefPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeJoinGameSuccess(msg: GameRef, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketJoinGameSuccess, encodeGameRefPayload(msg, enc));
+}
+
+export function decodeJoinGameSuccess(pkt: Packet): GameRef {
+  return decodeGameRefPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeStartGame(msg: GameRef, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketStartGame, encodeGameRefPayload(msg, enc));
+}
+
+export function decodeStartGame(pkt: Packet): GameRef {
+  return decodeGameRefPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeGameState(msg: GameStateMessage, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketGameState, encodeGameStateMessagePayload(msg, enc));
+}
+
+export function decodeGameState(pkt: Packet): GameStateMessage {
+  return decodeGameStateMessagePayload(pkt.data, pkt.encoding);
+}
+
+export function encodeStartGameSuccess(msg: StartInfo, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketStartGameSuccess, encodeStartInfoPayload(msg, enc));
+}
+
+export function decodeStartGameSuccess(pkt: Packet): StartInfo {
+  return decodeStartInfoPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeResumeSuccess(msg: ResumeInfo, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketResumeSuccess, encodeResumeInfoPayload(msg, enc));
+}
+
+export function decodeResumeSuccess(pkt: Packet): ResumeInfo {
+  return decodeResumeInfoPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeServerShutdown(msg: ShutdownInfo, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketServerShutdown, encodeShutdownInfoPayload(msg, enc));
+}
+
+export function decodeServerShutdown(pkt: Packet): ShutdownInfo {
+  return decodeShutdownInfoPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeHeartbeat(msg: Heartbeat, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketHeartbeat, encodeHeartbeatPayload(msg, enc));
+}
+
+export function decodeHeartbeat(pkt: Packet): Heartbeat {
+  return decodeHeartbeatPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeHeartbeatAck(msg: Heartbeat, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketHeartbeatAck, encodeHeartbeatPayload(msg, enc));
+}
+
+export function decodeHeartbeatAck(pkt: Packet): Heartbeat {
+  return decodeHeartbeatPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeHello(msg: Hello, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketHello, encodeHelloPayload(msg, enc));
+}
+
+export function decodeHello(pkt: Packet): Hello {
+  return decodeHelloPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeHelloAck(msg: Negotiated, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketHelloAck, encodeNegotiatedPayload(msg, enc));
+}
+
+export function decodeHelloAck(pkt: Packet): Negotiated {
+  return decodeNegotiatedPayload(pkt.data, pkt.encoding);
+}
+
+export function encodeBind(msg: Bind, enc: Encoding = Encoding.EncJSON): Uint8Array {
+  return encodePacket(enc, PacketType.PacketBind, encodeBindPayload(msg, enc));
+}
+
+export function decodeBind(pkt: Packet): Bind {
+  return decodeBindPayload(pkt.data, pkt.encoding);
+}
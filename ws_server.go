@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// magic value every websocket handshake hashes the client key with (RFC 6455 1.3)
+const WS_ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocolErr = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+)
+
+// how long Close waits on a peer to take the close frame
+const WS_CLOSE_TIMEOUT = time.Millisecond * 100
+
+var (
+	ERROR_WS_PROTOCOL        = errors.New("WebSocket protocol error")
+	ERROR_WS_UNSUPPORTED     = errors.New("WebSocket text frames are not supported")
+	ERROR_WS_FRAME_TOO_LARGE = errors.New("WebSocket frame too large")
+)
+
+// WSServer is a gateway for browsers since they cant
+// open raw tcp connections. Every binary message carries
+// the same Packet frames the TCPServer reads, and each
+// connection is handed to the Hub so both share the same
+// handlers and GameManager
+type WSServer struct {
+	addr string
+	path string
+	hub  *Hub
+	ln   net.Listener
+	srv  *http.Server
+
+	// hijacked connections are out of srv's hands,
+	// kept here so Close can shut them down
+	mu    sync.Mutex
+	conns map[*wsConn]struct{}
+}
+
+func NewWSServer(addr string, hub *Hub) *WSServer {
+	return &WSServer{
+		addr:  addr,
+		path:  "/ws",
+		hub:   hub,
+		conns: make(map[*wsConn]struct{}),
+	}
+}
+
+func (w *WSServer) Start() error {
+	ln, err := net.Listen("tcp", w.addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(w.path, w.upgrade)
+
+	w.ln = ln
+	w.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := w.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("WebSocket serve error: %s\n", err)
+		}
+	}()
+
+	log.Printf("WebSocket gateway listening on %s%s", w.addr, w.path)
+
+	return nil
+}
+
+func (w *WSServer) Close() error {
+	err := w.srv.Close()
+
+	w.mu.Lock()
+	conns := w.conns
+	w.conns = make(map[*wsConn]struct{})
+	w.mu.Unlock()
+
+	for ws := range conns {
+		ws.Close()
+	}
+	return err
+}
+
+func (w *WSServer) upgrade(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(rw, "Expected websocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(rw, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(rw, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "Websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("WebSocket hijack error: %s\n", err)
+		return
+	}
+
+	res := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(res)); err != nil {
+		conn.Close()
+		return
+	}
+
+	ws := newWSConn(conn, brw.Reader, false)
+	ws.onClose = func() {
+		w.mu.Lock()
+		delete(w.conns, ws)
+		w.mu.Unlock()
+	}
+
+	w.mu.Lock()
+	w.conns[ws] = struct{}{}
+	w.mu.Unlock()
+
+	w.hub.Serve(ws)
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + WS_ACCEPT_GUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn implements net.Conn over a websocket so the rest of
+// the server can treat it like any other stream. Reads return
+// the payload of binary messages back to back, the framer does
+// the rest. Every Write is sent as one binary message
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+	// client side conns mask their writes and expect unmasked reads
+	client bool
+
+	// read state for the frame currently being consumed
+	remaining uint64
+	mask      [4]byte
+	maskIdx   int
+	// set between the first frame of a fragmented
+	// message and the one with FIN set
+	fragmented bool
+
+	wmu    sync.Mutex
+	closed bool
+	// called once the connection is closed, if set
+	onClose func()
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, client bool) *wsConn {
+	return &wsConn{
+		Conn:   conn,
+		br:     br,
+		client: client,
+	}
+}
+
+func (w *wsConn) Read(p []byte) (int, error) {
+	for w.remaining == 0 {
+		if err := w.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > w.remaining {
+		p = p[:w.remaining]
+	}
+
+	n, err := w.br.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= w.mask[w.maskIdx]
+		w.maskIdx = (w.maskIdx + 1) % 4
+	}
+	w.remaining -= uint64(n)
+
+	return n, err
+}
+
+// nextFrame reads frame headers until it finds a data frame,
+// answering control frames on the way
+func (w *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(w.br, hdr[:]); err != nil {
+		return err
+	}
+
+	fin := hdr[0]&0x80 != 0
+	opcode := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7F)
+
+	// clients are required to mask every frame, servers never do
+	if masked == w.client {
+		w.closeWith(wsCloseProtocolErr)
+		return ERROR_WS_PROTOCOL
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(w.br, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(w.br, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	w.mask = [4]byte{}
+	w.maskIdx = 0
+	if masked {
+		if _, err := io.ReadFull(w.br, w.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpBinary, wsOpContinuation:
+		// a continuation has to follow a frame without FIN,
+		// and nothing else can until the message is done
+		if (opcode == wsOpContinuation) != w.fragmented {
+			w.closeWith(wsCloseProtocolErr)
+			return ERROR_WS_PROTOCOL
+		}
+		w.fragmented = !fin
+		if length > PACKET_MAX_SIZE {
+			w.closeWith(wsCloseTooBig)
+			return ERROR_WS_FRAME_TOO_LARGE
+		}
+		w.remaining = length
+		return nil
+	case wsOpText:
+		w.closeWith(wsCloseUnsupported)
+		return ERROR_WS_UNSUPPORTED
+	}
+
+	// control frames cant be fragmented and carry at most 125 bytes
+	if !fin || length > 125 {
+		w.closeWith(wsCloseProtocolErr)
+		return ERROR_WS_PROTOCOL
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(w.br, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= w.mask[i%4]
+	}
+
+	switch opcode {
+	case wsOpPing:
+		w.writeFrame(wsOpPong, payload)
+		return nil
+	case wsOpPong:
+		return nil
+	case wsOpClose:
+		w.closeWith(wsCloseNormal)
+		return io.EOF
+	}
+
+	w.closeWith(wsCloseProtocolErr)
+	return ERROR_WS_PROTOCOL
+}
+
+func (w *wsConn) Write(p []byte) (int, error) {
+	if err := w.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *wsConn) writeFrame(opcode byte, payload []byte) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	return w.writeFrameLocked(opcode, payload)
+}
+
+// SetWriteDeadline waits on a close frame going out so it
+// can't push back the deadline Close gave it
+func (w *wsConn) SetWriteDeadline(t time.Time) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	if w.closed {
+		return net.ErrClosed
+	}
+	return w.Conn.SetWriteDeadline(t)
+}
+
+// writeFrameLocked is writeFrame for callers holding wmu
+func (w *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	if w.closed {
+		return net.ErrClosed
+	}
+
+	hdr := make([]byte, 2, 14)
+	hdr[0] = 0x80 | opcode
+	switch {
+	case len(payload) <= 125:
+		hdr[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(payload)))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(payload)))
+	}
+
+	if !w.client {
+		_, err := w.Conn.Write(append(hdr, payload...))
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	hdr[1] |= 0x80
+	hdr = append(hdr, mask[:]...)
+
+	frame := append(hdr, payload...)
+	body := frame[len(hdr):]
+	for i := range body {
+		body[i] ^= mask[i%4]
+	}
+
+	_, err := w.Conn.Write(frame)
+	return err
+}
+
+// closeWith sends a close frame with the given status code.
+// The underlying connection is left for Close to shut down
+func (w *wsConn) closeWith(code uint16) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	w.writeFrame(wsOpClose, payload)
+
+	w.wmu.Lock()
+	w.closed = true
+	w.wmu.Unlock()
+}
+
+// Close says goodbye with a close frame unless a write is still in
+// flight. That write holds wmu until the peer takes it or the write
+// deadline is up, closing the connection under it is what gets a
+// stalled peer let go of without waiting on it. The close frame
+// itself only gets WS_CLOSE_TIMEOUT to go out
+func (w *wsConn) Close() error {
+	if w.wmu.TryLock() {
+		if !w.closed {
+			w.Conn.SetWriteDeadline(time.Now().Add(WS_CLOSE_TIMEOUT))
+			w.writeFrameLocked(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+			w.closed = true
+		}
+		w.wmu.Unlock()
+	}
+	if w.onClose != nil {
+		w.onClose()
+	}
+	return w.Conn.Close()
+}
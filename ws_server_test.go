@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWSGatewaySharesGames(t *testing.T) {
+	hub := NewHub()
+	server := NewTCPServer("127.0.0.1:0", hub)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	defer server.Close()
+
+	gateway := NewWSServer("127.0.0.1:0", hub)
+	if err := gateway.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := NewClient(conn)
+	defer host.Disconnect()
+
+	hostFramer := NewPacketFramer()
+	go FrameWithReader(hostFramer, host.conn)
+	if err := authenticate(hostFramer.C, host); err != nil {
+		t.Fatal(err)
+	}
+
+	wsConn, err := dialWS(gateway.ln.Addr().String(), gateway.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := NewClient(wsConn)
+	defer browser.Disconnect()
+
+	browserFramer := NewPacketFramer()
+	go FrameWithReader(browserFramer, browser.conn)
+	if err := authenticate(browserFramer.C, browser); err != nil {
+		t.Fatal(err)
+	}
+
+	host.Write(ConstructPacket(EncString, PacketCreateGame, []byte{}).data)
+	var id []byte
+	select {
+	case pkt := <-hostFramer.C:
+		if pkt.Type() != PacketCreateGameSuccess {
+			t.Fatalf("Expected PacketCreateGameSuccess. Got %s", TypeToString(pkt.Type()))
+		}
+		id = pkt.Data()
+	case <-time.After(time.Second * 5):
+		t.Fatal(ERROR_SERVER_TIMEOUT)
+	}
+
+	browser.Write(ConstructPacket(EncString, PacketJoinGame, id).data)
+	select {
+	case pkt := <-browserFramer.C:
+		if pkt.Type() != PacketJoinGameSuccess {
+			t.Fatalf("Expected PacketJoinGameSuccess. Got %s", TypeToString(pkt.Type()))
+		}
+		if string(pkt.Data()) != string(id) {
+			t.Fatalf("Joined game %s, want %s", pkt.Data(), id)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal(ERROR_SERVER_TIMEOUT)
+	}
+}
+
+// wsFrame builds a masked client frame, the zero
+// mask leaves the payload as it is
+func wsFrame(fin bool, opcode byte, payload []byte) []byte {
+	if fin {
+		opcode |= 0x80
+	}
+	return append([]byte{opcode, 0x80 | byte(len(payload)), 0, 0, 0, 0}, payload...)
+}
+
+func TestWSFragmentSequencing(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   []byte
+		close  uint16
+	}{
+		{
+			name: "fragmented message",
+			frames: [][]byte{
+				wsFrame(false, wsOpBinary, []byte("ab")),
+				// control frames can come in between
+				wsFrame(true, wsOpPing, []byte{}),
+				wsFrame(true, wsOpContinuation, []byte("cd")),
+				wsFrame(true, wsOpClose, []byte{}),
+			},
+			want:  []byte("abcd"),
+			close: wsCloseNormal,
+		},
+		{
+			name: "continuation with nothing started",
+			frames: [][]byte{
+				wsFrame(true, wsOpContinuation, []byte("ab")),
+			},
+			close: wsCloseProtocolErr,
+		},
+		{
+			name: "new message before the last is done",
+			frames: [][]byte{
+				wsFrame(false, wsOpBinary, []byte("ab")),
+				wsFrame(true, wsOpBinary, []byte("cd")),
+			},
+			want:  []byte("ab"),
+			close: wsCloseProtocolErr,
+		},
+		{
+			name: "fragmented control frame",
+			frames: [][]byte{
+				wsFrame(false, wsOpPing, []byte{}),
+			},
+			close: wsCloseProtocolErr,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, peer := net.Pipe()
+			defer peer.Close()
+			ws := newWSConn(server, bufio.NewReader(server), false)
+			defer ws.Close()
+
+			go func() {
+				for _, f := range test.frames {
+					if _, err := peer.Write(f); err != nil {
+						return
+					}
+				}
+			}()
+
+			read := make(chan []byte, 1)
+			go func() {
+				data, _ := io.ReadAll(ws)
+				read <- data
+			}()
+
+			// skip the pongs, the close frame is the last word
+			br := bufio.NewReader(peer)
+			for {
+				var hdr [2]byte
+				if _, err := io.ReadFull(br, hdr[:]); err != nil {
+					t.Fatal(err)
+				}
+				payload := make([]byte, hdr[1]&0x7F)
+				if _, err := io.ReadFull(br, payload); err != nil {
+					t.Fatal(err)
+				}
+				if hdr[0]&0x0F != wsOpClose {
+					continue
+				}
+				if code := binary.BigEndian.Uint16(payload); code != test.close {
+					t.Fatalf("Expected close %d. Got %d", test.close, code)
+				}
+				break
+			}
+
+			if data := <-read; !bytes.Equal(data, test.want) {
+				t.Fatalf("Expected to read %q. Got %q", test.want, data)
+			}
+		})
+	}
+}
+
+func TestWSCloseHijacked(t *testing.T) {
+	hub := NewHub()
+	defer hub.Close()
+
+	gateway := NewWSServer("127.0.0.1:0", hub)
+	if err := gateway.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	wsConn, err := dialWS(gateway.ln.Addr().String(), gateway.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := NewClient(wsConn)
+	defer browser.Disconnect()
+
+	framer := NewPacketFramer()
+	go FrameWithReader(framer, browser.conn)
+	if err := authenticate(framer.C, browser); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upgraded connection goes down with the gateway
+	gateway.Close()
+	select {
+	case <-framer.errch:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected the connection to be closed")
+	}
+}
+
+func TestWSStalledClient(t *testing.T) {
+	// nobody ever reads from remote, the writer is stuck
+	// part way through a frame
+	server, remote := net.Pipe()
+	defer remote.Close()
+	client := NewClient(newWSConn(server, bufio.NewReader(server), false))
+	client.clientID = "10000001"
+
+	pkt := ConstructPacket(EncString, PacketHealthCheckRes, []byte("Im alive :D"))
+
+	// giving up on the client doesn't wait on the stuck write
+	start := time.Now()
+	for i := 0; i < CLIENT_QUEUE_SIZE*2; i++ {
+		if _, err := client.Write(pkt.data); err != nil {
+			if err != ERROR_CLIENT_TOO_SLOW {
+				t.Fatalf("Expected %v. Got %v", ERROR_CLIENT_TOO_SLOW, err)
+			}
+			break
+		}
+	}
+	if took := time.Since(start); took > WRITE_TIMEOUT/2 {
+		t.Fatalf("Expected a stalled client to be let go of right away. Took %s", took)
+	}
+
+	if _, err := client.Write(pkt.data); err != ERROR_CLIENT_TOO_SLOW {
+		t.Fatalf("Expected %v once the client is cut loose. Got %v", ERROR_CLIENT_TOO_SLOW, err)
+	}
+}